@@ -0,0 +1,263 @@
+package aoi
+
+import (
+	"errors"
+	"gobonbon/iface"
+	"gobonbon/network"
+	"sync"
+)
+
+var ErrNoConnMgr = errors.New("aoi: connection manager not set")
+
+/*
+九宫格AOI，把地图按cellSize划分成格子，实体能看到周围viewRange圈格子中的实体
+viewRange为1时是3x3的九宫格，视野是对称的：A能看到B时B也能看到A
+
+	g := aoi.NewGrid(0, 0, 1000, 1000, 50, 1)
+	g.SetBroadcast(s.GetConnMgr(), s.GetMsgParser())
+	appeared := g.Enter(connID, x, y)               //通知appeared中的实体有人进入视野
+	appeared, disappeared := g.Move(connID, x, y)
+	disappeared := g.Leave(connID)
+	g.BroadcastNearby(connID, msgId, data)          //发给视野内的其他玩家
+
+实体ID一般使用connID，不能为0，NPC等没有连接的实体也可以加入，广播时跳过
+超出地图范围的坐标按边上的格子计算，可以在任意goroutine中使用
+*/
+type Grid struct {
+	lock      sync.RWMutex
+	minX      float64
+	minY      float64
+	cellSize  float64
+	cols      int
+	rows      int
+	viewRange int
+	cells     []map[uint64]struct{} //格子 -> 格子中的实体
+	entities  map[uint64]*entity
+
+	connMgr   iface.IConnManager
+	msgParser iface.IMsgParser
+}
+
+type entity struct {
+	x, y float64
+	cell int
+}
+
+/*
+创建AOI格子，地图范围是[minX, maxX) x [minY, maxY)
+cellSize为格子的边长，一般和视野半径差不多；viewRange为视野的格子圈数，至少为1
+参数不合法时panic
+*/
+func NewGrid(minX, minY, maxX, maxY, cellSize float64, viewRange int) *Grid {
+	if maxX <= minX || maxY <= minY || cellSize <= 0 || viewRange < 1 {
+		panic("aoi: invalid grid")
+	}
+	cols := int((maxX-minX)/cellSize) + 1
+	rows := int((maxY-minY)/cellSize) + 1
+	g := &Grid{
+		minX:      minX,
+		minY:      minY,
+		cellSize:  cellSize,
+		cols:      cols,
+		rows:      rows,
+		viewRange: viewRange,
+		cells:     make([]map[uint64]struct{}, cols*rows),
+		entities:  make(map[uint64]*entity),
+	}
+	for i := range g.cells {
+		g.cells[i] = make(map[uint64]struct{})
+	}
+	return g
+}
+
+// 设置广播使用的连接管理和封包，msgParser需要和连接使用的一致
+func (g *Grid) SetBroadcast(connMgr iface.IConnManager, msgParser iface.IMsgParser) {
+	g.lock.Lock()
+	g.connMgr = connMgr
+	g.msgParser = msgParser
+	g.lock.Unlock()
+}
+
+// 坐标所在格子的行列，超出范围时取边上的格子
+func (g *Grid) colRow(x, y float64) (int, int) {
+	col := int((x - g.minX) / g.cellSize)
+	row := int((y - g.minY) / g.cellSize)
+	if col < 0 || x < g.minX {
+		col = 0
+	} else if col >= g.cols {
+		col = g.cols - 1
+	}
+	if row < 0 || y < g.minY {
+		row = 0
+	} else if row >= g.rows {
+		row = g.rows - 1
+	}
+	return col, row
+}
+
+// 格子周围viewRange圈的范围，包含两端
+type area struct {
+	col0, row0, col1, row1 int
+}
+
+func (g *Grid) areaOf(cell int) area {
+	col, row := cell%g.cols, cell/g.cols
+	a := area{col - g.viewRange, row - g.viewRange, col + g.viewRange, row + g.viewRange}
+	if a.col0 < 0 {
+		a.col0 = 0
+	}
+	if a.row0 < 0 {
+		a.row0 = 0
+	}
+	if a.col1 >= g.cols {
+		a.col1 = g.cols - 1
+	}
+	if a.row1 >= g.rows {
+		a.row1 = g.rows - 1
+	}
+	return a
+}
+
+func (a area) contains(col, row int) bool {
+	return col >= a.col0 && col <= a.col1 && row >= a.row0 && row <= a.row1
+}
+
+// 把范围a中除self之外的实体加到ids，跳过同时在except中的格子
+func (g *Grid) collect(ids []uint64, a area, except *area, self uint64) []uint64 {
+	for row := a.row0; row <= a.row1; row++ {
+		for col := a.col0; col <= a.col1; col++ {
+			if except != nil && except.contains(col, row) {
+				continue
+			}
+			for id := range g.cells[row*g.cols+col] {
+				if id != self {
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	return ids
+}
+
+/*
+实体进入地图，返回进入后视野内的其他实体，它们需要收到这个实体出现的通知
+实体已经存在时按Move处理，只返回新出现的实体
+*/
+func (g *Grid) Enter(id uint64, x, y float64) (appeared []uint64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if _, ok := g.entities[id]; ok {
+		appeared, _ = g.move(id, x, y)
+		return appeared
+	}
+	return g.enter(id, x, y)
+}
+
+func (g *Grid) enter(id uint64, x, y float64) []uint64 {
+	col, row := g.colRow(x, y)
+	cell := row*g.cols + col
+	g.entities[id] = &entity{x: x, y: y, cell: cell}
+	g.cells[cell][id] = struct{}{}
+	return g.collect(nil, g.areaOf(cell), nil, id)
+}
+
+/*
+实体移动，返回新进入视野和离开视野的实体
+在同一个格子里移动时都为空；实体不存在时按Enter处理
+*/
+func (g *Grid) Move(id uint64, x, y float64) (appeared, disappeared []uint64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if _, ok := g.entities[id]; !ok {
+		return g.enter(id, x, y), nil
+	}
+	return g.move(id, x, y)
+}
+
+func (g *Grid) move(id uint64, x, y float64) (appeared, disappeared []uint64) {
+	e := g.entities[id]
+	e.x, e.y = x, y
+	col, row := g.colRow(x, y)
+	cell := row*g.cols + col
+	if cell == e.cell {
+		return nil, nil
+	}
+	oldArea, newArea := g.areaOf(e.cell), g.areaOf(cell)
+	delete(g.cells[e.cell], id)
+	g.cells[cell][id] = struct{}{}
+	e.cell = cell
+	appeared = g.collect(nil, newArea, &oldArea, id)
+	disappeared = g.collect(nil, oldArea, &newArea, id)
+	return appeared, disappeared
+}
+
+// 实体离开地图，返回离开前视野内的其他实体，它们需要收到这个实体消失的通知
+func (g *Grid) Leave(id uint64) (disappeared []uint64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	e, ok := g.entities[id]
+	if !ok {
+		return nil
+	}
+	delete(g.cells[e.cell], id)
+	delete(g.entities, id)
+	return g.collect(nil, g.areaOf(e.cell), nil, id)
+}
+
+// 实体的坐标
+func (g *Grid) Pos(id uint64) (x, y float64, ok bool) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	e, ok := g.entities[id]
+	if !ok {
+		return 0, 0, false
+	}
+	return e.x, e.y, true
+}
+
+// 实体的数量
+func (g *Grid) Len() int {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return len(g.entities)
+}
+
+// 实体视野内的其他实体，实体不存在时返回nil
+func (g *Grid) Nearby(id uint64) []uint64 {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	e, ok := g.entities[id]
+	if !ok {
+		return nil
+	}
+	return g.collect(nil, g.areaOf(e.cell), nil, id)
+}
+
+// 坐标周围能看到的实体，比如技能范围、掉落通知
+func (g *Grid) NearbyPos(x, y float64) []uint64 {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	col, row := g.colRow(x, y)
+	return g.collect(nil, g.areaOf(row*g.cols+col), nil, 0)
+}
+
+/*
+把消息发给connID视野内的其他玩家，不包括自己，数据只封包一次
+没有连接的实体（NPC或已经断开的玩家）跳过，需要先 SetBroadcast
+*/
+func (g *Grid) BroadcastNearby(connID uint64, msgId uint32, data []byte) error {
+	g.lock.RLock()
+	connMgr, msgParser := g.connMgr, g.msgParser
+	g.lock.RUnlock()
+	if connMgr == nil || msgParser == nil {
+		return ErrNoConnMgr
+	}
+	ids := g.Nearby(connID)
+	conns := make([]iface.IConn, 0, len(ids))
+	for _, id := range ids {
+		if conn, err := connMgr.Get(id); err == nil {
+			conns = append(conns, conn)
+		}
+	}
+	return network.Broadcast(msgParser, conns, msgId, data)
+}
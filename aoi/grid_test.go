@@ -0,0 +1,226 @@
+package aoi
+
+import (
+	"gobonbon/iface"
+	"gobonbon/log"
+	"gobonbon/msgparser"
+	"gobonbon/nettest"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// 按定义逐个比较格子距离，用来检查Grid的结果
+func bruteNearby(g *Grid, id uint64) []uint64 {
+	e := g.entities[id]
+	col, row := e.cell%g.cols, e.cell/g.cols
+	var ids []uint64
+	for other, o := range g.entities {
+		ocol, orow := o.cell%g.cols, o.cell/g.cols
+		if other != id && abs(ocol-col) <= g.viewRange && abs(orow-row) <= g.viewRange {
+			ids = append(ids, other)
+		}
+	}
+	return sorted(ids)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func sorted(ids []uint64) []uint64 {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func equal(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestGridEnterMoveLeave(t *testing.T) {
+	g := NewGrid(0, 0, 100, 100, 10, 1)
+	if got := g.Enter(1, 5, 5); len(got) != 0 {
+		t.Fatalf("Enter 1 = %v", got)
+	}
+	if got := g.Enter(2, 15, 15); !equal(got, []uint64{1}) {
+		t.Fatalf("Enter 2 = %v", got)
+	}
+	g.Enter(3, 95, 95)
+	// 同一个格子里移动没有变化
+	if a, d := g.Move(2, 16, 16); a != nil || d != nil {
+		t.Fatalf("Move in cell = %v %v", a, d)
+	}
+	a, d := g.Move(2, 85, 85)
+	if !equal(a, []uint64{3}) || !equal(d, []uint64{1}) {
+		t.Fatalf("Move = %v %v", a, d)
+	}
+	// 超出范围的坐标按边上的格子计算
+	g.Enter(4, 1000, -5)
+	if got := g.NearbyPos(95, 0); !equal(got, []uint64{4}) {
+		t.Fatalf("NearbyPos = %v", got)
+	}
+	if got := sorted(g.Leave(2)); !equal(got, []uint64{3}) {
+		t.Fatalf("Leave = %v", got)
+	}
+	if g.Len() != 3 || g.Nearby(2) != nil {
+		t.Fatal("Leave failed")
+	}
+}
+
+func TestGridRandom(t *testing.T) {
+	g := NewGrid(-500, -500, 500, 500, 30, 2)
+	r := rand.New(rand.NewSource(1))
+	for id := uint64(1); id <= 500; id++ {
+		g.Enter(id, r.Float64()*1100-550, r.Float64()*1100-550)
+	}
+	for i := 0; i < 2000; i++ {
+		id := uint64(r.Intn(500) + 1)
+		before := bruteNearby(g, id)
+		a, d := g.Move(id, r.Float64()*1000-500, r.Float64()*1000-500)
+		after := bruteNearby(g, id)
+		// after = before - disappeared + appeared
+		set := make(map[uint64]bool)
+		for _, v := range before {
+			set[v] = true
+		}
+		for _, v := range d {
+			if !set[v] {
+				t.Fatalf("disappeared %d not visible before", v)
+			}
+			delete(set, v)
+		}
+		for _, v := range a {
+			if set[v] {
+				t.Fatalf("appeared %d already visible", v)
+			}
+			set[v] = true
+		}
+		var got []uint64
+		for v := range set {
+			got = append(got, v)
+		}
+		if !equal(sorted(got), after) || !equal(sorted(g.Nearby(id)), after) {
+			t.Fatalf("move %d: nearby mismatch", id)
+		}
+	}
+}
+
+func TestBroadcastNearby(t *testing.T) {
+	s := nettest.NewServer()
+	g := NewGrid(0, 0, 100, 100, 10, 1)
+	if err := g.BroadcastNearby(1, 1, nil); err != ErrNoConnMgr {
+		t.Fatalf("BroadcastNearby = %v", err)
+	}
+	g.SetBroadcast(s.ConnMgr, msgparser.NewMsgParserWithMaxPacketSize(4096))
+	c1, c2, c3 := s.Connect(), s.Connect(), s.Connect()
+	ids := map[*nettest.Conn]uint64{c1: c1.Peer().GetConnID(), c2: c2.Peer().GetConnID(), c3: c3.Peer().GetConnID()}
+	g.Enter(ids[c1], 5, 5)
+	g.Enter(ids[c2], 15, 5)
+	g.Enter(ids[c3], 95, 95)
+	g.Enter(100000, 5, 15) //NPC没有连接
+
+	if err := g.BroadcastNearby(ids[c1], 7, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := c2.RecvAll(); len(msgs) != 1 || string(msgs[0].GetData()) != "hi" {
+		t.Fatalf("c2 got %v", msgs)
+	}
+	if len(c1.RecvAll()) != 0 || len(c3.RecvAll()) != 0 {
+		t.Fatal("c1 or c3 received")
+	}
+}
+
+const benchEntities = 10000
+
+// 1万个实体分布在1000x1000的地图上，格子边长50，九宫格内平均约225个实体
+func benchGrid() (*Grid, *rand.Rand) {
+	g := NewGrid(0, 0, 1000, 1000, 50, 1)
+	r := rand.New(rand.NewSource(1))
+	for id := uint64(1); id <= benchEntities; id++ {
+		g.Enter(id, r.Float64()*1000, r.Float64()*1000)
+	}
+	return g, r
+}
+
+func BenchmarkEnterLeave10k(b *testing.B) {
+	g, r := benchGrid()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id := uint64(benchEntities + 1)
+		g.Enter(id, r.Float64()*1000, r.Float64()*1000)
+		g.Leave(id)
+	}
+}
+
+// 每次移动一小步，大部分在同一个格子里
+func BenchmarkMoveStep10k(b *testing.B) {
+	g, r := benchGrid()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id := uint64(i%benchEntities + 1)
+		x, y, _ := g.Pos(id)
+		g.Move(id, x+r.Float64()*10-5, y+r.Float64()*10-5)
+	}
+}
+
+// 每次都换到随机的位置，最坏情况
+func BenchmarkMoveJump10k(b *testing.B) {
+	g, r := benchGrid()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.Move(uint64(i%benchEntities+1), r.Float64()*1000, r.Float64()*1000)
+	}
+}
+
+func BenchmarkNearby10k(b *testing.B) {
+	g, _ := benchGrid()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.Nearby(uint64(i%benchEntities + 1))
+	}
+}
+
+func BenchmarkNearbyParallel10k(b *testing.B) {
+	g, _ := benchGrid()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			g.Nearby(uint64(i%benchEntities + 1))
+			i++
+		}
+	})
+}
+
+func BenchmarkBroadcastNearby10k(b *testing.B) {
+	log.SetModuleLevel("network", "info")
+	defer log.SetModuleLevel("network", "")
+	s := nettest.NewServer()
+	g := NewGrid(0, 0, 1000, 1000, 50, 1)
+	g.SetBroadcast(s.ConnMgr, msgparser.NewMsgParserWithMaxPacketSize(4096))
+	r := rand.New(rand.NewSource(1))
+	ids := make([]uint64, 0, benchEntities)
+	for i := 0; i < benchEntities; i++ {
+		c := s.Connect()
+		c.SetOnMsg(func(*nettest.Conn, iface.IMessage) {})
+		id := c.Peer().GetConnID()
+		ids = append(ids, id)
+		g.Enter(id, r.Float64()*1000, r.Float64()*1000)
+	}
+	data := make([]byte, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.BroadcastNearby(ids[i%benchEntities], 1, data)
+	}
+}
@@ -0,0 +1,211 @@
+package chanrpc
+
+import (
+	"errors"
+	"fmt"
+	"gobonbon/log"
+	"runtime/debug"
+)
+
+var (
+	ErrClosed = errors.New("chanrpc server closed")
+	ErrFull   = errors.New("chanrpc server channel full")
+)
+
+// chanrpc的日志，等级可以用 log.SetModuleLevel("chanrpc", ...) 单独调整
+var rpcLog = log.Module("chanrpc")
+
+// 处理一个调用，args为调用时传入的参数
+type Handler func(args []interface{}) (interface{}, error)
+
+/*
+基于channel的RPC服务端，一个模块的信箱
+
+	s := chanrpc.NewServer(1024)
+	s.Register("AddScore", func(args []interface{}) (interface{}, error) {
+		return addScore(args[0].(uint64), args[1].(int)), nil
+	})
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+	ret, err := s.Call("AddScore", userID, 10) //其他goroutine中同步调用
+
+Handler只在执行 Exec 的goroutine中运行，不需要加锁；Handler中panic时调用方收到错误
+*/
+type Server struct {
+	functions map[interface{}]Handler
+	ChanCall  chan *CallInfo //等待执行的调用
+}
+
+// 一次调用
+type CallInfo struct {
+	id      interface{}
+	args    []interface{}
+	chanRet chan *RetInfo //nil表示不需要返回
+	cb      func(ret interface{}, err error)
+}
+
+// 调用的结果，异步调用的结果通过 Client.Cb 执行回调
+type RetInfo struct {
+	ret interface{}
+	err error
+	cb  func(ret interface{}, err error)
+}
+
+// 创建服务端，l为信箱的长度
+func NewServer(l int) *Server {
+	return &Server{
+		functions: make(map[interface{}]Handler),
+		ChanCall:  make(chan *CallInfo, l),
+	}
+}
+
+// 注册调用的处理方法，需要在开始处理调用之前注册，重复注册时panic
+func (s *Server) Register(id interface{}, f Handler) {
+	if _, ok := s.functions[id]; ok {
+		panic(fmt.Sprintf("function id %v: already registered", id))
+	}
+	s.functions[id] = f
+}
+
+func (s *Server) ret(ci *CallInfo, ri *RetInfo) {
+	if ci.chanRet == nil {
+		return
+	}
+	ri.cb = ci.cb
+	ci.chanRet <- ri
+}
+
+// 执行一个调用，在服务端的goroutine中调用
+func (s *Server) Exec(ci *CallInfo) {
+	ri := &RetInfo{}
+	defer func() {
+		if r := recover(); r != nil {
+			rpcLog.With("id", ci.id).Error("chanrpc handler panic", "panic", r, "stack", string(debug.Stack()))
+			ri.err = fmt.Errorf("function id %v: %v", ci.id, r)
+		}
+		s.ret(ci, ri)
+	}()
+	f, ok := s.functions[ci.id]
+	if !ok {
+		ri.err = fmt.Errorf("function id %v: function not registered", ci.id)
+		return
+	}
+	ri.ret, ri.err = f(ci.args)
+}
+
+// 发送调用，服务端已经关闭时返回 ErrClosed
+func (s *Server) call(ci *CallInfo, block bool) (err error) {
+	defer func() {
+		//关闭之后 ChanCall 已经close，发送会panic
+		if r := recover(); r != nil {
+			err = ErrClosed
+		}
+	}()
+	if block {
+		s.ChanCall <- ci
+		return nil
+	}
+	select {
+	case s.ChanCall <- ci:
+		return nil
+	default:
+		return ErrFull
+	}
+}
+
+// 不需要结果的调用，信箱满时等待
+func (s *Server) Go(id interface{}, args ...interface{}) {
+	if err := s.call(&CallInfo{id: id, args: args}, true); err != nil {
+		rpcLog.With("id", id).Debug("chanrpc go error", "err", err)
+	}
+}
+
+// 同步调用，可以在任意goroutine中使用；不要在服务端自己的goroutine中调用，会死锁
+func (s *Server) Call(id interface{}, args ...interface{}) (interface{}, error) {
+	chanRet := make(chan *RetInfo, 1)
+	if err := s.call(&CallInfo{id: id, args: args, chanRet: chanRet}, true); err != nil {
+		return nil, err
+	}
+	ri := <-chanRet
+	return ri.ret, ri.err
+}
+
+// 关闭服务端，信箱中没有执行的调用返回 ErrClosed，之后的调用也返回 ErrClosed
+// 需要在执行 Exec 的goroutine中调用
+func (s *Server) Close() {
+	close(s.ChanCall)
+	for ci := range s.ChanCall {
+		s.ret(ci, &RetInfo{err: ErrClosed})
+	}
+}
+
+/*
+chanrpc的调用方，一个模块的goroutine使用一个Client
+异步调用的结果放入 ChanAsynRet，需要在调用方的goroutine中用 Cb 执行回调，回调中不需要加锁
+*/
+type Client struct {
+	chanSyncRet     chan *RetInfo
+	ChanAsynRet     chan *RetInfo
+	pendingAsynCall int
+}
+
+// 创建调用方，l为同时进行的异步调用的最大数量
+func NewClient(l int) *Client {
+	return &Client{
+		chanSyncRet: make(chan *RetInfo, 1),
+		ChanAsynRet: make(chan *RetInfo, l),
+	}
+}
+
+// 同步调用服务端，等待结果
+func (c *Client) Call(s *Server, id interface{}, args ...interface{}) (interface{}, error) {
+	if err := s.call(&CallInfo{id: id, args: args, chanRet: c.chanSyncRet}, true); err != nil {
+		return nil, err
+	}
+	ri := <-c.chanSyncRet
+	return ri.ret, ri.err
+}
+
+/*
+异步调用服务端，不等待结果，结果通过 ChanAsynRet 交给 Cb 执行cb
+同时进行的异步调用太多或者服务端信箱满时，cb收到 ErrFull
+*/
+func (c *Client) AsynCall(s *Server, cb func(ret interface{}, err error), id interface{}, args ...interface{}) {
+	if c.pendingAsynCall >= cap(c.ChanAsynRet) {
+		cb(nil, ErrFull)
+		return
+	}
+	if err := s.call(&CallInfo{id: id, args: args, chanRet: c.ChanAsynRet, cb: cb}, false); err != nil {
+		cb(nil, err)
+		return
+	}
+	c.pendingAsynCall++
+}
+
+// 执行异步调用的回调
+func (c *Client) Cb(ri *RetInfo) {
+	c.pendingAsynCall--
+	defer func() {
+		if r := recover(); r != nil {
+			rpcLog.Error("chanrpc callback panic", "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	if ri.cb != nil {
+		ri.cb(ri.ret, ri.err)
+	}
+}
+
+// 没有等待结果的异步调用
+func (c *Client) Idle() bool {
+	return c.pendingAsynCall == 0
+}
+
+// 等待全部异步调用返回并执行回调
+func (c *Client) Close() {
+	for c.pendingAsynCall > 0 {
+		c.Cb(<-c.ChanAsynRet)
+	}
+}
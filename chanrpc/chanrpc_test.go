@@ -0,0 +1,88 @@
+package chanrpc
+
+import (
+	"errors"
+	"testing"
+)
+
+func newTestServer() *Server {
+	s := NewServer(10)
+	s.Register("add", func(args []interface{}) (interface{}, error) {
+		return args[0].(int) + args[1].(int), nil
+	})
+	s.Register("fail", func(args []interface{}) (interface{}, error) {
+		return nil, errors.New("fail")
+	})
+	s.Register("panic", func(args []interface{}) (interface{}, error) {
+		panic("boom")
+	})
+	return s
+}
+
+func TestCall(t *testing.T) {
+	s := newTestServer()
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case ci := <-s.ChanCall:
+				s.Exec(ci)
+			case <-stop:
+				s.Close()
+				return
+			}
+		}
+	}()
+
+	if ret, err := s.Call("add", 1, 2); err != nil || ret != 3 {
+		t.Fatalf("Call add = %v, %v", ret, err)
+	}
+	c := NewClient(10)
+	if _, err := c.Call(s, "fail"); err == nil || err.Error() != "fail" {
+		t.Fatalf("Call fail = %v", err)
+	}
+	if _, err := c.Call(s, "panic"); err == nil {
+		t.Fatal("Call panic returned no error")
+	}
+	if _, err := c.Call(s, "missing"); err == nil {
+		t.Fatal("Call missing returned no error")
+	}
+
+	// 异步调用的回调在调用方执行 Cb 时执行
+	var got []interface{}
+	for i := 0; i < 3; i++ {
+		c.AsynCall(s, func(ret interface{}, err error) {
+			got = append(got, ret)
+		}, "add", i, 10)
+	}
+	if c.Idle() {
+		t.Fatal("client idle with pending calls")
+	}
+	c.Close()
+	if len(got) != 3 || got[0] != 10 || got[2] != 12 {
+		t.Fatalf("async results %v", got)
+	}
+	s.Go("add", 1, 1)
+	close(stop)
+	<-done
+}
+
+func TestClose(t *testing.T) {
+	s := newTestServer()
+	c := NewClient(10)
+	var asynErr error
+	c.AsynCall(s, func(ret interface{}, err error) { asynErr = err }, "add", 1, 2)
+	s.Close()
+	c.Close()
+	if asynErr != ErrClosed {
+		t.Fatalf("pending call = %v", asynErr)
+	}
+	if _, err := s.Call("add", 1, 2); err != ErrClosed {
+		t.Fatalf("Call after close = %v", err)
+	}
+	c.AsynCall(s, func(ret interface{}, err error) { asynErr = err }, "add", 1, 2)
+	if asynErr != ErrClosed {
+		t.Fatalf("AsynCall after close = %v", asynErr)
+	}
+}
@@ -0,0 +1,445 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"gobonbon/conf"
+	"gobonbon/iface"
+	"gobonbon/log"
+	"gobonbon/msgparser"
+	"gobonbon/network"
+	"gobonbon/router"
+	"gobonbon/util"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	NetworkTcp       = conf.ServerModeTcp
+	NetworkWebsocket = conf.ServerModeWebsocket
+
+	defaultMinBackoff   = 100 * time.Millisecond
+	defaultMaxBackoff   = 10 * time.Second
+	defaultDialTimeout  = 5 * time.Second
+	defaultWriteTimeout = 50 * time.Millisecond
+
+	defaultMsgChanLen    = 1024 //发送队列的默认长度
+	defaultMaxPacketSize = 4096 //默认解析器的数据最大长度
+)
+
+// 断线期间 WriteMsg 返回的错误，消息没有放入发送队列
+var ErrNotConnected = errors.New("client not connected")
+
+// 客户端连接ID，只在本进程内唯一
+var clientID uint64
+
+// 客户端的日志，等级可以用 log.SetModuleLevel("client", ...) 单独调整
+var clientLog = log.Module("client")
+
+/*
+gobonbon客户端，使用和服务端相同的msgparser封包格式
+Client本身实现了iface.IConn，收到的消息交给IMsgHandle按路由处理
+*/
+type Client struct {
+	sync.RWMutex
+	util.ConnProperty //链接属性
+
+	Name    string
+	network string //tcp 或 websocket
+	addr    string //tcp为 host:port，websocket为 ws://host:port/path
+
+	connID     uint64
+	tcpConn    net.Conn
+	wsConn     *websocket.Conn
+	connected  bool
+	writeChan  chan []byte //跨越重连保留，断线前已经放入队列还没有发出的消息在重连后发送
+	msgParser  iface.IMsgParser
+	msgHandler iface.IMsgHandle
+
+	reconnect    bool
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+
+	onConnect    func(conn iface.IConn) //连接(含重连)建立后的Hook函数
+	onDisconnect func(conn iface.IConn) //连接断开后的Hook函数
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	started int32         //是否已经在后台运行
+	done    chan struct{} //后台goroutine退出时关闭
+}
+
+/*
+创建一个客户端，此时还没有连接
+network 为 "tcp" 或 "websocket"
+*/
+func NewClient(network, addr string) *Client {
+	c := &Client{
+		Name:         "gobonbon-client",
+		network:      network,
+		addr:         addr,
+		connID:       atomic.AddUint64(&clientID, 1),
+		writeChan:    make(chan []byte, defaultMsgChanLen),
+		msgParser:    msgparser.NewMsgParserWithMaxPacketSize(defaultMaxPacketSize),
+		msgHandler:   router.NewMsgHandleWithPool(0, 0), //在读goroutine中直接处理，不使用Worker池
+		reconnect:    true,
+		minBackoff:   defaultMinBackoff,
+		maxBackoff:   defaultMaxBackoff,
+		dialTimeout:  defaultDialTimeout,
+		writeTimeout: defaultWriteTimeout,
+		done:         make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c
+}
+
+/*
+创建客户端并立即连接，第一次连接失败直接返回错误
+连接成功后在后台处理消息，断线按配置自动重连
+*/
+func Dial(network, addr string) (*Client, error) {
+	c := NewClient(network, addr)
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	c.started = 1
+	go c.run()
+	return c, nil
+}
+
+// 设置是否自动重连，以及重连的退避时间范围
+func (c *Client) SetReconnect(enable bool, minBackoff, maxBackoff time.Duration) {
+	c.reconnect = enable
+	if minBackoff > 0 {
+		c.minBackoff = minBackoff
+	}
+	if maxBackoff >= c.minBackoff {
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// 设置拨号超时
+func (c *Client) SetDialTimeout(timeout time.Duration) {
+	c.dialTimeout = timeout
+}
+
+// 设置写消息进入发送队列的超时
+func (c *Client) SetWriteTimeout(timeout time.Duration) {
+	c.writeTimeout = timeout
+}
+
+// 设置发送队列的长度，需要在Start之前调用，Dial创建的客户端使用默认长度
+func (c *Client) SetMsgChanLen(n int) {
+	c.writeChan = make(chan []byte, n)
+}
+
+// 设置连接建立时的Hook函数
+func (c *Client) SetOnConnect(hook func(conn iface.IConn)) {
+	c.onConnect = hook
+}
+
+// 设置连接断开时的Hook函数
+func (c *Client) SetOnDisconnect(hook func(conn iface.IConn)) {
+	c.onDisconnect = hook
+}
+
+// 替换消息解析器，必须与服务端一致
+func (c *Client) SetMsgParser(msgParser iface.IMsgParser) {
+	c.msgParser = msgParser
+}
+
+// 替换消息管理模块，可以和其他客户端共用一组路由
+func (c *Client) SetMsgHandler(msgHandler iface.IMsgHandle) {
+	c.msgHandler = msgHandler
+}
+
+// 路由功能：给客户端注册一个路由业务方法
+func (c *Client) AddRouter(msgId uint32, router iface.IRouter) {
+	c.msgHandler.AddRouter(msgId, router)
+}
+
+func (c *Client) GetMsgHandler() iface.IMsgHandle {
+	return c.msgHandler
+}
+
+// 当前是否处于连接状态
+func (c *Client) IsConnected() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.connected
+}
+
+// 建立一次连接
+func (c *Client) connect() error {
+	var tcpConn net.Conn
+	var wsConn *websocket.Conn
+	var err error
+
+	switch c.network {
+	case NetworkWebsocket:
+		dialer := websocket.Dialer{HandshakeTimeout: c.dialTimeout}
+		wsConn, _, err = dialer.Dial(c.addr, nil)
+	default:
+		tcpConn, err = net.DialTimeout("tcp", c.addr, c.dialTimeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.tcpConn = tcpConn
+	c.wsConn = wsConn
+	c.connected = true
+	c.Unlock()
+
+	if c.onConnect != nil {
+		c.onConnect(c)
+	}
+	return nil
+}
+
+// 后台循环：处理当前连接，断线后按退避时间重连，直到Stop
+func (c *Client) run() {
+	defer close(c.done)
+	for {
+		c.serve()
+
+		c.Lock()
+		c.connected = false
+		c.Unlock()
+		if c.onDisconnect != nil {
+			c.onDisconnect(c)
+		}
+
+		if !c.reconnect || c.ctx.Err() != nil {
+			return
+		}
+		if !c.redial() {
+			return
+		}
+	}
+}
+
+// 按指数退避重连，Stop之后返回false
+func (c *Client) redial() bool {
+	backoff := c.minBackoff
+	for {
+		select {
+		case <-c.ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		err := c.connect()
+		if err == nil {
+			return true
+		}
+		clientLog.With("addr", c.addr).Warn("client reconnect error", "err", err, "retryIn", backoff)
+		backoff *= 2
+		if backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+// 处理一次连接的读写，连接断开后返回
+func (c *Client) serve() {
+	ctx, cancel := context.WithCancel(c.ctx)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		c.startReader(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		c.startWriter(ctx)
+	}()
+
+	<-ctx.Done()
+	c.closeConn()
+	wg.Wait()
+}
+
+func (c *Client) closeConn() {
+	c.RLock()
+	defer c.RUnlock()
+	if c.tcpConn != nil {
+		c.tcpConn.Close()
+	}
+	if c.wsConn != nil {
+		c.wsConn.Close()
+	}
+}
+
+// 读取一个完整的消息包
+func (c *Client) readMsg() (iface.IMessage, error) {
+	hlen := c.msgParser.GetHeadLen()
+
+	if c.wsConn != nil {
+		// websocket 一个二进制帧就是一个完整的消息包
+		_, buf, err := c.wsConn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(buf)) < hlen {
+			return nil, errors.New("ws msg too short")
+		}
+		msg, err := c.msgParser.Decode(buf[:hlen])
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(buf))-hlen < msg.GetDataLen() {
+			return nil, errors.New("ws msg data too short")
+		}
+		msg.SetData(buf[hlen : hlen+msg.GetDataLen()])
+		return msg, nil
+	}
+
+	headData := make([]byte, hlen)
+	if _, err := io.ReadFull(c.tcpConn, headData); err != nil {
+		return nil, err
+	}
+	msg, err := c.msgParser.Decode(headData)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if msg.GetDataLen() > 0 {
+		data = make([]byte, msg.GetDataLen())
+		if _, err := io.ReadFull(c.tcpConn, data); err != nil {
+			return nil, err
+		}
+	}
+	msg.SetData(data)
+	return msg, nil
+}
+
+func (c *Client) startReader(ctx context.Context) {
+	for {
+		msg, err := c.readMsg()
+		if err != nil {
+			if ctx.Err() == nil {
+				clientLog.With("addr", c.addr).Info("client read msg error", "err", err)
+			}
+			return
+		}
+		// 客户端在读goroutine里按顺序处理消息
+		c.msgHandler.DoMsgHandler(network.NewRequest(c, msg))
+	}
+}
+
+func (c *Client) startWriter(ctx context.Context) {
+	for {
+		select {
+		case data := <-c.writeChan:
+			var err error
+			if c.wsConn != nil {
+				err = c.wsConn.WriteMessage(websocket.BinaryMessage, data)
+			} else {
+				_, err = c.tcpConn.Write(data)
+			}
+			if err != nil {
+				clientLog.With("addr", c.addr).Info("client send data error", "err", err)
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// (启动客户端并阻塞，直到Stop；用于NewClient创建的客户端，Dial创建的客户端已经在后台运行)
+func (c *Client) Start() {
+	if !atomic.CompareAndSwapInt32(&c.started, 0, 1) {
+		return
+	}
+	if err := c.connect(); err != nil {
+		clientLog.With("addr", c.addr).Warn("client connect error", "err", err)
+		if !c.reconnect || !c.redial() {
+			close(c.done)
+			return
+		}
+	}
+	c.run()
+}
+
+// 停止客户端，不再重连，等待后台goroutine退出
+func (c *Client) Stop() {
+	c.cancel()
+	c.closeConn()
+	if atomic.LoadInt32(&c.started) == 1 {
+		<-c.done
+	}
+}
+
+func (c *Client) LocalAddr() net.Addr {
+	c.RLock()
+	defer c.RUnlock()
+	if c.wsConn != nil {
+		return c.wsConn.LocalAddr()
+	}
+	if c.tcpConn != nil {
+		return c.tcpConn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *Client) RemoteAddr() net.Addr {
+	c.RLock()
+	defer c.RUnlock()
+	if c.wsConn != nil {
+		return c.wsConn.RemoteAddr()
+	}
+	if c.tcpConn != nil {
+		return c.tcpConn.RemoteAddr()
+	}
+	return nil
+}
+
+/*
+将消息封包后放入发送队列
+断线期间不缓存消息，直接返回 ErrNotConnected，需要调用者在重连后(如 SetOnConnect 的回调中)重新发送
+*/
+func (c *Client) WriteMsg(msgId uint32, data []byte) error {
+	if !c.IsConnected() {
+		return ErrNotConnected
+	}
+	msg, err := c.msgParser.Encode(msgparser.NewMsgPackage(msgId, data))
+	if err != nil {
+		return err
+	}
+
+	idleTimeout := time.NewTimer(c.writeTimeout)
+	defer idleTimeout.Stop()
+	select {
+	case <-idleTimeout.C:
+		return errors.New("send buff msg timeout")
+	case c.writeChan <- msg:
+		return nil
+	}
+}
+
+func (c *Client) GetConnID() uint64 {
+	return c.connID
+}
+
+func (c *Client) GetTCPConnection() net.Conn {
+	c.RLock()
+	defer c.RUnlock()
+	return c.tcpConn
+}
+
+func (c *Client) GetWsConn() *websocket.Conn {
+	c.RLock()
+	defer c.RUnlock()
+	return c.wsConn
+}
@@ -0,0 +1,270 @@
+package client_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gobonbon/client"
+	"gobonbon/conf"
+	"gobonbon/iface"
+	"gobonbon/network"
+	"gobonbon/router"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	msgEcho  = 1
+	msgReply = 2
+)
+
+// 把收到的数据原样发回
+type echoRouter struct {
+	router.BaseRouter
+}
+
+func (r *echoRouter) Handle(req iface.IRequest) {
+	req.GetConnection().WriteMsg(msgReply, req.GetData())
+}
+
+type recvRouter struct {
+	router.BaseRouter
+	ch chan []byte
+}
+
+func (r *recvRouter) Handle(req iface.IRequest) {
+	r.ch <- req.GetData()
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// 启动回显服务器，等到开始监听再返回
+func startEcho(t *testing.T, mode string) (*network.Server, string) {
+	t.Helper()
+	addr := freeAddr(t)
+	_, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	s, err := network.NewServer(
+		network.WithHost("127.0.0.1"),
+		network.WithMode(mode),
+		network.WithTcpPort(p),
+		network.WithWsPort(p),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddRouter(msgEcho, &echoRouter{})
+	s.Start()
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return s, addr
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	s.Stop()
+	t.Fatal("server not listening")
+	return nil, ""
+}
+
+func recv(t *testing.T, ch chan []byte) []byte {
+	t.Helper()
+	select {
+	case data := <-ch:
+		return data
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for reply")
+		return nil
+	}
+}
+
+func TestDialEcho(t *testing.T) {
+	for _, mode := range []string{conf.ServerModeTcp, conf.ServerModeWebsocket} {
+		mode := mode
+		t.Run(mode, func(t *testing.T) {
+			s, addr := startEcho(t, mode)
+			defer s.Stop()
+			if mode == conf.ServerModeWebsocket {
+				addr = "ws://" + addr
+			}
+			c, err := client.Dial(mode, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Stop()
+			ch := make(chan []byte, 16)
+			c.AddRouter(msgReply, &recvRouter{ch: ch})
+
+			// 空消息、普通消息和接近最大长度的消息，按发送顺序收到
+			msgs := [][]byte{{}, []byte("hello"), bytes.Repeat([]byte{'x'}, 4000)}
+			for _, data := range msgs {
+				if err := c.WriteMsg(msgEcho, data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, want := range msgs {
+				if got := recv(t, ch); !bytes.Equal(got, want) {
+					t.Fatalf("reply %d: got %d bytes, want %d", i, len(got), len(want))
+				}
+			}
+		})
+	}
+}
+
+func TestDialError(t *testing.T) {
+	if _, err := client.Dial(client.NetworkTcp, freeAddr(t)); err == nil {
+		t.Fatal("dial to closed port succeeded")
+	}
+}
+
+// 第一次连接失败后按退避时间重试，断线后重连，每次连接和断开都调用Hook
+func TestReconnect(t *testing.T) {
+	addr := freeAddr(t)
+	c := client.NewClient(client.NetworkTcp, addr)
+	c.SetReconnect(true, 20*time.Millisecond, 80*time.Millisecond)
+	connected := make(chan time.Time, 4)
+	closed := make(chan time.Time, 4)
+	c.SetOnConnect(func(conn iface.IConn) { connected <- time.Now() })
+	c.SetOnDisconnect(func(conn iface.IConn) { closed <- time.Now() })
+	go c.Start()
+
+	// 服务器还没有启动，客户端在后台重试
+	time.Sleep(150 * time.Millisecond)
+	if c.IsConnected() {
+		t.Fatal("connected without server")
+	}
+	if err := c.WriteMsg(msgEcho, nil); err != client.ErrNotConnected {
+		t.Fatalf("WriteMsg while disconnected = %v", err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accept := func() net.Conn {
+		t.Helper()
+		l.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	wait := func(ch chan time.Time, what string) time.Time {
+		t.Helper()
+		select {
+		case at := <-ch:
+			return at
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for " + what)
+			return time.Time{}
+		}
+	}
+
+	// 退避时间不超过maxBackoff，服务器启动后很快连上
+	conn := accept()
+	wait(connected, "connect")
+
+	// 服务器断开连接，至少等minBackoff之后重连
+	conn.Close()
+	closedAt := wait(closed, "disconnect")
+	conn = accept()
+	defer conn.Close()
+	if d := wait(connected, "reconnect").Sub(closedAt); d < 20*time.Millisecond {
+		t.Fatalf("reconnected after %v, want at least minBackoff", d)
+	}
+
+	// Stop之后不再重连
+	c.Stop()
+	wait(closed, "disconnect after stop")
+	if c.IsConnected() {
+		t.Fatal("connected after stop")
+	}
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if conn, err := l.Accept(); err == nil {
+		conn.Close()
+		t.Fatal("reconnected after stop")
+	}
+}
+
+// 服务端的websocket读写：一个二进制帧是一个完整的消息包，文本帧被忽略，不完整的包关闭连接
+func TestWebsocketFraming(t *testing.T) {
+	s, addr := startEcho(t, conf.ServerModeWebsocket)
+	defer s.Stop()
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	packet := func(msgId uint32, data []byte) []byte {
+		buf := make([]byte, 8+len(data))
+		binary.BigEndian.PutUint32(buf, msgId)
+		binary.BigEndian.PutUint32(buf[4:], uint32(len(data)))
+		copy(buf[8:], data)
+		return buf
+	}
+	ws.WriteMessage(websocket.TextMessage, []byte("ignored"))
+	ws.WriteMessage(websocket.BinaryMessage, packet(msgEcho, []byte("a")))
+	ws.WriteMessage(websocket.BinaryMessage, packet(msgEcho, []byte("bc")))
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{"a", "bc"} {
+		msgType, buf, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgType != websocket.BinaryMessage || !bytes.Equal(buf, packet(msgReply, []byte(want))) {
+			t.Fatalf("got frame %d %v, want reply %q", msgType, buf, want)
+		}
+	}
+
+	// 数据长度超过帧的长度
+	bad := packet(msgEcho, []byte("abc"))
+	ws.WriteMessage(websocket.BinaryMessage, bad[:len(bad)-1])
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatal("conn not closed after short frame")
+	}
+}
+
+// 发送队列的长度可以设置，断线期间写入的消息在连接后发送
+func TestMsgChanLen(t *testing.T) {
+	s, addr := startEcho(t, conf.ServerModeTcp)
+	defer s.Stop()
+	c := client.NewClient(client.NetworkTcp, addr)
+	c.SetReconnect(false, 0, 0)
+	c.SetMsgChanLen(2)
+	c.SetWriteTimeout(10 * time.Millisecond)
+	ch := make(chan []byte, 16)
+	c.AddRouter(msgReply, &recvRouter{ch: ch})
+	block := make(chan struct{})
+	// 在连接Hook中写满队列，此时写goroutine还没有开始
+	var errs []error
+	c.SetOnConnect(func(conn iface.IConn) {
+		for i := 0; i < 3; i++ {
+			errs = append(errs, conn.WriteMsg(msgEcho, []byte{byte(i)}))
+		}
+		close(block)
+	})
+	go c.Start()
+	defer c.Stop()
+	<-block
+	if errs[0] != nil || errs[1] != nil || errs[2] == nil {
+		t.Fatalf("write errors %v, want the third to fail", errs)
+	}
+	for i := 0; i < 2; i++ {
+		if got := recv(t, ch); !bytes.Equal(got, []byte{byte(i)}) {
+			t.Fatalf("reply %d = %v", i, got)
+		}
+	}
+}
@@ -0,0 +1,471 @@
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"gobonbon/client"
+	"gobonbon/conf"
+	"gobonbon/iface"
+	"gobonbon/log"
+	"gobonbon/msgparser"
+	"gobonbon/network"
+	"gobonbon/router"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNodeNotFound = errors.New("cluster node not found")
+	ErrCallTimeout  = errors.New("cluster call timeout")
+	ErrStopped      = errors.New("cluster stopped")
+	ErrNotCall      = errors.New("request is not a cluster call")
+)
+
+// 对方处理Call时用 ReplyError 返回的错误
+type RemoteError string
+
+func (e RemoteError) Error() string {
+	return string(e)
+}
+
+// 集群消息的类型，放在每个消息数据的最前面
+const (
+	kindHello   byte = iota + 1 //连接建立后告诉对方自己的名字，带共享密钥的签名
+	kindSend                    //单向消息
+	kindCall                    //需要回复的请求
+	kindReply                   //Call的回复
+	kindError                   //Call的错误回复
+	kindForward                 //网关转发的客户端消息，seq为客户端的connID
+	kindPush                    //后端发给网关上的客户端的消息，seq为客户端的connID
+	kindKick                    //后端关闭网关上的客户端连接，seq为客户端的connID
+	kindLeave                   //网关上的客户端连接已经断开，seq为客户端的connID
+)
+
+// 数据前面的类型和序号：kind(1字节) | seq(8字节，大端)
+const headLen = 9
+
+// kindHello的数据：HMAC-SHA256(密钥, 名字)(32字节) | 名字
+const helloMacLen = sha256.Size
+
+// 链接属性中保存对方节点名字的key
+const nodeKey = "gobonbon.cluster.node"
+
+// 集群的日志，等级可以用 log.SetModuleLevel("cluster", ...) 单独调整
+var clusterLog = log.Module("cluster")
+
+/*
+集群，节点之间用msgparser封包的TCP长连接通信
+
+	c, err := cluster.NewCluster("gate", map[string]string{
+		"gate":   "127.0.0.1:7100",
+		"battle": "127.0.0.1:7200",
+	})
+	c.AddRouter(MsgMatch, &MatchRouter{})
+	c.Start()
+	c.Send("battle", MsgEnter, data)
+	reply, err := c.Call("battle", MsgQuery, data, time.Second)
+
+每个节点监听自己的地址，并连接其他全部节点，断线后自动重连，连接断开期间Send和Call返回错误
+连接建立后先发送用共享密钥签名的kindHello，监听到的连接在验证通过之前收到的消息全部丢弃，
+名字不在nodes中或者签名不对时关闭连接；全部节点用 SetSecret 设置相同的密钥。
+签名不防重放，集群端口只应该在内网开放
+收到的消息按路由处理，路由中 req.GetConnection().WriteMsg 发消息给来源节点，
+Call的请求用 Reply 或 ReplyError 回复，用 NodeOf 取得来源节点的名字
+*/
+type Cluster struct {
+	name       string
+	nodes      map[string]string  //节点名字 -> 地址
+	secret     []byte             //节点之间验证kindHello的共享密钥
+	msgHandler iface.IMsgHandle   //收到的消息的路由
+	gateConns  iface.IConnManager //作为网关时客户端的连接，后端推送的消息发给这里的连接
+	forwards   map[string]bool    //网关转发消息的节点，客户端断开时通知它们
+	leaveMsgId uint32             //客户端断开时通知后端的消息ID，0表示不通知
+	pushQueues []chan pushTask    //网关处理后端推送的队列，按客户端的connID分配
+
+	server *network.Server
+	links  map[string]*client.Client //连接其他节点的客户端，Start之后不再修改
+
+	seq       uint64 //Call的序号
+	callLock  sync.Mutex
+	calls     map[uint64]chan callResult
+	exitChan  chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+type callResult struct {
+	data []byte
+	err  error
+}
+
+/*
+创建集群节点，name为当前节点的名字，nodes为全部节点的名字和地址，需要包含当前节点
+收到的消息默认使用 conf.DefaultGlobalObj() 中Worker池配置的 router.MsgHandle 处理，可以用 SetMsgHandler 替换
+*/
+func NewCluster(name string, nodes map[string]string) (*Cluster, error) {
+	addr, ok := nodes[name]
+	if !ok {
+		return nil, errors.New("cluster node " + name + " not in nodes")
+	}
+	host, port, err := splitAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	def := conf.DefaultGlobalObj()
+	c := &Cluster{
+		name:       name,
+		nodes:      make(map[string]string, len(nodes)),
+		msgHandler: router.NewMsgHandleWithPool(def.WorkerPoolSize, def.MaxWorkerTaskLen),
+		forwards:   make(map[string]bool),
+		links:      make(map[string]*client.Client),
+		calls:      make(map[uint64]chan callResult),
+		exitChan:   make(chan struct{}),
+	}
+	for node, addr := range nodes {
+		if _, _, err := splitAddr(addr); err != nil {
+			return nil, err
+		}
+		c.nodes[node] = addr
+	}
+	//集群内部的连接不限制包的长度
+	c.server, err = network.NewServer(
+		network.WithName("cluster-"+name),
+		network.WithHost(host),
+		network.WithTcpPort(port),
+		network.WithMaxPacketSize(0),
+		network.WithMsgHandler(&linkHandler{c: c, accepted: true}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+/*
+使用 conf.Get() 的 ClusterName、ClusterNodes、ClusterSecret 和Worker池配置创建集群节点，配置不正确时panic
+*/
+func NewClusterWithConfig() *Cluster {
+	cfg := conf.Get()
+	c, err := NewCluster(cfg.ClusterName, cfg.ClusterNodes)
+	if err != nil {
+		panic(err)
+	}
+	c.SetMsgHandler(router.NewMsgHandleWithPool(cfg.WorkerPoolSize, cfg.MaxWorkerTaskLen))
+	c.SetSecret(cfg.ClusterSecret)
+	return c
+}
+
+func splitAddr(addr string) (string, int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, n, nil
+}
+
+// 当前节点的名字
+func (c *Cluster) Name() string {
+	return c.name
+}
+
+// 全部节点的名字，按名字排序
+func (c *Cluster) Nodes() []string {
+	names := make([]string, 0, len(c.nodes))
+	for name := range c.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 给收到的集群消息注册路由
+func (c *Cluster) AddRouter(msgId uint32, router iface.IRouter) {
+	c.msgHandler.AddRouter(msgId, router)
+}
+
+// 替换收到的消息的路由，需要在Start之前调用；Start时会启动它的Worker池，不要和Server共用
+func (c *Cluster) SetMsgHandler(msgHandler iface.IMsgHandle) {
+	c.msgHandler = msgHandler
+}
+
+func (c *Cluster) GetMsgHandler() iface.IMsgHandle {
+	return c.msgHandler
+}
+
+// 设置节点之间验证的共享密钥，全部节点需要相同，需要在Start之前调用
+func (c *Cluster) SetSecret(secret string) {
+	c.secret = []byte(secret)
+}
+
+// 开始监听并连接其他全部节点，不等待连接建立
+func (c *Cluster) Start() {
+	c.startOnce.Do(func() {
+		if len(c.secret) == 0 {
+			clusterLog.With("node", c.name).Warn("cluster secret not set, any peer knowing a node name can join")
+		}
+		c.msgHandler.StartWorkerPool()
+		if c.gateConns != nil {
+			c.startPushWorkers()
+		}
+		c.server.Start()
+		for node, addr := range c.nodes {
+			if node == c.name {
+				continue
+			}
+			node := node
+			link := client.NewClient(client.NetworkTcp, addr)
+			link.Name = c.name + "->" + node
+			link.SetReconnect(true, 100*time.Millisecond, 5*time.Second)
+			link.SetMsgParser(msgparser.NewMsgParserWithMaxPacketSize(0))
+			link.SetMsgHandler(&linkHandler{c: c})
+			link.SetProperty(nodeKey, node)
+			link.SetOnConnect(func(conn iface.IConn) {
+				clusterLog.With("node", c.name, "peer", node).Info("cluster link connected")
+				conn.WriteMsg(0, encode(kindHello, 0, c.hello()))
+			})
+			c.links[node] = link
+			go link.Start()
+		}
+		clusterLog.With("node", c.name, "addr", c.nodes[c.name]).Info("cluster started")
+	})
+}
+
+// 关闭监听和全部连接，等待中的Call返回 ErrStopped
+func (c *Cluster) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.exitChan)
+		for _, link := range c.links {
+			link.Stop()
+		}
+		c.server.Stop()
+		clusterLog.With("node", c.name).Info("cluster stopped")
+	})
+}
+
+// 到节点的连接是否已经建立
+func (c *Cluster) IsConnected(node string) bool {
+	link, ok := c.links[node]
+	return ok && link.IsConnected()
+}
+
+// 发送单向消息给节点，连接没有建立时返回 client.ErrNotConnected，不能发给当前节点自己
+func (c *Cluster) Send(node string, msgId uint32, data []byte) error {
+	link, ok := c.links[node]
+	if !ok {
+		return ErrNodeNotFound
+	}
+	return link.WriteMsg(msgId, encode(kindSend, 0, data))
+}
+
+/*
+发送请求给节点并等待回复，timeout内没有回复返回 ErrCallTimeout
+对方用 ReplyError 回复时返回 RemoteError
+*/
+func (c *Cluster) Call(node string, msgId uint32, data []byte, timeout time.Duration) ([]byte, error) {
+	link, ok := c.links[node]
+	if !ok {
+		return nil, ErrNodeNotFound
+	}
+	seq := atomic.AddUint64(&c.seq, 1)
+	ch := make(chan callResult, 1)
+	c.callLock.Lock()
+	c.calls[seq] = ch
+	c.callLock.Unlock()
+	defer func() {
+		c.callLock.Lock()
+		delete(c.calls, seq)
+		c.callLock.Unlock()
+	}()
+
+	if err := link.WriteMsg(msgId, encode(kindCall, seq, data)); err != nil {
+		return nil, err
+	}
+	callTimeout := time.NewTimer(timeout)
+	defer callTimeout.Stop()
+	select {
+	case r := <-ch:
+		return r.data, r.err
+	case <-callTimeout.C:
+		clusterLog.With("node", node, "msgId", msgId).Warn("cluster call timeout")
+		return nil, ErrCallTimeout
+	case <-c.exitChan:
+		return nil, ErrStopped
+	}
+}
+
+// 收到Call的回复，超时之后到达的回复直接丢弃
+func (c *Cluster) finishCall(seq uint64, r callResult) {
+	c.callLock.Lock()
+	ch, ok := c.calls[seq]
+	c.callLock.Unlock()
+	if ok {
+		ch <- r
+	}
+}
+
+// 当前节点的kindHello数据
+func (c *Cluster) hello() []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(c.name))
+	return append(mac.Sum(nil), c.name...)
+}
+
+// 验证对方的kindHello，返回对方节点的名字
+func (c *Cluster) verifyHello(payload []byte) (string, bool) {
+	if len(payload) <= helloMacLen {
+		return "", false
+	}
+	node := string(payload[helloMacLen:])
+	if _, ok := c.nodes[node]; !ok || node == c.name {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(node))
+	return node, hmac.Equal(payload[:helloMacLen], mac.Sum(nil))
+}
+
+// 监听到的连接上第一条消息需要是验证通过的kindHello，否则关闭连接
+func (c *Cluster) acceptHello(conn iface.IConn, kind byte, payload []byte) {
+	node, ok := "", false
+	if kind == kindHello {
+		node, ok = c.verifyHello(payload)
+	}
+	if !ok {
+		clusterLog.With("connID", conn.GetConnID(), "remote", conn.RemoteAddr().String(), "kind", kind).Warn("cluster hello rejected")
+		conn.Stop()
+		return
+	}
+	conn.SetProperty(nodeKey, node)
+	clusterLog.With("node", c.name, "peer", node, "connID", conn.GetConnID()).Info("cluster peer verified")
+}
+
+/*
+处理集群连接上收到的消息，在连接的读goroutine中执行
+accepted为监听到的连接，没有通过kindHello验证时只处理kindHello
+*/
+func (c *Cluster) receive(req iface.IRequest, accepted bool) {
+	conn := req.GetConnection()
+	data := req.GetData()
+	if len(data) < headLen {
+		clusterLog.With("connID", conn.GetConnID(), "msgId", req.GetMsgID()).Warn("cluster msg too short")
+		return
+	}
+	kind, seq, payload := data[0], binary.BigEndian.Uint64(data[1:headLen]), data[headLen:]
+	if accepted {
+		if _, err := conn.GetProperty(nodeKey); err != nil {
+			c.acceptHello(conn, kind, payload)
+			return
+		}
+	}
+	switch kind {
+	case kindHello:
+		//已经验证过的连接，或者主动连接的对方发来的hello
+		clusterLog.With("connID", conn.GetConnID()).Warn("unexpected cluster hello")
+	case kindReply:
+		c.finishCall(seq, callResult{data: payload})
+	case kindError:
+		c.finishCall(seq, callResult{err: RemoteError(payload)})
+	case kindSend, kindCall:
+		node := &NodeConn{IConn: conn, seq: seq, call: kind == kindCall}
+		msg := msgparser.NewMsgPackage(req.GetMsgID(), payload)
+		//交给Worker处理，路由中可以继续Call其他节点，不会阻塞连接的读取
+		c.msgHandler.SendMsgToTaskQueue(network.NewRequest(node, msg))
+	case kindForward, kindLeave:
+		cc := &ClientConn{c: c, link: conn, connID: seq}
+		msg := msgparser.NewMsgPackage(req.GetMsgID(), payload)
+		c.msgHandler.SendMsgToTaskQueue(network.NewRequest(cc, msg))
+	case kindPush, kindKick:
+		c.push(kind, seq, req.GetMsgID(), payload)
+	default:
+		clusterLog.With("connID", conn.GetConnID(), "kind", kind).Warn("unknown cluster msg kind")
+	}
+}
+
+func encode(kind byte, seq uint64, data []byte) []byte {
+	buf := make([]byte, headLen+len(data))
+	buf[0] = kind
+	binary.BigEndian.PutUint64(buf[1:headLen], seq)
+	copy(buf[headLen:], data)
+	return buf
+}
+
+// 集群连接使用的IMsgHandle，收到的消息都交给 Cluster.receive
+type linkHandler struct {
+	c        *Cluster
+	accepted bool //监听到的连接，需要先验证kindHello
+}
+
+func (h *linkHandler) DoMsgHandler(req iface.IRequest) {
+	h.c.receive(req, h.accepted)
+}
+
+func (h *linkHandler) SendMsgToTaskQueue(req iface.IRequest) {
+	h.c.receive(req, h.accepted)
+}
+
+func (h *linkHandler) AddRouter(msgId uint32, router iface.IRouter) {}
+
+func (h *linkHandler) StartWorkerPool() {}
+
+/*
+集群消息的来源，路由中 req.GetConnection() 得到的连接
+WriteMsg 把单向消息发回来源节点，其他方法和收到消息的连接相同
+*/
+type NodeConn struct {
+	iface.IConn
+	seq  uint64
+	call bool
+}
+
+// 发送单向消息给来源节点
+func (n *NodeConn) WriteMsg(msgId uint32, data []byte) error {
+	return n.IConn.WriteMsg(msgId, encode(kindSend, 0, data))
+}
+
+// 来源节点的名字
+func (n *NodeConn) Node() string {
+	node, err := n.IConn.GetProperty(nodeKey)
+	if err != nil {
+		return ""
+	}
+	return node.(string)
+}
+
+// 集群消息来源节点的名字，网关转发的消息为网关节点的名字，不是集群消息时返回空字符串
+func NodeOf(req iface.IRequest) string {
+	switch conn := req.GetConnection().(type) {
+	case *NodeConn:
+		return conn.Node()
+	case *ClientConn:
+		return conn.Node()
+	}
+	return ""
+}
+
+// 回复Call的请求，不是Call时返回 ErrNotCall
+func Reply(req iface.IRequest, data []byte) error {
+	n, ok := req.GetConnection().(*NodeConn)
+	if !ok || !n.call {
+		return ErrNotCall
+	}
+	return n.IConn.WriteMsg(req.GetMsgID(), encode(kindReply, n.seq, data))
+}
+
+// 用错误回复Call的请求，调用方的Call返回 RemoteError
+func ReplyError(req iface.IRequest, err error) error {
+	n, ok := req.GetConnection().(*NodeConn)
+	if !ok || !n.call {
+		return ErrNotCall
+	}
+	return n.IConn.WriteMsg(req.GetMsgID(), encode(kindError, n.seq, []byte(err.Error())))
+}
@@ -0,0 +1,230 @@
+package cluster
+
+import (
+	"errors"
+	"gobonbon/iface"
+	"gobonbon/msgparser"
+	"gobonbon/router"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	msgEcho  = 1
+	msgFail  = 2
+	msgSlow  = 3
+	msgPing  = 4
+	msgPong  = 5
+	msgRelay = 6
+)
+
+type funcRouter struct {
+	router.BaseRouter
+	fn func(req iface.IRequest)
+}
+
+func (r *funcRouter) Handle(req iface.IRequest) {
+	r.fn(req)
+}
+
+func handle(c *Cluster, msgId uint32, fn func(req iface.IRequest)) {
+	c.AddRouter(msgId, &funcRouter{fn: fn})
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return "127.0.0.1:" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func newNode(t *testing.T, name string, nodes map[string]string) *Cluster {
+	t.Helper()
+	c, err := NewCluster(name, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func waitConnected(t *testing.T, c *Cluster, nodes ...string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for _, node := range nodes {
+		for !c.IsConnected(node) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s not connected to %s", c.Name(), node)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestCluster(t *testing.T) {
+	nodes := map[string]string{"gate": freeAddr(t), "lobby": freeAddr(t), "battle": freeAddr(t)}
+	gate, lobby, battle := newNode(t, "gate", nodes), newNode(t, "lobby", nodes), newNode(t, "battle", nodes)
+
+	pongs := make(chan string, 4)
+	handle(gate, msgPong, func(req iface.IRequest) {
+		pongs <- NodeOf(req) + ":" + string(req.GetData())
+	})
+	handle(battle, msgEcho, func(req iface.IRequest) {
+		Reply(req, append([]byte(NodeOf(req)+":"), req.GetData()...))
+	})
+	handle(battle, msgFail, func(req iface.IRequest) {
+		ReplyError(req, errors.New("no room"))
+	})
+	handle(battle, msgSlow, func(req iface.IRequest) {})
+	handle(battle, msgPing, func(req iface.IRequest) {
+		req.GetConnection().WriteMsg(msgPong, req.GetData())
+	})
+	// lobby处理请求时再Call battle
+	handle(lobby, msgRelay, func(req iface.IRequest) {
+		data, err := lobby.Call("battle", msgEcho, req.GetData(), time.Second)
+		if err != nil {
+			ReplyError(req, err)
+			return
+		}
+		Reply(req, data)
+	})
+	for _, c := range []*Cluster{gate, lobby, battle} {
+		c.Start()
+		defer c.Stop()
+	}
+	waitConnected(t, gate, "lobby", "battle")
+	waitConnected(t, lobby, "battle")
+
+	if data, err := gate.Call("battle", msgEcho, []byte("hi"), time.Second); err != nil || string(data) != "gate:hi" {
+		t.Fatalf("Call = %q, %v", data, err)
+	}
+	if _, err := gate.Call("battle", msgFail, nil, time.Second); err != RemoteError("no room") {
+		t.Fatalf("Call fail = %v", err)
+	}
+	if _, err := gate.Call("battle", msgSlow, nil, 100*time.Millisecond); err != ErrCallTimeout {
+		t.Fatalf("Call slow = %v", err)
+	}
+	if data, err := gate.Call("lobby", msgRelay, []byte("x"), time.Second); err != nil || string(data) != "lobby:x" {
+		t.Fatalf("Call relay = %q, %v", data, err)
+	}
+	if _, err := gate.Call("unknown", msgEcho, nil, time.Second); err != ErrNodeNotFound {
+		t.Fatalf("Call unknown = %v", err)
+	}
+
+	// 对方用 req.GetConnection().WriteMsg 回复单向消息
+	if err := gate.Send("battle", msgPing, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-pongs:
+		if got != "battle:1" {
+			t.Fatalf("pong = %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pong timeout")
+	}
+
+	// battle重启后自动重连
+	battle.Stop()
+	//监听在Stop之后异步关闭，等端口可以重新使用
+	for i := 0; i < 100; i++ {
+		if l, err := net.Listen("tcp", nodes["battle"]); err == nil {
+			l.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	battle = newNode(t, "battle", nodes)
+	handle(battle, msgEcho, func(req iface.IRequest) {
+		Reply(req, []byte("again"))
+	})
+	battle.Start()
+	defer battle.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := gate.Call("battle", msgEcho, nil, 200*time.Millisecond)
+		if err == nil && string(data) == "again" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Call after restart = %q, %v", data, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// 监听到的连接需要先发送用相同密钥签名、名字在nodes中的hello，之前的消息都被丢弃并关闭连接
+func TestClusterHello(t *testing.T) {
+	nodes := map[string]string{"gate": freeAddr(t), "battle": freeAddr(t)}
+	gate, battle := newNode(t, "gate", nodes), newNode(t, "battle", nodes)
+	gate.SetSecret("s3cret")
+	battle.SetSecret("s3cret")
+	pings := make(chan string, 4)
+	handle(battle, msgPing, func(req iface.IRequest) {
+		pings <- NodeOf(req) + ":" + string(req.GetData())
+	})
+	battle.Start()
+	defer battle.Stop()
+
+	parser := msgparser.NewMsgParserWithMaxPacketSize(0)
+	packet := func(msgId uint32, kind byte, payload []byte) []byte {
+		buf, _ := parser.Encode(msgparser.NewMsgPackage(msgId, encode(kind, 0, payload)))
+		return buf
+	}
+	// 发送之后连接应该被对方关闭
+	expectClosed := func(name string, packets ...[]byte) {
+		t.Helper()
+		var conn net.Conn
+		var err error
+		for i := 0; i < 50; i++ {
+			if conn, err = net.Dial("tcp", nodes["battle"]); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		for _, p := range packets {
+			conn.Write(p)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		//没有读取的数据还在对方的缓冲区时，关闭会变成RST
+		_, err = conn.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+			t.Fatalf("%s: read = %v, want conn closed", name, err)
+		}
+	}
+	wrongSecret := &Cluster{name: "gate", secret: []byte("wrong")}
+	unknownNode := &Cluster{name: "evil", secret: []byte("s3cret")}
+	expectClosed("no hello", packet(msgPing, kindSend, []byte("x")), packet(msgPing, kindPush, []byte("x")))
+	expectClosed("wrong secret", packet(0, kindHello, wrongSecret.hello()), packet(msgPing, kindSend, []byte("x")))
+	expectClosed("unknown node", packet(0, kindHello, unknownNode.hello()), packet(msgPing, kindSend, []byte("x")))
+	expectClosed("bare name", packet(0, kindHello, []byte("gate")), packet(msgPing, kindSend, []byte("x")))
+	select {
+	case got := <-pings:
+		t.Fatalf("unverified msg handled: %q", got)
+	default:
+	}
+
+	// 密钥相同的节点正常通信
+	gate.Start()
+	defer gate.Stop()
+	waitConnected(t, gate, "battle")
+	if err := gate.Send("battle", msgPing, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-pings:
+		if got != "gate:1" {
+			t.Fatalf("ping = %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ping timeout")
+	}
+}
@@ -0,0 +1,228 @@
+package cluster
+
+import (
+	"gobonbon/client"
+	"gobonbon/iface"
+	"gobonbon/network"
+	"gobonbon/router"
+	"gobonbon/util"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+网关模式，把客户端的一段消息转发给后端节点，客户端不需要知道后端的存在
+
+	// 网关
+	c.SetGate(s.GetConnMgr())
+	s.AddRouterRange(1000, 1999, c.Forward("battle"))
+
+	// 后端，路由和直接连接客户端时一样
+	func (r *MoveRouter) Handle(req iface.IRequest) {
+		req.GetConnection().WriteMsg(MsgMoveAck, data) //经过网关发给客户端
+		gate, connID := cluster.NodeOf(req), req.GetConnection().GetConnID()
+		battle.Push(gate, connID, MsgHit, data) //之后随时推送
+	}
+
+后端收到的请求中 req.GetConnection() 是 *ClientConn，GetConnID 为客户端在网关上的connID，
+WriteMsg 经过网关发给客户端，Stop 关闭网关上的客户端连接
+
+SetGate 设置网关上客户端的连接管理，后端推送的消息发给其中的连接，需要在Start之前调用。
+后端的推送和关闭不在集群连接的读goroutine中处理，而是按connID分给固定数量的goroutine，
+同一个客户端的推送按顺序处理，一个客户端发送慢不会阻塞整个集群连接
+*/
+func (c *Cluster) SetGate(connMgr iface.IConnManager) {
+	c.gateConns = connMgr
+	if cm, ok := connMgr.(*network.ConnManager); ok {
+		cm.OnRemove(c.leave)
+	}
+}
+
+/*
+设置客户端断开时通知后端的消息ID，需要在Start之前调用，0表示不通知
+网关上的客户端连接断开后，给每个 Forward 的节点发送这个消息，后端按普通的转发消息路由，
+GetConnID 为断开的客户端的connID，用来清理按 网关名字+connID 保存的数据
+
+	c.SetLeaveMsgId(MsgLeave)                  //网关
+	battle.AddRouter(MsgLeave, &LeaveRouter{}) //后端
+*/
+func (c *Cluster) SetLeaveMsgId(msgId uint32) {
+	c.leaveMsgId = msgId
+}
+
+// 转发消息给节点的路由，和 Server.AddRouterRange 一起使用，需要在Start之前调用
+func (c *Cluster) Forward(node string) iface.IRouter {
+	c.forwards[node] = true
+	return &forwardRouter{c: c, node: node}
+}
+
+// 网关上的客户端连接断开，通知转发过消息的节点，在关闭连接的goroutine中执行
+func (c *Cluster) leave(conn iface.IConn) {
+	if c.leaveMsgId == 0 {
+		return
+	}
+	connID := conn.GetConnID()
+	for node := range c.forwards {
+		link, ok := c.links[node]
+		if !ok {
+			continue
+		}
+		if err := link.WriteMsg(c.leaveMsgId, encode(kindLeave, connID, nil)); err != nil {
+			clusterLog.With("node", node, "connID", connID).Debug("send leave error", "err", err)
+		}
+	}
+}
+
+type forwardRouter struct {
+	router.BaseRouter
+	c    *Cluster
+	node string
+}
+
+func (r *forwardRouter) Handle(req iface.IRequest) {
+	link, ok := r.c.links[r.node]
+	if !ok {
+		clusterLog.With("node", r.node, "msgId", req.GetMsgID()).Warn("forward to unknown node")
+		return
+	}
+	connID := req.GetConnection().GetConnID()
+	if err := link.WriteMsg(req.GetMsgID(), encode(kindForward, connID, req.GetData())); err != nil {
+		clusterLog.With("node", r.node, "connID", connID, "msgId", req.GetMsgID()).Warn("forward msg error", "err", err)
+	}
+}
+
+// 后端直接推送消息给网关上的客户端，gate为网关节点的名字
+func (c *Cluster) Push(gate string, connID uint64, msgId uint32, data []byte) error {
+	link, ok := c.links[gate]
+	if !ok {
+		return ErrNodeNotFound
+	}
+	return link.WriteMsg(msgId, encode(kindPush, connID, data))
+}
+
+// 网关处理后端推送的goroutine数量和每个goroutine的队列长度
+const (
+	pushWorkers  = 16
+	pushQueueLen = 1024
+)
+
+// 一个后端的推送或者关闭
+type pushTask struct {
+	kind   byte
+	connID uint64
+	msgId  uint32
+	data   []byte
+}
+
+// 启动处理推送的goroutine，Stop时退出
+func (c *Cluster) startPushWorkers() {
+	c.pushQueues = make([]chan pushTask, pushWorkers)
+	for i := range c.pushQueues {
+		c.pushQueues[i] = make(chan pushTask, pushQueueLen)
+		go c.pushWorker(c.pushQueues[i])
+	}
+}
+
+func (c *Cluster) pushWorker(queue chan pushTask) {
+	for {
+		select {
+		case task := <-queue:
+			c.deliver(task)
+		case <-c.exitChan:
+			return
+		}
+	}
+}
+
+// 网关收到后端的推送，交给客户端对应的goroutine处理，队列满时才会阻塞集群连接的读取
+func (c *Cluster) push(kind byte, connID uint64, msgId uint32, data []byte) {
+	if c.gateConns == nil {
+		clusterLog.With("connID", connID, "msgId", msgId).Warn("push received but not a gate")
+		return
+	}
+	select {
+	case c.pushQueues[connID%pushWorkers] <- pushTask{kind: kind, connID: connID, msgId: msgId, data: data}:
+	case <-c.exitChan:
+	}
+}
+
+// 把推送发给客户端或者关闭客户端连接
+func (c *Cluster) deliver(task pushTask) {
+	conn, err := c.gateConns.Get(task.connID)
+	if err != nil {
+		clusterLog.With("connID", task.connID, "msgId", task.msgId).Debug("push to closed client")
+		return
+	}
+	if task.kind == kindKick {
+		network.StopAfterFlush(conn, time.Second)
+		return
+	}
+	conn.WriteMsg(task.msgId, task.data)
+}
+
+/*
+后端节点上代表网关客户端的连接，每个转发来的请求一个
+属性只在这次请求中有效，需要保存的数据用 网关名字+GetConnID 作为key自己保存
+*/
+type ClientConn struct {
+	util.ConnProperty
+	c      *Cluster
+	link   iface.IConn //收到这个请求的连接
+	connID uint64
+}
+
+func (cc *ClientConn) Start() {}
+
+// 关闭网关上的客户端连接，在这之前发出的消息会先发给客户端
+func (cc *ClientConn) Stop() {
+	cc.send(kindKick, 0, nil)
+}
+
+// 经过网关发送消息给客户端
+func (cc *ClientConn) WriteMsg(msgId uint32, data []byte) error {
+	return cc.send(kindPush, msgId, data)
+}
+
+// 和 Push 使用同一个连接，保证回复、推送和关闭按顺序到达网关；到网关的连接断开时使用收到请求的连接
+func (cc *ClientConn) send(kind byte, msgId uint32, data []byte) error {
+	packet := encode(kind, cc.connID, data)
+	if link, ok := cc.c.links[cc.Node()]; ok {
+		if err := link.WriteMsg(msgId, packet); err != client.ErrNotConnected {
+			return err
+		}
+	}
+	return cc.link.WriteMsg(msgId, packet)
+}
+
+// 客户端在网关上的connID
+func (cc *ClientConn) GetConnID() uint64 {
+	return cc.connID
+}
+
+// 网关节点的名字
+func (cc *ClientConn) Node() string {
+	node, err := cc.link.GetProperty(nodeKey)
+	if err != nil {
+		return ""
+	}
+	return node.(string)
+}
+
+// 和网关之间连接的地址
+func (cc *ClientConn) LocalAddr() net.Addr {
+	return cc.link.LocalAddr()
+}
+
+func (cc *ClientConn) RemoteAddr() net.Addr {
+	return cc.link.RemoteAddr()
+}
+
+func (cc *ClientConn) GetTCPConnection() net.Conn {
+	return nil
+}
+
+func (cc *ClientConn) GetWsConn() *websocket.Conn {
+	return nil
+}
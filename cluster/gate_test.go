@@ -0,0 +1,175 @@
+package cluster
+
+import (
+	"gobonbon/client"
+	"gobonbon/iface"
+	"gobonbon/nettest"
+	"gobonbon/network"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	msgBattleMin = 1000
+	msgAttack    = 1001
+	msgBattleMax = 1999
+	msgHit       = 2000
+	msgLocal     = 7
+	msgLeave     = 8
+)
+
+func TestGateForward(t *testing.T) {
+	nodes := map[string]string{"gate": freeAddr(t), "battle": freeAddr(t)}
+	gate, battle := newNode(t, "gate", nodes), newNode(t, "battle", nodes)
+
+	front := freeAddr(t)
+	host, port, _ := splitAddr(front)
+	s, err := network.NewServer(network.WithHost(host), network.WithTcpPort(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle(gate, msgLocal, func(req iface.IRequest) {}) //集群路由和网关路由互不影响
+	s.AddRouter(msgLocal, &funcRouter{fn: func(req iface.IRequest) {
+		req.GetConnection().WriteMsg(msgHit, []byte("local"))
+	}})
+	s.AddRouterRange(msgBattleMin, msgBattleMax, gate.Forward("battle"))
+	gate.SetGate(s.GetConnMgr())
+	gate.SetLeaveMsgId(msgLeave)
+
+	connIDs := make(chan uint64, 4)
+	leaves := make(chan string, 4)
+	handle(battle, msgLeave, func(req iface.IRequest) {
+		leaves <- NodeOf(req) + ":" + strconv.FormatUint(req.GetConnection().GetConnID(), 10)
+	})
+	handle(battle, msgAttack, func(req iface.IRequest) {
+		conn := req.GetConnection()
+		connIDs <- conn.GetConnID()
+		conn.WriteMsg(msgHit, append([]byte("reply:"), req.GetData()...))
+		battle.Push(NodeOf(req), conn.GetConnID(), msgHit, []byte("push"))
+		if string(req.GetData()) == "bye" {
+			conn.Stop()
+		}
+	})
+	s.Start()
+	defer s.Stop()
+	for _, c := range []*Cluster{gate, battle} {
+		c.Start()
+		defer c.Stop()
+	}
+	waitConnected(t, gate, "battle")
+	waitConnected(t, battle, "gate")
+
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", front); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	cli := client.NewClient(client.NetworkTcp, front)
+	cli.SetReconnect(false, 0, 0)
+	ch := make(chan string, 16)
+	cli.AddRouter(msgHit, &funcRouter{fn: func(req iface.IRequest) { ch <- string(req.GetData()) }})
+	go cli.Start()
+	defer cli.Stop()
+	for i := 0; i < 50 && !cli.IsConnected(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-ch:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+
+	cli.WriteMsg(msgLocal, nil)
+	expect("local")
+	cli.WriteMsg(msgAttack, []byte("1"))
+	expect("reply:1")
+	expect("push")
+
+	// 后端关闭网关上的客户端连接
+	cli.WriteMsg(msgAttack, []byte("bye"))
+	expect("reply:bye")
+	expect("push")
+	deadline := time.Now().Add(2 * time.Second)
+	for cli.IsConnected() && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if cli.IsConnected() {
+		t.Fatal("client not kicked by backend")
+	}
+
+	// 客户端断开后后端收到通知，前面等待监听时的连接也会通知
+	want := "gate:" + strconv.FormatUint(<-connIDs, 10)
+	for {
+		select {
+		case got := <-leaves:
+			if got == want {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("leave %q not received", want)
+		}
+	}
+}
+
+// 一个客户端发送阻塞时，其他客户端的推送不受影响，同一个客户端的推送和关闭按顺序处理
+func TestGatePushSlowClient(t *testing.T) {
+	nodes := map[string]string{"gate": freeAddr(t), "battle": freeAddr(t)}
+	gate := newNode(t, "gate", nodes)
+	s := nettest.NewServer()
+	gate.SetGate(s.ConnMgr)
+	gate.Start()
+	defer gate.Stop()
+
+	slow, fast := s.Connect(), s.Connect()
+	block := make(chan struct{})
+	var lock sync.Mutex
+	var got []string
+	slow.SetOnMsg(func(conn *nettest.Conn, msg iface.IMessage) {
+		<-block
+		lock.Lock()
+		got = append(got, string(msg.GetData()))
+		lock.Unlock()
+	})
+	slowID, fastID := slow.Peer().GetConnID(), fast.Peer().GetConnID()
+
+	done := make(chan struct{})
+	go func() {
+		gate.push(kindPush, slowID, msgHit, []byte("1"))
+		gate.push(kindPush, slowID, msgHit, []byte("2"))
+		gate.push(kindKick, slowID, 0, nil)
+		gate.push(kindPush, fastID, msgHit, []byte("fast"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("push blocked by slow client")
+	}
+	for i := 0; i < 50 && len(fast.RecvAll()) == 0; i++ {
+		if i == 49 {
+			t.Fatal("fast client got no push")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(block)
+	for i := 0; i < 50 && !slow.Closed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !slow.Closed() || len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Fatalf("slow client got %v, closed %v", got, slow.Closed())
+	}
+}
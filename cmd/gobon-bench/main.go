@@ -0,0 +1,297 @@
+/*
+gobon-bench 压测工具：模拟大量客户端连接gobonbon服务器
+
+	gobon-bench -addr 127.0.0.1:7777 -conns 1000 -rate 20000 -duration 30s -mix 1:64:3,2:1024:1
+
+每个连接按 -mix 中的权重随机选择消息ID和包大小发送，
+服务器需要把收到的数据原样回复（回复ID = 消息ID + -reply-offset），
+数据前8个字节是发送时间，用来计算往返延迟。
+加上 -serve 会在本进程内启动一个回显服务器，方便在CI中直接运行。
+*/
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"gobonbon/client"
+	"gobonbon/conf"
+	"gobonbon/iface"
+	"gobonbon/log"
+	"gobonbon/network"
+	"gobonbon/router"
+	stdlog "log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 时间戳占用的字节数
+const stampLen = 8
+
+// 一种要发送的消息
+type msgKind struct {
+	msgId  uint32
+	size   int
+	weight int
+}
+
+// 解析 -mix：msgId:size[:weight]，逗号分隔
+func parseMix(mix string) ([]msgKind, error) {
+	var kinds []msgKind
+	for _, item := range strings.Split(mix, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid mix item %q, want msgId:size[:weight]", item)
+		}
+		msgId, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid msgId in %q: %v", item, err)
+		}
+		size, err := strconv.Atoi(parts[1])
+		if err != nil || size < stampLen {
+			return nil, fmt.Errorf("invalid size in %q, must be at least %d", item, stampLen)
+		}
+		weight := 1
+		if len(parts) == 3 {
+			weight, err = strconv.Atoi(parts[2])
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("invalid weight in %q", item)
+			}
+		}
+		kinds = append(kinds, msgKind{msgId: uint32(msgId), size: size, weight: weight})
+	}
+	if len(kinds) == 0 {
+		return nil, errors.New("empty mix")
+	}
+	return kinds, nil
+}
+
+// 按权重随机选择一种消息
+func pick(kinds []msgKind, total int, r *rand.Rand) msgKind {
+	n := r.Intn(total)
+	for _, k := range kinds {
+		if n < k.weight {
+			return k
+		}
+		n -= k.weight
+	}
+	return kinds[len(kinds)-1]
+}
+
+// 统计回复延迟的路由
+type replyRouter struct {
+	router.BaseRouter
+	stats *stats
+}
+
+func (r *replyRouter) Handle(req iface.IRequest) {
+	data := req.GetData()
+	if len(data) < stampLen {
+		r.stats.addBadReply()
+		return
+	}
+	sentAt := int64(binary.BigEndian.Uint64(data))
+	r.stats.addRecv(len(data), time.Duration(time.Now().UnixNano()-sentAt))
+}
+
+// -serve 使用的回显路由
+type echoRouter struct {
+	router.BaseRouter
+	offset uint32
+}
+
+func (r *echoRouter) Handle(req iface.IRequest) {
+	req.GetConnection().WriteMsg(req.GetMsgID()+r.offset, req.GetData())
+}
+
+// 在本进程内启动一个回显服务器
+func serve(mode, addr string, kinds []msgKind, offset uint32) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	opts := []network.Option{network.WithConfig(conf.Get()), network.WithHost(host), network.WithMode(mode)}
+	if mode == conf.ServerModeWebsocket {
+		opts = append(opts, network.WithWsPort(port))
+	} else {
+		opts = append(opts, network.WithTcpPort(port))
+	}
+	s, err := network.NewServer(opts...)
+	if err != nil {
+		return err
+	}
+	added := make(map[uint32]bool)
+	for _, k := range kinds {
+		if !added[k.msgId] {
+			s.AddRouter(k.msgId, &echoRouter{offset: offset})
+			added[k.msgId] = true
+		}
+	}
+	s.Start()
+	// 等待监听成功
+	for i := 0; i < 50; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("echo server on %s not ready", addr)
+}
+
+func main() {
+	var (
+		addr       = flag.String("addr", "127.0.0.1:7777", "server address host:port")
+		mode       = flag.String("network", client.NetworkTcp, "tcp or websocket")
+		conns      = flag.Int("conns", 100, "number of connections")
+		rate       = flag.Int("rate", 1000, "total messages per second across all connections")
+		duration   = flag.Duration("duration", 10*time.Second, "how long to send")
+		drain      = flag.Duration("drain", 2*time.Second, "how long to wait for outstanding replies")
+		mix        = flag.String("mix", "1:64", "message mix msgId:size[:weight],...")
+		offset     = flag.Uint("reply-offset", 0, "reply msgId = msgId + reply-offset")
+		maxErrors  = flag.Int64("max-errors", -1, "exit 1 if errors exceed this, -1 disables")
+		serveLocal = flag.Bool("serve", false, "start an in-process echo server on -addr")
+		logLevel   = flag.String("log-level", "warn", "framework log level")
+	)
+	flag.Parse()
+
+	logger, err := log.New(*logLevel, "", stdlog.LstdFlags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	log.Export(logger)
+
+	kinds, err := parseMix(*mix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *conns < 1 || *rate < 1 {
+		fmt.Fprintln(os.Stderr, "-conns and -rate must be positive")
+		os.Exit(2)
+	}
+	totalWeight := 0
+	for _, k := range kinds {
+		totalWeight += k.weight
+	}
+
+	if *serveLocal {
+		if err := serve(*mode, *addr, kinds, uint32(*offset)); err != nil {
+			fmt.Fprintln(os.Stderr, "serve:", err)
+			os.Exit(1)
+		}
+	}
+
+	st := &stats{}
+	// 所有连接共用一组回复路由
+	msgHandler := router.NewMsgHandleWithPool(0, 0) //客户端在读goroutine中直接处理回复
+	added := make(map[uint32]bool)
+	for _, k := range kinds {
+		replyId := k.msgId + uint32(*offset)
+		if !added[replyId] {
+			msgHandler.AddRouter(replyId, &replyRouter{stats: st})
+			added[replyId] = true
+		}
+	}
+
+	dialAddr := *addr
+	if *mode == client.NetworkWebsocket && !strings.Contains(dialAddr, "://") {
+		dialAddr = "ws://" + dialAddr + "/"
+	}
+
+	// 建立连接
+	clients := make([]*client.Client, 0, *conns)
+	var clientsLock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < *conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := client.NewClient(*mode, dialAddr)
+			c.SetReconnect(false, 0, 0)
+			c.SetWriteTimeout(time.Second)
+			c.SetMsgHandler(msgHandler)
+			go c.Start()
+			for j := 0; j < 50 && !c.IsConnected(); j++ {
+				time.Sleep(100 * time.Millisecond)
+			}
+			if !c.IsConnected() {
+				st.addDialError()
+				c.Stop()
+				return
+			}
+			clientsLock.Lock()
+			clients = append(clients, c)
+			clientsLock.Unlock()
+		}()
+	}
+	wg.Wait()
+	fmt.Printf("connected %d/%d to %s\n", len(clients), *conns, dialAddr)
+	if len(clients) == 0 {
+		os.Exit(1)
+	}
+
+	// 每个连接分到的发送间隔
+	interval := time.Duration(float64(time.Second) * float64(len(clients)) / float64(*rate))
+	if interval < 1 {
+		// -rate 比 -conns 大很多时会截断成0，NewTicker(0) 会panic，这时每个连接尽快发送
+		interval = 1
+	}
+	stop := make(chan struct{})
+	start := time.Now()
+	for i, c := range clients {
+		wg.Add(1)
+		go func(c *client.Client, seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			// 错开各个连接的发送时间
+			time.Sleep(time.Duration(r.Int63n(int64(interval) + 1)))
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					k := pick(kinds, totalWeight, r)
+					data := make([]byte, k.size)
+					binary.BigEndian.PutUint64(data, uint64(time.Now().UnixNano()))
+					if err := c.WriteMsg(k.msgId, data); err != nil {
+						st.addWriteError()
+						continue
+					}
+					st.addSent(len(data))
+				}
+			}
+		}(c, int64(i)+start.UnixNano())
+	}
+
+	time.Sleep(*duration)
+	close(stop)
+	wg.Wait()
+	elapsed := time.Since(start)
+	time.Sleep(*drain)
+	for _, c := range clients {
+		c.Stop()
+	}
+
+	st.report(os.Stdout, elapsed)
+	if *maxErrors >= 0 && st.errors() > uint64(*maxErrors) {
+		os.Exit(1)
+	}
+}
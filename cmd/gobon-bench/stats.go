@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+压测统计：发送、接收、错误计数和往返延迟
+*/
+type stats struct {
+	sent      uint64
+	recv      uint64
+	sentBytes uint64
+	recvBytes uint64
+
+	dialErrors  uint64
+	writeErrors uint64
+	badReplies  uint64
+
+	lock      sync.Mutex
+	latencies []time.Duration
+}
+
+func (s *stats) addSent(n int) {
+	atomic.AddUint64(&s.sent, 1)
+	atomic.AddUint64(&s.sentBytes, uint64(n))
+}
+
+func (s *stats) addRecv(n int, rtt time.Duration) {
+	atomic.AddUint64(&s.recv, 1)
+	atomic.AddUint64(&s.recvBytes, uint64(n))
+	s.lock.Lock()
+	s.latencies = append(s.latencies, rtt)
+	s.lock.Unlock()
+}
+
+func (s *stats) addDialError() {
+	atomic.AddUint64(&s.dialErrors, 1)
+}
+
+func (s *stats) addWriteError() {
+	atomic.AddUint64(&s.writeErrors, 1)
+}
+
+func (s *stats) addBadReply() {
+	atomic.AddUint64(&s.badReplies, 1)
+}
+
+// 发出去没有收到回复的消息数
+func (s *stats) lost() uint64 {
+	sent, recv := atomic.LoadUint64(&s.sent), atomic.LoadUint64(&s.recv)
+	if sent > recv {
+		return sent - recv
+	}
+	return 0
+}
+
+// 错误总数，发出去没有收到回复的也算
+func (s *stats) errors() uint64 {
+	return atomic.LoadUint64(&s.dialErrors) + atomic.LoadUint64(&s.writeErrors) +
+		atomic.LoadUint64(&s.badReplies) + s.lost()
+}
+
+// 取第p百分位的延迟，latencies需要已经排好序
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	idx := int(float64(len(latencies)-1) * p / 100)
+	return latencies[idx]
+}
+
+// 输出压测报告
+func (s *stats) report(w io.Writer, elapsed time.Duration) {
+	s.lock.Lock()
+	latencies := make([]time.Duration, len(s.latencies))
+	copy(latencies, s.latencies)
+	s.lock.Unlock()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	secs := elapsed.Seconds()
+	sent, recv := atomic.LoadUint64(&s.sent), atomic.LoadUint64(&s.recv)
+	fmt.Fprintf(w, "duration:    %v\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "sent:        %d msgs, %d bytes\n", sent, atomic.LoadUint64(&s.sentBytes))
+	fmt.Fprintf(w, "received:    %d msgs, %d bytes\n", recv, atomic.LoadUint64(&s.recvBytes))
+	fmt.Fprintf(w, "throughput:  %.1f msgs/s sent, %.1f msgs/s received\n", float64(sent)/secs, float64(recv)/secs)
+	fmt.Fprintf(w, "latency:     p50=%v p95=%v p99=%v max=%v\n",
+		percentile(latencies, 50), percentile(latencies, 95), percentile(latencies, 99), percentile(latencies, 100))
+	fmt.Fprintf(w, "errors:      %d (dial=%d write=%d bad_reply=%d lost=%d)\n", s.errors(),
+		atomic.LoadUint64(&s.dialErrors), atomic.LoadUint64(&s.writeErrors), atomic.LoadUint64(&s.badReplies), s.lost())
+}
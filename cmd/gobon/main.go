@@ -0,0 +1,41 @@
+/*
+gobon 命令行工具
+
+	gobon config dump [-format json|yaml|toml] [-config file] [-tcpport 8000 ...]
+
+config dump 按 默认值、配置文件、环境变量、命令行参数 合并配置并校验，
+然后按 -format 输出，输出的内容可以直接作为配置文件使用。
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gobonbon/conf"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gobon config dump [-format json|yaml|toml] [-config file] [config flags]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 3 || os.Args[1] != "config" || os.Args[2] != "dump" {
+		usage()
+	}
+
+	fs := flag.NewFlagSet("gobon config dump", flag.ExitOnError)
+	format := fs.String("format", conf.FormatJSON, "output format json, yaml or toml")
+	conf.BindFlags(fs)
+	fs.Parse(os.Args[3:])
+
+	if err := conf.Reload(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := conf.Dump(os.Stdout, conf.Get(), *format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,97 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// 配置文件格式，按扩展名选择
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// 按扩展名得到配置文件格式 .json .yaml .yml .toml
+func FormatOf(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON, nil
+	case ".yaml", ".yml":
+		return FormatYAML, nil
+	case ".toml":
+		return FormatTOML, nil
+	}
+	return "", fmt.Errorf("unknown config format %q, want .json .yaml .yml or .toml", filepath.Ext(path))
+}
+
+/*
+把配置文件转成json
+yaml和toml先解析成map再转成json，之后统一按json解析到 GlobalObj，
+保证三种格式的字段名映射（不区分大小写）和校验完全一致
+*/
+func toJSON(format string, data []byte) ([]byte, error) {
+	m := make(map[string]interface{})
+	switch format {
+	case FormatJSON:
+		return data, nil
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+	case FormatTOML:
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown config format %q", format)
+	}
+	return json.Marshal(m)
+}
+
+// 按字段名输出的配置，yaml和toml默认的字段名规则不同，这里统一使用Go的字段名
+func fieldMap(g *GlobalObj) map[string]interface{} {
+	v := reflect.ValueOf(g).Elem()
+	t := v.Type()
+	m := make(map[string]interface{}, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		f := v.Field(i)
+		// toml不能输出nil，没有设置的列表和map不输出
+		if (f.Kind() == reflect.Slice || f.Kind() == reflect.Map) && f.IsNil() {
+			continue
+		}
+		m[t.Field(i).Name] = f.Interface()
+	}
+	return m
+}
+
+// 按format输出配置，输出的内容可以直接作为配置文件使用；令牌和密钥被隐藏，见 Masked
+func Dump(w io.Writer, g *GlobalObj, format string) error {
+	g = g.Masked()
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(g)
+	case FormatYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(fieldMap(g)); err != nil {
+			return err
+		}
+		return enc.Close()
+	case FormatTOML:
+		return toml.NewEncoder(w).Encode(fieldMap(g))
+	}
+	return fmt.Errorf("unknown config format %q", format)
+}
@@ -1,10 +1,10 @@
 package conf
 
 import (
-	"encoding/json"
-	"fmt"
+	"flag"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 )
 
 const (
@@ -13,9 +13,17 @@ const (
 	ServerModeUdp       = "udp"
 )
 
+// 同一个用户重复登录时的处理方式
+const (
+	LoginKickOld    = "kick"   //踢掉旧连接，默认
+	LoginRejectNew  = "reject" //拒绝新连接的登录
+	LoginAllowMulti = "multi"  //允许多个连接同时在线
+)
+
 /*
 存储一切有关gobonbon框架的全局参数，供其他模块使用
 一些参数也可以通过 用户根据 gobonbon.json来配置
+带 reload:"hot" 标签的字段可以在运行时热更新，其他字段修改后需要重启
 */
 type GlobalObj struct {
 	Host    string //当前服务器主机IP
@@ -24,19 +32,99 @@ type GlobalObj struct {
 	Name    string //当前服务器名称
 	Version string //当前gobonbon版本号
 
-	MaxPacketSize    uint32 //都需数据包的最大值
-	MaxConn          int    //当前服务器主机允许的最大链接个数
+	MaxPacketSize    uint32 `reload:"hot"` //都需数据包的最大值
+	MaxConn          int    `reload:"hot"` //当前服务器主机允许的最大链接个数
 	MaxMsgChanLen    int
 	WorkerPoolSize   uint64 //业务工作Worker池的数量
 	MaxWorkerTaskLen uint64 //业务工作Worker对应负责的任务队列最大任务存储数量
 
 	Mode string
+
+	LogFormat  string            `reload:"hot"` //框架日志的输出格式 text 或 json，为空时不修改
+	LogLevel   string            `reload:"hot"` //日志等级 debug info warn error fatal，为空时不修改
+	LogModules map[string]string `reload:"hot"` //按模块设置的日志等级，如 {"network": "info", "game.match": "debug"}
+
+	// 连接准入控制
+	MaxConnPerIP  int      `reload:"hot"` //同一个IP允许的最大链接个数，0表示不限制
+	MaxAcceptRate int      `reload:"hot"` //每秒允许接入的新链接个数，0表示不限制
+	AcceptBurst   int      `reload:"hot"` //接入速率允许的突发数量，不大于0时等于MaxAcceptRate
+	AllowCIDR     []string `reload:"hot"` //允许接入的网段，为空表示全部允许
+	DenyCIDR      []string `reload:"hot"` //拒绝接入的网段，优先于AllowCIDR
+	FullMsgId     uint32   `reload:"hot"` //因为满员(总数或单IP)拒绝接入时发给客户端的消息ID
+	FullMsg       string   `reload:"hot"` //因为满员拒绝接入时发给客户端的消息内容，为空则直接关闭链接；黑名单和接入速率的拒绝不发送
+
+	// 单点登录，见 network.UserManager
+	LoginPolicy string `reload:"hot"` //重复登录的处理方式 kick reject multi，为空时等于kick
+	KickMsgId   uint32 `reload:"hot"` //被挤下线时发给旧连接的消息ID
+	KickMsg     string `reload:"hot"` //被挤下线时发给旧连接的消息内容，为空则直接关闭链接
+
+	// 集群，见 cluster 包
+	ClusterName   string            //当前节点的名字，需要在ClusterNodes中
+	ClusterNodes  map[string]string //全部节点的名字和地址，如 {"gate": "10.0.0.1:7000", "battle": "10.0.0.2:7000"}
+	ClusterSecret string            //节点之间连接时验证的共享密钥，全部节点需要相同
+
+	AdminHost  string //管理http监听的IP，默认只监听本机
+	AdminPort  int    //管理http端口，提供 /metrics 等接口，0表示不开启
+	AdminToken string //管理接口的访问令牌，不为空时请求需要带上 Authorization: Bearer <token>
 }
 
 /*
-定义一个全局的对象
+全局的配置对象，用 Get 读取，第一次读取时才加载
+热更新时不修改原来的对象，而是整体换成新的对象，其他goroutine读取时不需要加锁
+*/
+var current atomic.Value //*GlobalObj
+
+/*
+当前的全局配置，返回的对象不会再被修改，也不要修改它的字段
+第一次调用时用 DefaultLoader 加载：默认值、配置文件、环境变量，失败时使用默认值并记录在 LoadError
 */
-var GlobalObject *GlobalObj
+func Get() *GlobalObj {
+	if g, ok := current.Load().(*GlobalObj); ok {
+		return g
+	}
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	return loadLocked()
+}
+
+// 还没有加载时加载全局配置，需要持有reloadLock
+func loadLocked() *GlobalObj {
+	if g, ok := current.Load().(*GlobalObj); ok {
+		return g
+	}
+	g, err := DefaultLoader.Load()
+	loadError = err
+	if err != nil {
+		g = DefaultGlobalObj()
+	}
+	store(g)
+	return g
+}
+
+/*
+Deprecated: 使用 Get 读取全局配置，Reload 重新加载
+兼容旧代码保留，全局配置每次换成新的对象后把内容复制到这里，第一次 Get 或 Reload 之前是默认值；
+复制时直接修改字段，和其他goroutine的读取没有同步，并发读取配置时只能使用 Get
+*/
+var GlobalObject = DefaultGlobalObj()
+
+// 换成新的全局配置并同步到 GlobalObject，需要持有reloadLock
+func store(g *GlobalObj) {
+	if g == GlobalObject {
+		// GlobalObject 之后还会被修改，current 中保存一份副本
+		cp := *g
+		g = &cp
+	}
+	current.Store(g)
+	*GlobalObject = *g
+}
+
+// 换成新的全局配置，之前 Get 得到的对象不受影响；不会通知 Subscribe 的订阅者
+func Set(g *GlobalObj) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	store(g)
+}
 
 // PathExists Check if a file exists.(判断一个文件是否存在)
 func PathExists(path string) (bool, error) {
@@ -68,33 +156,75 @@ func GetConfigFilePath() string {
 
 }
 
-// 读取用户的配置文件
-func (g *GlobalObj) Reload() {
-	confFilePath := GetConfigFilePath()
-	if confFileExists, _ := PathExists(confFilePath); !confFileExists {
-		return
-	}
+// 启动时使用的配置加载器，BindFlags 注册的命令行参数也保存在这里
+var DefaultLoader = NewLoader()
 
-	data, err := os.ReadFile(confFilePath)
-	fmt.Println(data)
-	if err != nil {
-		panic(err)
-	}
-	fmt.Println(data)
-	//将json数据解析到struct中
-	//fmt.Printf("json :%s\n", data)
-	err = json.Unmarshal(data, &GlobalObject)
+// 在fs中注册配置对应的命令行参数，解析后调用 Reload 生效
+func BindFlags(fs *flag.FlagSet) {
+	DefaultLoader.BindFlags(fs)
+}
+
+// 最近一次加载全局配置的错误，reloadLock保护
+var loadError error
+
+// 最近一次加载全局配置的错误，还没有加载时先加载，NewServerWithConfig 启动前检查
+func LoadError() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	loadLocked()
+	return loadError
+}
+
+/*
+重新加载全局配置：默认值、配置文件、环境变量、命令行参数，全部字段都换成新的值
+加载或校验失败时返回错误，全局配置保持不变；不会通知 Subscribe 的订阅者，运行时修改使用 ReloadHot
+*/
+func Reload() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	loaded, err := DefaultLoader.Load()
+	loadError = err
 	if err != nil {
-		panic(err)
+		return err
 	}
+	store(loaded)
+	return nil
 }
 
 /*
-提供init方法，默认加载
+Deprecated: 使用 conf.Reload
+g是 GlobalObject 时重新加载全局配置，否则用 DefaultLoader 加载到g，全局配置不变
 */
-func init() {
-	//初始化GlobalObject变量，设置一些默认值
-	GlobalObject = &GlobalObj{
+func (g *GlobalObj) Reload() error {
+	if g == GlobalObject {
+		return Reload()
+	}
+	loaded, err := DefaultLoader.Load()
+	if err != nil {
+		return err
+	}
+	*g = *loaded
+	return nil
+}
+
+// 输出配置时代替令牌和密钥的值
+const MaskedValue = "******"
+
+// 隐藏 AdminToken 和 ClusterSecret 之后的副本，Dump 和管理接口 /config 输出这个副本
+func (g *GlobalObj) Masked() *GlobalObj {
+	m := *g
+	if m.AdminToken != "" {
+		m.AdminToken = MaskedValue
+	}
+	if m.ClusterSecret != "" {
+		m.ClusterSecret = MaskedValue
+	}
+	return &m
+}
+
+// 内置的默认配置
+func DefaultGlobalObj() *GlobalObj {
+	return &GlobalObj{
 		Name:    "gobonbon",
 		Version: "V1.0",
 		TcpPort: 7777,
@@ -106,8 +236,7 @@ func init() {
 		MaxMsgChanLen:    1024,
 		WorkerPoolSize:   10,
 		MaxWorkerTaskLen: 1024,
-	}
 
-	//从配置文件中加载一些用户配置的参数
-	GlobalObject.Reload()
+		AdminHost: "127.0.0.1",
+	}
 }
@@ -0,0 +1,274 @@
+package conf
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 配置值的来源，优先级从低到高
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// 环境变量的默认前缀，GOBONBON_TCPPORT 对应 TcpPort
+const DefaultEnvPrefix = "GOBONBON_"
+
+/*
+分层加载配置：默认值 < 配置文件 < 环境变量 < 命令行参数，后面的覆盖前面的
+
+	配置文件：按扩展名支持 .json .yaml .yml .toml，字段名不区分大小写
+
+	环境变量：前缀 + 字段名大写，如 GOBONBON_TCPPORT=8000
+	命令行：  字段名小写，如 -tcpport=8000，需要先调用 BindFlags 并解析命令行
+	[]string 用逗号分隔，如 GOBONBON_ALLOWCIDR=10.0.0.0/8,192.168.0.0/16
+	map[string]string 用逗号和等号分隔，如 GOBONBON_LOGMODULES=network=info,game=debug
+
+加载后可以用 Sources 查看每个字段的值来自哪一层。
+*/
+type Loader struct {
+	filePath  string            //配置文件路径，为空时使用 GetConfigFilePath
+	envPrefix string            //环境变量前缀
+	flags     map[string]string //命令行中设置过的字段，字段名 -> 原始值
+	lock      sync.RWMutex      //保护上面的设置和sources，管理接口和热更新会在其他goroutine中读取
+	sources   map[string]string //上一次加载时每个字段的来源
+}
+
+func NewLoader() *Loader {
+	return &Loader{
+		envPrefix: DefaultEnvPrefix,
+		flags:     make(map[string]string),
+		sources:   make(map[string]string),
+	}
+}
+
+// 设置配置文件路径，为空时使用 GetConfigFilePath
+func (l *Loader) SetFilePath(path string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.filePath = path
+}
+
+// 设置环境变量前缀
+func (l *Loader) SetEnvPrefix(prefix string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.envPrefix = prefix
+}
+
+// 配置文件路径
+func (l *Loader) FilePath() string {
+	l.lock.RLock()
+	path := l.filePath
+	l.lock.RUnlock()
+	if path != "" {
+		return path
+	}
+	return GetConfigFilePath()
+}
+
+/*
+在fs中注册每个配置字段对应的命令行参数，以及指定配置文件的 -config
+fs解析之后再调用 Load，命令行中出现过的参数覆盖其他来源
+*/
+func (l *Loader) BindFlags(fs *flag.FlagSet) {
+	fs.Func("config", "config file path", func(s string) error {
+		l.SetFilePath(s)
+		return nil
+	})
+	l.lock.RLock()
+	prefix := l.envPrefix
+	l.lock.RUnlock()
+	t := reflect.TypeOf(GlobalObj{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		usage := fmt.Sprintf("config %s (env %s%s)", name, prefix, strings.ToUpper(name))
+		fs.Func(strings.ToLower(name), usage, func(s string) error {
+			if err := setField(reflect.New(field.Type).Elem(), s); err != nil {
+				return err
+			}
+			l.lock.Lock()
+			l.flags[name] = s
+			l.lock.Unlock()
+			return nil
+		})
+	}
+}
+
+// 按 默认值、配置文件、环境变量、命令行参数 的顺序加载配置，合并后校验
+func (l *Loader) Load() (*GlobalObj, error) {
+	g := DefaultGlobalObj()
+	v := reflect.ValueOf(g).Elem()
+	t := v.Type()
+	sources := make(map[string]string)
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			sources[t.Field(i).Name] = SourceDefault
+		}
+	}
+
+	// 取出设置的副本，加载的过程中可以在其他goroutine中修改
+	path := l.FilePath()
+	l.lock.RLock()
+	prefix := l.envPrefix
+	flags := make(map[string]string, len(l.flags))
+	for name, s := range l.flags {
+		flags[name] = s
+	}
+	l.lock.RUnlock()
+
+	// 配置文件
+	if exists, _ := PathExists(path); exists {
+		format, err := FormatOf(path)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = toJSON(format, data); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		keys := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if err := json.Unmarshal(data, g); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for key := range keys {
+			// 和encoding/json一样，字段名不区分大小写
+			if field, ok := t.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, key) }); ok {
+				sources[field.Name] = SourceFile
+			}
+		}
+	}
+
+	// 环境变量
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		env := prefix + strings.ToUpper(field.Name)
+		s, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), s); err != nil {
+			return nil, fmt.Errorf("%s: %v", env, err)
+		}
+		sources[field.Name] = SourceEnv
+	}
+
+	// 命令行参数
+	for name, s := range flags {
+		if err := setField(v.FieldByName(name), s); err != nil {
+			return nil, fmt.Errorf("-%s: %v", strings.ToLower(name), err)
+		}
+		sources[name] = SourceFlag
+	}
+
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+	l.lock.Lock()
+	l.sources = sources
+	l.lock.Unlock()
+	return g, nil
+}
+
+// 上一次加载时每个字段的来源，字段名 -> default file env flag
+func (l *Loader) Sources() map[string]string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	sources := make(map[string]string, len(l.sources))
+	for name, source := range l.sources {
+		sources[name] = source
+	}
+	return sources
+}
+
+// 不是默认值的字段，按字段名排序，格式为 字段名=来源，方便启动时打印
+func (l *Loader) Report() []string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	var list []string
+	for name, source := range l.sources {
+		if source != SourceDefault {
+			list = append(list, name+"="+source)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// 把字符串解析成字段的类型
+func setField(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		list := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		m := make(map[string]string)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid item %q, want key=value", item)
+			}
+			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package conf
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLoaderLayers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gobon.json")
+	data := `{"tcpport": 8000, "WsPort": 8001, "MaxConn": 100, "Name": "file"}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOBONBON_WSPORT", "9001")
+	t.Setenv("GOBONBON_MAXCONN", "200")
+	t.Setenv("GOBONBON_ALLOWCIDR", "10.0.0.0/8, 192.168.0.0/16")
+	t.Setenv("GOBONBON_LOGMODULES", "network=info,game.match=debug")
+
+	l := NewLoader()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	l.BindFlags(fs)
+	if err := fs.Parse([]string{"-config", path, "-maxconn=300"}); err != nil {
+		t.Fatal(err)
+	}
+	g, err := l.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g.Host != "0.0.0.0" || g.Name != "file" || g.TcpPort != 8000 || g.WsPort != 9001 || g.MaxConn != 300 {
+		t.Fatalf("loaded %+v", g)
+	}
+	if !reflect.DeepEqual(g.AllowCIDR, []string{"10.0.0.0/8", "192.168.0.0/16"}) {
+		t.Fatalf("AllowCIDR = %q", g.AllowCIDR)
+	}
+	if !reflect.DeepEqual(g.LogModules, map[string]string{"network": "info", "game.match": "debug"}) {
+		t.Fatalf("LogModules = %v", g.LogModules)
+	}
+
+	sources := l.Sources()
+	want := map[string]string{
+		"Host":    SourceDefault,
+		"Name":    SourceFile,
+		"TcpPort": SourceFile,
+		"WsPort":  SourceEnv,
+		"MaxConn": SourceFlag,
+	}
+	for name, source := range want {
+		if sources[name] != source {
+			t.Fatalf("source of %s = %s, want %s", name, sources[name], source)
+		}
+	}
+}
+
+// 管理接口读取来源的同时重新加载，用 -race 运行
+func TestLoaderSourcesRace(t *testing.T) {
+	l := NewLoader()
+	l.SetFilePath(filepath.Join(t.TempDir(), "missing.json"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			l.Sources()
+			l.Report()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := l.Load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+// 解析命令行、修改配置文件路径的同时重新加载，用 -race 运行
+func TestLoaderSettingsRace(t *testing.T) {
+	dir := t.TempDir()
+	l := NewLoader()
+	l.SetFilePath(filepath.Join(dir, "missing.json"))
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	l.BindFlags(fs)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			l.SetFilePath(filepath.Join(dir, "missing"+strconv.Itoa(i)+".json"))
+			if err := fs.Parse([]string{"-maxconn=" + strconv.Itoa(100+i), "-config=" + filepath.Join(dir, "other.json")}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := l.Load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	g, err := l.Load()
+	if err != nil || g.MaxConn != 199 {
+		t.Fatalf("MaxConn = %d, %v", g.MaxConn, err)
+	}
+}
+
+func TestLoaderBadEnv(t *testing.T) {
+	t.Setenv("GOBONBON_TCPPORT", "abc")
+	l := NewLoader()
+	l.SetFilePath(filepath.Join(t.TempDir(), "missing.json"))
+	if _, err := l.Load(); err == nil {
+		t.Fatal("want error for bad GOBONBON_TCPPORT")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	g := DefaultGlobalObj()
+	if err := g.Validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+
+	g.TcpPort = 0
+	g.MaxConn = 0
+	g.WorkerPoolSize = 0
+	g.DenyCIDR = []string{"10.0.0.0"}
+	err := g.Validate()
+	errs, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("err = %v, want ValidationError", err)
+	}
+	var fields []string
+	for _, fe := range errs {
+		fields = append(fields, fe.Field)
+	}
+	if want := []string{"TcpPort", "MaxConn", "WorkerPoolSize", "DenyCIDR"}; !reflect.DeepEqual(fields, want) {
+		t.Fatalf("fields = %q, want %q", fields, want)
+	}
+
+	g = DefaultGlobalObj()
+	g.Mode = ServerModeUdp
+	if err := g.Validate(); err == nil {
+		t.Fatal("want error for unsupported mode")
+	}
+}
+
+func TestLoaderBadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gobon.json")
+	if err := os.WriteFile(path, []byte(`{"MaxConn": 0}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := NewLoader()
+	l.SetFilePath(path)
+	if _, err := l.Load(); err == nil {
+		t.Fatal("want error for MaxConn 0")
+	}
+}
+
+func TestLoaderFormats(t *testing.T) {
+	files := map[string]string{
+		"gobon.json": `{"TcpPort": 8000, "allowcidr": ["10.0.0.0/8"], "LogModules": {"network": "info"}}`,
+		"gobon.yaml": "TcpPort: 8000\nallowcidr:\n  - 10.0.0.0/8\nLogModules:\n  network: info\n",
+		"gobon.toml": "TcpPort = 8000\nallowcidr = [\"10.0.0.0/8\"]\n[LogModules]\nnetwork = \"info\"\n",
+	}
+	dir := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		l := NewLoader()
+		l.SetFilePath(path)
+		g, err := l.Load()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if g.TcpPort != 8000 || !reflect.DeepEqual(g.AllowCIDR, []string{"10.0.0.0/8"}) || g.LogModules["network"] != "info" {
+			t.Fatalf("%s: loaded %+v", name, g)
+		}
+		if l.Sources()["AllowCIDR"] != SourceFile {
+			t.Fatalf("%s: source of AllowCIDR = %s", name, l.Sources()["AllowCIDR"])
+		}
+	}
+}
+
+// 输出的配置中不包含令牌和密钥，原来的配置不变
+func TestDumpMasked(t *testing.T) {
+	g := DefaultGlobalObj()
+	g.AdminToken = "admin-tok"
+	g.ClusterSecret = "cluster-s3cret"
+	for _, format := range []string{FormatJSON, FormatYAML, FormatTOML} {
+		var buf bytes.Buffer
+		if err := Dump(&buf, g, format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		out := buf.String()
+		if strings.Contains(out, "admin-tok") || strings.Contains(out, "cluster-s3cret") {
+			t.Fatalf("%s: secret in dump:\n%s", format, out)
+		}
+		if strings.Count(out, MaskedValue) != 2 {
+			t.Fatalf("%s: want 2 masked fields:\n%s", format, out)
+		}
+	}
+	if g.AdminToken != "admin-tok" || g.ClusterSecret != "cluster-s3cret" {
+		t.Fatal("Dump modified the config")
+	}
+	if m := DefaultGlobalObj().Masked(); m.AdminToken != "" || m.ClusterSecret != "" {
+		t.Fatal("empty fields masked")
+	}
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	g := DefaultGlobalObj()
+	g.TcpPort = 8000
+	g.DenyCIDR = []string{"10.0.0.0/8"}
+	g.LogModules = map[string]string{"network": "info"}
+	dir := t.TempDir()
+	for _, format := range []string{FormatJSON, FormatYAML, FormatTOML} {
+		path := filepath.Join(dir, "dump."+format)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Dump(f, g, format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		f.Close()
+
+		l := NewLoader()
+		l.SetFilePath(path)
+		loaded, err := l.Load()
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if !reflect.DeepEqual(loaded, g) {
+			t.Fatalf("%s: loaded %+v, want %+v", format, loaded, g)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package conf
+
+import (
+	"gobonbon/log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"time"
+)
+
+/*
+配置热更新
+
+	conf.Subscribe(func(changes []conf.Change) { ... })
+	w := conf.Watch(5 * time.Second) //每5秒检查一次配置文件，收到SIGHUP时也会重新加载
+	defer w.Stop()
+
+重新加载时按 Loader 的顺序合并并校验，只应用带 reload:"hot" 标签的字段，
+其他字段的修改会被忽略并打印警告，需要重启才能生效。
+应用时不会修改原来的全局配置，而是换成一个新的对象，持有旧对象的代码看到的值不会变化。
+*/
+
+// 一个字段的修改
+type Change struct {
+	Field string
+	Old   interface{}
+	New   interface{}
+}
+
+// 一次重新加载的结果
+type ReloadResult struct {
+	Applied []Change //已经生效的修改
+	Ignored []Change //需要重启才能生效的修改
+}
+
+var confLog = log.Module("conf")
+
+type subscriber struct {
+	id int
+	fn func(changes []Change)
+}
+
+var (
+	reloadLock  sync.Mutex //同一时间只有一个重新加载，也保护全局配置的替换和loadError
+	subLock     sync.Mutex
+	subscribers []subscriber
+	subID       int
+)
+
+// 注册配置修改的回调，返回取消注册的函数
+// 回调按注册顺序在重新加载的goroutine中调用，此时 Get 已经返回新的值
+func Subscribe(fn func(changes []Change)) (unsubscribe func()) {
+	subLock.Lock()
+	defer subLock.Unlock()
+	subID++
+	id := subID
+	subscribers = append(subscribers, subscriber{id: id, fn: fn})
+	return func() {
+		subLock.Lock()
+		defer subLock.Unlock()
+		for i, sub := range subscribers {
+			if sub.id == id {
+				subscribers = append(subscribers[:i:i], subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func notify(changes []Change) {
+	subLock.Lock()
+	subs := subscribers
+	subLock.Unlock()
+	for _, sub := range subs {
+		sub.fn(changes)
+	}
+}
+
+// 字段是否可以热更新
+func isHot(field reflect.StructField) bool {
+	return field.Tag.Get("reload") == "hot"
+}
+
+/*
+用 DefaultLoader 重新加载配置，应用可以热更新的字段并通知订阅者
+加载或校验失败时返回错误，全局配置保持不变
+*/
+func ReloadHot() (*ReloadResult, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	loaded, err := DefaultLoader.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	old := loadLocked()
+	next := *old
+	ov := reflect.ValueOf(old).Elem()
+	lv := reflect.ValueOf(loaded).Elem()
+	nv := reflect.ValueOf(&next).Elem()
+	t := ov.Type()
+	result := &ReloadResult{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || reflect.DeepEqual(ov.Field(i).Interface(), lv.Field(i).Interface()) {
+			continue
+		}
+		c := Change{Field: field.Name, Old: ov.Field(i).Interface(), New: lv.Field(i).Interface()}
+		if isHot(field) {
+			nv.Field(i).Set(lv.Field(i))
+			result.Applied = append(result.Applied, c)
+		} else {
+			result.Ignored = append(result.Ignored, c)
+		}
+	}
+
+	for _, c := range result.Ignored {
+		confLog.With("field", c.Field, "old", c.Old, "new", c.New).Warn("config field requires restart, change ignored")
+	}
+	if len(result.Applied) == 0 {
+		return result, nil
+	}
+	// 新旧字段混合之后再校验一次
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
+	store(&next)
+	for _, c := range result.Applied {
+		confLog.With("field", c.Field, "old", c.Old, "new", c.New).Info("config field reloaded")
+	}
+	notify(result.Applied)
+	return result, nil
+}
+
+// 监视配置文件，文件修改或收到重新加载信号时调用 ReloadHot
+type Watcher struct {
+	interval time.Duration
+	signals  chan os.Signal
+	exitChan chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+/*
+开始监视配置文件
+interval为检查文件修改时间的间隔，<=0 时不检查文件，只响应信号
+在支持的平台上收到 SIGHUP 时立即重新加载
+*/
+func Watch(interval time.Duration) *Watcher {
+	w := &Watcher{
+		interval: interval,
+		signals:  make(chan os.Signal, 1),
+		exitChan: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if sigs := reloadSignals(); len(sigs) > 0 {
+		signal.Notify(w.signals, sigs...)
+	}
+	go w.run()
+	return w
+}
+
+// 文件的修改时间和大小，任何一个变化都认为文件被修改了
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	last := statFile(DefaultLoader.FilePath())
+	for {
+		select {
+		case <-w.exitChan:
+			return
+		case sig := <-w.signals:
+			confLog.With("signal", sig).Info("reloading config")
+			last = statFile(DefaultLoader.FilePath())
+			w.reload()
+		case <-tick:
+			stamp := statFile(DefaultLoader.FilePath())
+			if stamp.modTime.Equal(last.modTime) && stamp.size == last.size {
+				continue
+			}
+			last = stamp
+			w.reload()
+		}
+	}
+}
+
+func (w *Watcher) reload() {
+	if _, err := ReloadHot(); err != nil {
+		confLog.With("file", DefaultLoader.FilePath(), "err", err).Error("config reload failed, keep current config")
+	}
+}
+
+// 停止监视，可以重复调用
+func (w *Watcher) Stop() {
+	w.stopOnce.Do(func() {
+		signal.Stop(w.signals)
+		close(w.exitChan)
+		<-w.done
+	})
+}
@@ -0,0 +1,148 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReloadHot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gobon.json")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"MaxConn": 100, "TcpPort": 8000}`)
+
+	oldLoader, oldGlobal := DefaultLoader, Get()
+	defer func() { DefaultLoader = oldLoader; Set(oldGlobal) }()
+	DefaultLoader = NewLoader()
+	DefaultLoader.SetFilePath(path)
+	if err := Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan []Change, 1)
+	unsubscribe := Subscribe(func(changes []Change) { changed <- changes })
+	defer unsubscribe()
+
+	w := Watch(10 * time.Millisecond)
+	defer w.Stop()
+	time.Sleep(20 * time.Millisecond)
+	write(`{"MaxConn": 200, "TcpPort": 9000, "LogLevel": "warn"}`)
+
+	select {
+	case changes := <-changed:
+		if len(changes) != 2 || changes[0].Field != "MaxConn" || changes[0].Old != 100 || changes[0].New != 200 || changes[1].Field != "LogLevel" {
+			t.Fatalf("changes = %+v", changes)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no reload")
+	}
+	if Get().MaxConn != 200 || Get().TcpPort != 8000 {
+		t.Fatalf("MaxConn = %d, TcpPort = %d, want 200 and 8000", Get().MaxConn, Get().TcpPort)
+	}
+
+	// 校验失败时保持原来的配置
+	write(`{"MaxConn": 0, "TcpPort": 9000, "LogLevel": "warn"}`)
+	if _, err := ReloadHot(); err == nil {
+		t.Fatal("want error for MaxConn 0")
+	}
+	if Get().MaxConn != 200 {
+		t.Fatalf("MaxConn = %d after failed reload", Get().MaxConn)
+	}
+
+	write(`{"MaxConn": 200, "TcpPort": 9001, "LogLevel": "warn"}`)
+	result, err := ReloadHot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 0 || len(result.Ignored) != 1 || result.Ignored[0].Field != "TcpPort" {
+		t.Fatalf("result = %+v", result)
+	}
+}
+
+// 废弃的 GlobalObject 跟随全局配置，Get 返回的对象不受它的修改影响
+func TestGlobalObjectCompat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gobon.json")
+	oldLoader, oldGlobal := DefaultLoader, Get()
+	defer func() { DefaultLoader = oldLoader; Set(oldGlobal) }()
+	DefaultLoader = NewLoader()
+	DefaultLoader.SetFilePath(path)
+	if err := os.WriteFile(path, []byte(`{"MaxConn": 100}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := GlobalObject.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if GlobalObject.MaxConn != 100 || Get().MaxConn != 100 {
+		t.Fatalf("MaxConn = %d/%d, want 100", GlobalObject.MaxConn, Get().MaxConn)
+	}
+
+	// 旧代码修改 GlobalObject 之后调用 Set
+	GlobalObject.MaxConn = 200
+	Set(GlobalObject)
+	got := Get()
+	GlobalObject.MaxConn = 300
+	if got.MaxConn != 200 {
+		t.Fatalf("Get().MaxConn = %d, want 200", got.MaxConn)
+	}
+
+	// 其他对象的 Reload 不改变全局配置
+	g := DefaultGlobalObj()
+	if err := g.Reload(); err != nil || g.MaxConn != 100 {
+		t.Fatalf("g.Reload: %v, MaxConn = %d", err, g.MaxConn)
+	}
+	if Get().MaxConn != 200 {
+		t.Fatalf("Get().MaxConn = %d after g.Reload", Get().MaxConn)
+	}
+}
+
+// 其他goroutine读取配置的同时热更新，用 -race 运行
+func TestReloadRace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gobon.json")
+	oldLoader, oldGlobal := DefaultLoader, Get()
+	defer func() { DefaultLoader = oldLoader; Set(oldGlobal) }()
+	DefaultLoader = NewLoader()
+	DefaultLoader.SetFilePath(path)
+	if err := os.WriteFile(path, []byte(`{"MaxConn": 100}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			cfg := *Get()
+			if cfg.MaxConn < 100 || cfg.MaxConn >= 150 {
+				t.Errorf("MaxConn = %d", cfg.MaxConn)
+				return
+			}
+		}
+	}()
+	for i := 1; i < 50; i++ {
+		data := []byte(`{"MaxConn": ` + strconv.Itoa(100+i) + `}`)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReloadHot(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	<-done
+	if Get().MaxConn != 149 {
+		t.Fatalf("MaxConn = %d, want 149", Get().MaxConn)
+	}
+}
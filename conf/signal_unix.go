@@ -0,0 +1,13 @@
+//go:build !windows
+
+package conf
+
+import (
+	"os"
+	"syscall"
+)
+
+// 触发重新加载配置的信号
+func reloadSignals() []os.Signal {
+	return []os.Signal{syscall.SIGHUP}
+}
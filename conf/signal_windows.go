@@ -0,0 +1,10 @@
+//go:build windows
+
+package conf
+
+import "os"
+
+// windows没有SIGHUP，只能通过检查文件修改时间重新加载
+func reloadSignals() []os.Signal {
+	return nil
+}
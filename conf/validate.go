@@ -0,0 +1,108 @@
+package conf
+
+import (
+	"fmt"
+	"gobonbon/log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 一个字段的校验错误
+type FieldError struct {
+	Field  string
+	Value  interface{}
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s (got %v)", e.Field, e.Reason, e.Value)
+}
+
+// 全部字段的校验错误，一次报告所有问题
+type ValidationError []*FieldError
+
+func (e ValidationError) Error() string {
+	list := make([]string, 0, len(e))
+	for _, fe := range e {
+		list = append(list, fe.Error())
+	}
+	return "invalid config: " + strings.Join(list, "; ")
+}
+
+// 校验配置，返回 ValidationError，没有问题时返回nil
+func (g *GlobalObj) Validate() error {
+	var errs ValidationError
+	check := func(ok bool, field string, value interface{}, reason string) {
+		if !ok {
+			errs = append(errs, &FieldError{Field: field, Value: value, Reason: reason})
+		}
+	}
+	checkPort := func(field string, port int) {
+		check(port >= 1 && port <= 65535, field, port, "must be between 1 and 65535")
+	}
+
+	switch g.Mode {
+	case "", ServerModeTcp:
+		checkPort("TcpPort", g.TcpPort)
+	case ServerModeWebsocket:
+		checkPort("WsPort", g.WsPort)
+	default:
+		check(false, "Mode", g.Mode, fmt.Sprintf("must be %q or %q", ServerModeTcp, ServerModeWebsocket))
+	}
+	check(g.MaxConn >= 1, "MaxConn", g.MaxConn, "must be at least 1")
+	check(g.MaxMsgChanLen >= 0, "MaxMsgChanLen", g.MaxMsgChanLen, "must not be negative")
+	check(g.WorkerPoolSize >= 1, "WorkerPoolSize", g.WorkerPoolSize, "must be at least 1")
+	check(g.MaxWorkerTaskLen >= 1, "MaxWorkerTaskLen", g.MaxWorkerTaskLen, "must be at least 1")
+
+	switch g.LogFormat {
+	case "", log.FormatText, log.FormatJSON:
+	default:
+		check(false, "LogFormat", g.LogFormat, fmt.Sprintf("must be %q or %q", log.FormatText, log.FormatJSON))
+	}
+	if g.LogLevel != "" {
+		_, err := log.ParseLevel(g.LogLevel)
+		check(err == nil, "LogLevel", g.LogLevel, "must be debug, info, warn, error or fatal")
+	}
+	for module, level := range g.LogModules {
+		_, err := log.ParseLevel(level)
+		check(module != "" && err == nil, "LogModules."+module, level, "must be a non-empty module with level debug, info, warn, error or fatal")
+	}
+
+	check(g.MaxConnPerIP >= 0, "MaxConnPerIP", g.MaxConnPerIP, "must not be negative")
+	check(g.MaxAcceptRate >= 0, "MaxAcceptRate", g.MaxAcceptRate, "must not be negative")
+	check(g.AcceptBurst >= 0, "AcceptBurst", g.AcceptBurst, "must not be negative")
+	for _, cidr := range g.AllowCIDR {
+		_, _, err := net.ParseCIDR(cidr)
+		check(err == nil, "AllowCIDR", cidr, "must be a CIDR like 10.0.0.0/8")
+	}
+	for _, cidr := range g.DenyCIDR {
+		_, _, err := net.ParseCIDR(cidr)
+		check(err == nil, "DenyCIDR", cidr, "must be a CIDR like 10.0.0.0/8")
+	}
+
+	switch g.LoginPolicy {
+	case "", LoginKickOld, LoginRejectNew, LoginAllowMulti:
+	default:
+		check(false, "LoginPolicy", g.LoginPolicy, fmt.Sprintf("must be %q, %q or %q", LoginKickOld, LoginRejectNew, LoginAllowMulti))
+	}
+
+	if g.ClusterName != "" {
+		_, ok := g.ClusterNodes[g.ClusterName]
+		check(ok, "ClusterName", g.ClusterName, "must be one of ClusterNodes")
+	}
+	for name, addr := range g.ClusterNodes {
+		_, port, err := net.SplitHostPort(addr)
+		n, _ := strconv.Atoi(port)
+		check(name != "" && err == nil && n >= 1 && n <= 65535, "ClusterNodes."+name, addr, "must be a non-empty node with address host:port")
+	}
+
+	if g.AdminPort != 0 {
+		checkPort("AdminPort", g.AdminPort)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
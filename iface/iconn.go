@@ -16,4 +16,8 @@ type IConn interface {
 
 	GetTCPConnection() net.Conn
 	GetWsConn() *websocket.Conn // 从当前连接中获取原始的websocket连接)
+
+	SetProperty(key string, value interface{})   //设置链接属性
+	GetProperty(key string) (interface{}, error) //获取链接属性
+	RemoveProperty(key string)                   //移除链接属性
 }
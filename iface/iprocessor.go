@@ -6,7 +6,7 @@ type HandleStep int
 type IServer interface {
 	Start() //启动服务器方法
 	Stop()  //停止服务器方法
-	// Serve()//开启业务服务方法
+	Serve() //开启业务服务方法，阻塞直到Stop
 
 	AddRouter(msgId uint32, router IRouter) //路由功能：给当前服务注册一个路由业务方法，供客户端链接处理使用
 	GetConnMgr() IConnManager               //得到链接管理
@@ -68,4 +68,5 @@ type IConnManager interface {
 	Get(connID uint64) (IConn, error) //利用ConnID获取链接
 	Len() int                         //获取当前连接
 	ClearConn()                       //删除并停止所有链接
+	All() []IConn                     //获取全部链接
 }
@@ -0,0 +1,172 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+结构化日志，带有一组 key/value 字段
+
+	log.With("connID", id).Info("recv msg", "msgId", 5)
+
+text格式输出为 [info   ] recv msg connID=1 msgId=5
+json格式输出为 {"time":"...","level":"info","msg":"recv msg","connID":1,"msgId":5}
+*/
+type Entry struct {
+	logger *Logger //为空时使用全局日志，Export之后也跟着切换
+	module string  //所属模块，决定使用哪个日志等级
+	fields []interface{}
+}
+
+// 创建带字段的日志，kv为 key, value, key, value...
+func (logger *Logger) With(kv ...interface{}) *Entry {
+	return &Entry{logger: logger, fields: kv}
+}
+
+func (e *Entry) target() *Logger {
+	if e.logger == nil {
+		return gLogger
+	}
+	return e.logger
+}
+
+// 在当前字段的基础上追加字段
+func (e *Entry) With(kv ...interface{}) *Entry {
+	fields := make([]interface{}, 0, len(e.fields)+len(kv))
+	fields = append(fields, e.fields...)
+	fields = append(fields, kv...)
+	return &Entry{logger: e.logger, module: e.module, fields: fields}
+}
+
+func (e *Entry) log(level int, printLevel string, msg string, kv []interface{}) {
+	logger := e.target()
+	if severity(level) < severity(logger.levelFor(e.module)) {
+		return
+	}
+	fields := e.fields
+	if len(kv) > 0 {
+		fields = make([]interface{}, 0, len(e.fields)+len(kv))
+		fields = append(fields, e.fields...)
+		fields = append(fields, kv...)
+	}
+	logger.output(level, printLevel, e.module, msg, fields)
+}
+
+func (e *Entry) Debug(msg string, kv ...interface{}) {
+	e.log(DebugLevel, PrintDebugLevel, msg, kv)
+}
+
+func (e *Entry) Info(msg string, kv ...interface{}) {
+	e.log(InfoLevel, PrintInfoLevel, msg, kv)
+}
+
+func (e *Entry) Warn(msg string, kv ...interface{}) {
+	e.log(WarnLevel, PrintWarnLevel, msg, kv)
+}
+
+func (e *Entry) Error(msg string, kv ...interface{}) {
+	e.log(ErrorLevel, PrintErrorLevel, msg, kv)
+}
+
+func (e *Entry) Fatal(msg string, kv ...interface{}) {
+	e.log(FatalLevel, PrintFatalLevel, msg, kv)
+}
+
+// 使用全局日志创建带字段的日志
+func With(kv ...interface{}) *Entry {
+	return gLogger.With(kv...)
+}
+
+// 设置全局日志的输出格式
+func SetFormat(format string) error {
+	return gLogger.SetFormat(format)
+}
+
+func levelName(level int) string {
+	switch level {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	case FatalLevel:
+		return "fatal"
+	}
+	return "unknown"
+}
+
+// 取出第i对字段，缺少value时用 (MISSING) 代替
+func fieldAt(fields []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(fields[i])
+	if i+1 >= len(fields) {
+		return key, "(MISSING)"
+	}
+	value := fields[i+1]
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case time.Duration:
+		value = v.String()
+	}
+	return key, value
+}
+
+// text格式的字段 key=value，含空格等字符的值加引号
+func formatText(fields []interface{}) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fieldAt(fields, i)
+		s := fmt.Sprint(value)
+		if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+			s = strconv.Quote(s)
+		}
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+// json格式的一行日志
+func formatJSON(level int, module string, msg string, fields []interface{}) string {
+	var b strings.Builder
+	b.WriteString(`{"time":`)
+	writeJSONValue(&b, time.Now().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSONValue(&b, levelName(level))
+	if module != "" {
+		b.WriteString(`,"module":`)
+		writeJSONValue(&b, module)
+	}
+	b.WriteString(`,"msg":`)
+	writeJSONValue(&b, msg)
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fieldAt(fields, i)
+		b.WriteByte(',')
+		writeJSONValue(&b, key)
+		b.WriteByte(':')
+		writeJSONValue(&b, value)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// 不能编码成json的值按字符串输出
+func writeJSONValue(b *strings.Builder, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(data)
+}
@@ -12,6 +12,8 @@ func TestExample(t *testing.T) {
 	log.Debug("My name is %v", name)
 	log.Release("My name is %v", name)
 	log.Error("My name is %v", name)
+	log.With("connID", 1).Info("recv msg", "msgId", 5, "name", name)
+	log.With("connID", 1).With("remote", "127.0.0.1:7777").Warn("slow handler", "cost", time.Second)
 	// log.Fatal("My name is %v", logger)
 
 	//测试文件名空
@@ -31,7 +33,7 @@ func TestExample(t *testing.T) {
 	// log.Release("My name is %v", name)
 
 	//测试文件
-	logger, err := log.New("release", "log", l.LstdFlags)
+	logger, err := log.New("release", t.TempDir(), l.LstdFlags)
 	if err != nil {
 		return
 	}
@@ -3,73 +3,126 @@ package log
 import (
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
-	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+/*
+日志等级，保持原来的数值不变，保存下来的数值等级含义不会改变
+WarnLevel 是后来加入的，取一个不重复的值，高低按 Debug < Info < Warn < Error < Fatal 比较，见 severity
+*/
 const (
 	DebugLevel   = 0
-	ReleaseLevel = 1
+	InfoLevel    = 1
+	ReleaseLevel = InfoLevel // Release 与 Info 同级，保留给旧代码使用
 	ErrorLevel   = 2
 	FatalLevel   = 3
+	WarnLevel    = 4
 )
 
+// 等级的高低，用于比较，WarnLevel 排在 Info 和 Error 之间
+func severity(level int) int {
+	if level == WarnLevel {
+		return 2*InfoLevel + 1
+	}
+	return 2 * level
+}
+
 const (
 	PrintDebugLevel   = "[debug  ] "
+	PrintInfoLevel    = "[info   ] "
 	PrintReleaseLevel = "[release] "
+	PrintWarnLevel    = "[warn   ] "
 	PrintErrorLevel   = "[error  ] "
 	PrintFatalLevel   = "[fatal  ] "
 )
 
+// 输出格式
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// 一条等待写出的日志，json格式不需要 log.Logger 再加时间前缀
+type logMsg struct {
+	line  string
+	flag  int
+	flush chan struct{} //不为空时是Flush请求，之前的日志写完后关闭它
+}
+
+/*
+日志队列配置
+
+日志先进入队列，由单独的goroutine写出，队列满时：
+DropOnFull 为 false 时等待队列有空位，不丢日志；
+DropOnFull 为 true 时丢弃这条日志并计数，不阻塞调用者，丢弃数量通过 Dropped 获取。
+*/
+type QueueConfig struct {
+	Size       int  //队列长度，<=0 时使用默认的1000
+	DropOnFull bool //队列满时丢弃日志而不是阻塞
+}
+
+// 默认队列，队列满时阻塞，与之前的行为一致
+var DefaultQueue = QueueConfig{
+	Size: 1000,
+}
+
+// Fatal 前等待队列写完的最长时间，超时后直接同步写出
+const fatalFlushTimeout = time.Second
+
 type Logger struct {
-	level      int
+	dropped    uint64       //队列满时丢弃的日志数，原子操作，放在开头保证64位对齐
+	level      int32        //日志等级，原子操作，运行时可以修改
+	format     atomic.Value //输出格式 text 或 json
+	flag       int          //text格式下 log.Logger 的属性
 	baseLogger *log.Logger
-	baseFile   *os.File //文件句柄
-	todaydate  string
-	msgQueue   chan string // 所有的日志先到这来
-	closed     bool
+	baseFile   *rotateWriter //日志文件，按大小和时间切换
+	writeLock  sync.Mutex    //写日志的goroutine和同步写出互斥
+	msgQueue   chan logMsg   // 所有的日志先到这来
+	dropOnFull bool
+
+	moduleLock   sync.RWMutex
+	moduleLevels map[string]int //按模块设置的日志等级
+
+	stateLock sync.RWMutex //保护closed，入队时持有读锁，Close时持有写锁
+	closed    bool
+	closing   chan struct{} //通知写日志的goroutine写完队列后退出
+	done      chan struct{} //写日志的goroutine已经退出
 }
 
 // New 创建一个自己的日志对象。
 // pathname:文件夹路径名称
 // strLevel: 打印等级。DEBUG, INFO, ERROR
 // flag定义日志的属性（时间、文件等等）
+// 日志文件按 DefaultRotate 每天切换一次
 func New(strLevel string, pathname string, flag int) (*Logger, error) {
+	return NewWithRotate(strLevel, pathname, flag, DefaultRotate)
+}
+
+// NewWithRotate 创建一个自己的日志对象，日志文件按rotate配置切换和清理
+// pathname为空时不创建日志文件，rotate不生效
+func NewWithRotate(strLevel string, pathname string, flag int, rotate RotateConfig) (*Logger, error) {
+	return NewWithQueue(strLevel, pathname, flag, rotate, DefaultQueue)
+}
+
+// NewWithQueue 创建一个自己的日志对象，日志队列的长度和队列满时的处理按queue配置
+func NewWithQueue(strLevel string, pathname string, flag int, rotate RotateConfig, queue QueueConfig) (*Logger, error) {
 	// level
-	var level int
-	switch strings.ToLower(strLevel) {
-	case "debug":
-		level = DebugLevel
-	case "release":
-		level = ReleaseLevel
-	case "error":
-		level = ErrorLevel
-	case "fatal":
-		level = FatalLevel
-	default:
-		return nil, errors.New("unknown level: " + strLevel)
+	level, err := ParseLevel(strLevel)
+	if err != nil {
+		return nil, err
 	}
 
 	// logger
 	var baseLogger *log.Logger
-	var baseFile *os.File
+	var baseFile *rotateWriter
 
 	if pathname != "" {
-		now := time.Now()
-
-		filename := fmt.Sprintf("%d%02d%02d_%02d_%02d_%02d.log",
-			now.Year(),
-			now.Month(),
-			now.Day(),
-			now.Hour(),
-			now.Minute(),
-			now.Second())
-
-		file, err := os.Create(path.Join(pathname, filename))
+		file, err := newRotateWriter(pathname, rotate)
 		if err != nil {
 			return nil, err
 		}
@@ -77,124 +130,236 @@ func New(strLevel string, pathname string, flag int) (*Logger, error) {
 		baseLogger = log.New(file, "", flag)
 		baseFile = file
 	} else {
+		//文件夹路径名称为空，不创建日志文件，直接终端打印信息
 		baseLogger = log.New(os.Stdout, "", flag)
 	}
 
-	//文件夹路径名称为空，不创建日志文件，直接终端打印信息
+	if queue.Size <= 0 {
+		queue.Size = DefaultQueue.Size
+	}
+
 	logger := new(Logger)
-	logger.level = level
+	logger.level = int32(level)
+	logger.format.Store(FormatText)
+	logger.flag = flag
 	logger.baseLogger = baseLogger
 	logger.baseFile = baseFile
-	logger.todaydate = time.Now().Format("2006-01-02")
-	logger.msgQueue = make(chan string, 1000)
-	logger.closed = false
+	logger.msgQueue = make(chan logMsg, queue.Size)
+	logger.dropOnFull = queue.DropOnFull
+	logger.closing = make(chan struct{})
+	logger.done = make(chan struct{})
 
-	// 启动日志切换
-	go logger.logworker(pathname)
+	// 启动写日志
+	go logger.logworker()
 
 	return logger, nil
 }
 
-func (logger *Logger) logworker(pathname string) {
-	for !logger.closed {
-		msg := <-logger.msgQueue
-		logger.baseLogger.Output(3, msg)
-
-		//跨日改时间，后台启动
-		nowDate := time.Now().Format("2006-01-02")
-		if nowDate != logger.todaydate {
-			// logger.Debug("doRotate run %v %v", nowDate, logger.todaydate)
-			logger.doRotate(pathname)
+// 写日志的goroutine，文件切换由 rotateWriter 在写入时完成
+func (logger *Logger) logworker() {
+	defer close(logger.done)
+	for {
+		select {
+		case msg := <-logger.msgQueue:
+			logger.handle(msg)
+		case <-logger.closing:
+			// Close之后不会再有日志进入队列，写完剩下的就退出
+			for {
+				select {
+				case msg := <-logger.msgQueue:
+					logger.handle(msg)
+				default:
+					return
+				}
+			}
 		}
 	}
 }
 
-// 日志按天切换文件
-func (logger *Logger) doRotate(pathname string) {
-	// 首先关闭文件句柄，把当前日志改名为昨天，再创建新的文件句柄，将这个文件句柄赋值给log对象
-	defer func() {
-		rec := recover()
-		if rec != nil {
-			fmt.Printf("doRotate %v", rec)
-		}
-	}()
-
-	if logger.baseFile == nil {
+func (logger *Logger) handle(msg logMsg) {
+	if msg.flush != nil {
+		close(msg.flush)
 		return
 	}
+	logger.write(msg)
+}
 
-	prefile := logger.baseFile
+// 写出一条日志，写失败（比如文件已关闭）时改写到标准错误
+func (logger *Logger) write(msg logMsg) {
+	logger.writeLock.Lock()
+	defer logger.writeLock.Unlock()
+	logger.baseLogger.SetFlags(msg.flag)
+	if err := logger.baseLogger.Output(3, msg.line); err != nil {
+		fmt.Fprintln(os.Stderr, msg.line)
+	}
+}
 
-	_, err := prefile.Stat()
-	if err == nil {
-		err := prefile.Close()
-		if err != nil {
-			fmt.Printf("doRotate rename err %v", err)
-			return
-		}
+// 放入队列，已经关闭时返回false
+// block为true时队列满也等待，Flush请求不能丢
+func (logger *Logger) enqueue(msg logMsg, block bool) bool {
+	logger.stateLock.RLock()
+	defer logger.stateLock.RUnlock()
+	if logger.closed {
+		return false
+	}
+	if block || !logger.dropOnFull {
+		logger.msgQueue <- msg
+		return true
+	}
+	select {
+	case logger.msgQueue <- msg:
+	default:
+		atomic.AddUint64(&logger.dropped, 1)
 	}
+	return true
+}
 
-	if pathname != "" {
-		now := time.Now()
-		filename := fmt.Sprintf("%d%02d%02d_%02d_%02d_%02d.log",
-			now.Year(),
-			now.Month(),
-			now.Day(),
-			now.Hour(),
-			now.Minute(),
-			now.Second())
-		nextfile, err := os.Create(path.Join(pathname, filename))
-		if err != nil {
-			return
-		}
-		logger.baseFile = nextfile
+// 队列满时丢弃的日志数
+func (logger *Logger) Dropped() uint64 {
+	return atomic.LoadUint64(&logger.dropped)
+}
+
+// 等待调用之前进入队列的日志全部写出
+func (logger *Logger) Flush() {
+	logger.flush(0)
+}
 
-		fmt.Println("newLogger use MultiWriter")
-		multi := io.MultiWriter(nextfile, os.Stdout)
-		logger.baseLogger.SetOutput(multi)
+// timeout<=0 时一直等待，超时返回false
+func (logger *Logger) flush(timeout time.Duration) bool {
+	ack := make(chan struct{})
+	if !logger.enqueue(logMsg{flush: ack}, true) {
+		// 已经关闭，队列早已写完
+		return true
 	}
+	if timeout <= 0 {
+		<-ack
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ack:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
 
-	// 更新标记，这个标记决定是否会启动文件切换
-	nowDate := time.Now().Format("2006-01-02")
-	logger.todaydate = nowDate
+// 解析日志等级 debug info release warn error fatal
+func ParseLevel(strLevel string) (int, error) {
+	switch strings.ToLower(strLevel) {
+	case "debug":
+		return DebugLevel, nil
+	case "info", "release":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	case "fatal":
+		return FatalLevel, nil
+	}
+	return 0, errors.New("unknown level: " + strLevel)
 }
 
-// It's dangerous to call the method on logging
+// 设置输出格式 text 或 json，json格式每行一个对象，时间由日志自己输出
+func (logger *Logger) SetFormat(format string) error {
+	switch format {
+	case FormatText, FormatJSON:
+	default:
+		return errors.New("unknown format: " + format)
+	}
+	logger.format.Store(format)
+	return nil
+}
+
+// 设置日志等级，运行时可以修改，不影响单独设置了等级的模块
+func (logger *Logger) SetLevel(strLevel string) error {
+	level, err := ParseLevel(strLevel)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&logger.level, int32(level))
+	return nil
+}
+
+// 当前的日志等级
+func (logger *Logger) Level() string {
+	return levelName(int(atomic.LoadInt32(&logger.level)))
+}
+
+// 关闭日志：不再接收新的日志，写完队列中剩下的日志后关闭文件
+// 关闭之后的日志直接同步写出，文件日志改写到标准错误
+// 可以重复调用
 func (logger *Logger) Close() {
+	logger.stateLock.Lock()
+	if logger.closed {
+		logger.stateLock.Unlock()
+		return
+	}
+	logger.closed = true
+	logger.stateLock.Unlock()
+
+	close(logger.closing)
+	<-logger.done
+
 	if logger.baseFile != nil {
 		logger.baseFile.Close() //关闭文件
 	}
-
-	logger.baseLogger = nil
-	logger.baseFile = nil
-	logger.closed = true
 }
 
 func (logger *Logger) doPrintf(level int, printLevel string, format string, a ...interface{}) {
-	if level < logger.level {
+	if severity(level) < severity(logger.levelFor("")) {
 		return
 	}
-	if logger.baseLogger == nil {
-		panic("logger closed")
-	}
 
-	format = printLevel + format
-	logger.msgQueue <- fmt.Sprintf(format, a...)
-	// logger.baseLogger.Output(3, fmt.Sprintf(format, a...))
+	logger.output(level, printLevel, "", fmt.Sprintf(format, a...), nil)
+}
+
+// 输出一条日志，module为空表示不属于任何模块，fields为 key, value, key, value...
+func (logger *Logger) output(level int, printLevel string, module string, msg string, fields []interface{}) {
+	var m logMsg
+	if logger.format.Load() == FormatJSON {
+		m = logMsg{line: formatJSON(level, module, msg, fields), flag: 0}
+	} else {
+		if module != "" {
+			msg = "[" + module + "] " + msg
+		}
+		m = logMsg{line: printLevel + msg + formatText(fields), flag: logger.flag}
+	}
 
 	if level == FatalLevel {
+		// 先写完队列中已有的日志，再同步写出崩溃原因，保证退出前一定写出
+		logger.flush(fatalFlushTimeout)
+		logger.write(m)
 		os.Exit(1)
 	}
+
+	if !logger.enqueue(m, false) {
+		logger.write(m)
+	}
 }
 
+/*
+日志的输出方法是printf风格，如 logger.Info("recv msg %d", 5)
+结构化的日志使用 With 或 Module 返回的 Entry，如 logger.With("connID", 1).Info("recv msg", "msgId", 5)
+*/
 func (logger *Logger) Debug(format string, a ...interface{}) {
 	logger.doPrintf(DebugLevel, PrintDebugLevel, format, a...)
 }
 
+func (logger *Logger) Info(format string, a ...interface{}) {
+	logger.doPrintf(InfoLevel, PrintInfoLevel, format, a...)
+}
+
 func (logger *Logger) Release(format string, a ...interface{}) {
 	logger.doPrintf(ReleaseLevel, PrintReleaseLevel, format, a...)
 }
 
+func (logger *Logger) Warn(format string, a ...interface{}) {
+	logger.doPrintf(WarnLevel, PrintWarnLevel, format, a...)
+}
+
 func (logger *Logger) Error(format string, a ...interface{}) {
 	logger.doPrintf(ErrorLevel, PrintErrorLevel, format, a...)
 }
@@ -212,14 +377,23 @@ func Export(logger *Logger) {
 	}
 }
 
+// 全局日志的输出方法，printf风格，结构化的日志使用 log.With 或 log.Module
 func Debug(format string, a ...interface{}) {
 	gLogger.doPrintf(DebugLevel, PrintDebugLevel, format, a...)
 }
 
+func Info(format string, a ...interface{}) {
+	gLogger.doPrintf(InfoLevel, PrintInfoLevel, format, a...)
+}
+
 func Release(format string, a ...interface{}) {
 	gLogger.doPrintf(ReleaseLevel, PrintReleaseLevel, format, a...)
 }
 
+func Warn(format string, a ...interface{}) {
+	gLogger.doPrintf(WarnLevel, PrintWarnLevel, format, a...)
+}
+
 func Error(format string, a ...interface{}) {
 	gLogger.doPrintf(ErrorLevel, PrintErrorLevel, format, a...)
 }
@@ -228,6 +402,16 @@ func Fatal(format string, a ...interface{}) {
 	gLogger.doPrintf(FatalLevel, PrintFatalLevel, format, a...)
 }
 
+// 等待全局日志队列中的日志全部写出
+func Flush() {
+	gLogger.Flush()
+}
+
+// 全局日志队列满时丢弃的日志数
+func Dropped() uint64 {
+	return gLogger.Dropped()
+}
+
 func Close() {
 	gLogger.Close()
 }
@@ -0,0 +1,145 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readLines(t *testing.T, name string) []string {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestCloseDrainsQueue(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := NewWithQueue("debug", dir, 0, RotateConfig{FileName: "app.log"}, QueueConfig{Size: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		logger.Info("line %d", i)
+	}
+	logger.Close()
+	logger.Close()
+
+	if lines := readLines(t, filepath.Join(dir, "app.log")); len(lines) != 500 {
+		t.Fatalf("lines = %d, want 500", len(lines))
+	}
+}
+
+func TestDropOnFull(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := NewWithQueue("debug", dir, 0, RotateConfig{FileName: "app.log"}, QueueConfig{Size: 1, DropOnFull: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 卡住写日志的goroutine，队列很快就会满
+	logger.writeLock.Lock()
+	for i := 0; i < 10; i++ {
+		logger.Info("line %d", i)
+	}
+	dropped := logger.Dropped()
+	logger.writeLock.Unlock()
+	logger.Flush()
+
+	if dropped < 8 {
+		t.Fatalf("dropped = %d, want at least 8", dropped)
+	}
+	logger.Close()
+	if lines := readLines(t, filepath.Join(dir, "app.log")); uint64(len(lines))+dropped != 10 {
+		t.Fatalf("lines = %d, dropped = %d, want 10 in total", len(lines), dropped)
+	}
+}
+
+func TestModuleLevels(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := NewWithRotate("warn", dir, 0, RotateConfig{FileName: "app.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.SetModuleLevel("game", "debug"); err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.SetModuleLevel("game.match", "error"); err != nil {
+		t.Fatal(err)
+	}
+	logger.Module("network").Info("network hidden")
+	logger.Module("game.room").Debug("room shown")
+	logger.Module("game.match").Warn("match hidden")
+	logger.Module("game.match.queue").Error("queue shown")
+	logger.SetModuleLevel("game.match", "")
+	logger.Module("game.match").Debug("match shown")
+	logger.Info("global hidden")
+	logger.Close()
+
+	lines := readLines(t, filepath.Join(dir, "app.log"))
+	want := []string{"[game.room] room shown", "[game.match.queue] queue shown", "[game.match] match shown"}
+	if len(lines) != len(want) {
+		t.Fatalf("lines = %q, want %d lines", lines, len(want))
+	}
+	for i, w := range want {
+		if !strings.Contains(lines[i], w) {
+			t.Fatalf("line %d = %q, want %q", i, lines[i], w)
+		}
+	}
+}
+
+// 原来的等级数值不变，Warn 排在 Info 和 Error 之间
+func TestLevels(t *testing.T) {
+	if DebugLevel != 0 || ReleaseLevel != 1 || ErrorLevel != 2 || FatalLevel != 3 {
+		t.Fatal("level values changed")
+	}
+	tests := []struct {
+		level string
+		want  []string
+	}{
+		{"info", []string{"[info   ] info", "[warn   ] warn", "[error  ] error"}},
+		{"warn", []string{"[warn   ] warn", "[error  ] error"}},
+		{"error", []string{"[error  ] error"}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		logger, err := NewWithRotate(tt.level, dir, 0, RotateConfig{FileName: "app.log"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger.Debug("debug")
+		logger.Info("info")
+		logger.Warn("warn")
+		logger.Error("error")
+		logger.Close()
+		lines := readLines(t, filepath.Join(dir, "app.log"))
+		if strings.Join(lines, "\n") != strings.Join(tt.want, "\n") {
+			t.Fatalf("level %s: lines = %q, want %q", tt.level, lines, tt.want)
+		}
+	}
+}
+
+// Logger 的方法保持printf风格，结构化的日志使用 With 或 Module 返回的 Entry
+func TestConvention(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := NewWithRotate("debug", dir, 0, RotateConfig{FileName: "app.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("My name is %v", "BonBon")
+	logger.Info("recv msg %d", 5)
+	logger.With("connID", 1).Info("recv msg", "msgId", 5)
+	logger.Module("game").Warn("slow handler", "cost", 2)
+	logger.Close()
+	want := []string{
+		"[debug  ] My name is BonBon",
+		"[info   ] recv msg 5",
+		"[info   ] recv msg connID=1 msgId=5",
+		"[warn   ] [game] slow handler cost=2",
+	}
+	lines := readLines(t, filepath.Join(dir, "app.log"))
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("lines = %q, want %q", lines, want)
+	}
+}
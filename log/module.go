@@ -0,0 +1,132 @@
+package log
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+按模块设置日志等级
+
+	var netLog = log.Module("network")
+	netLog.With("connID", id).Debug("recv msg")
+
+	log.SetModuleLevel("network", "info")    //只看network的info以上
+	log.SetModuleLevel("game.match", "debug") //单独打开game.match的debug
+	log.SetModuleLevel("network", "")        //取消设置，恢复使用上一级的等级
+
+模块名用.分层，game.match 没有单独设置时使用 game 的等级，都没有设置时使用日志自己的等级。
+等级可以在运行时随时修改，立即生效。
+*/
+
+// 创建属于模块name的日志
+func (logger *Logger) Module(name string) *Entry {
+	return &Entry{logger: logger, module: name}
+}
+
+// 模块实际使用的日志等级，module为空时返回日志自己的等级
+func (logger *Logger) levelFor(module string) int {
+	if module != "" {
+		logger.moduleLock.RLock()
+		if len(logger.moduleLevels) > 0 {
+			for name := module; ; {
+				if level, ok := logger.moduleLevels[name]; ok {
+					logger.moduleLock.RUnlock()
+					return level
+				}
+				i := strings.LastIndexByte(name, '.')
+				if i < 0 {
+					break
+				}
+				name = name[:i]
+			}
+		}
+		logger.moduleLock.RUnlock()
+	}
+	return int(atomic.LoadInt32(&logger.level))
+}
+
+// 设置模块的日志等级，strLevel为空时取消设置
+func (logger *Logger) SetModuleLevel(module string, strLevel string) error {
+	if module == "" {
+		return errors.New("empty module name")
+	}
+	if strLevel == "" {
+		logger.moduleLock.Lock()
+		delete(logger.moduleLevels, module)
+		logger.moduleLock.Unlock()
+		return nil
+	}
+	level, err := ParseLevel(strLevel)
+	if err != nil {
+		return err
+	}
+	logger.moduleLock.Lock()
+	if logger.moduleLevels == nil {
+		logger.moduleLevels = make(map[string]int)
+	}
+	logger.moduleLevels[module] = level
+	logger.moduleLock.Unlock()
+	return nil
+}
+
+// 用levels替换全部模块的日志等级，有错误时不做任何修改，用于从配置文件加载
+func (logger *Logger) SetModuleLevels(levels map[string]string) error {
+	moduleLevels := make(map[string]int, len(levels))
+	for module, strLevel := range levels {
+		if module == "" {
+			return errors.New("empty module name")
+		}
+		level, err := ParseLevel(strLevel)
+		if err != nil {
+			return errors.New(module + ": " + err.Error())
+		}
+		moduleLevels[module] = level
+	}
+	logger.moduleLock.Lock()
+	logger.moduleLevels = moduleLevels
+	logger.moduleLock.Unlock()
+	return nil
+}
+
+// 单独设置了等级的模块
+func (logger *Logger) ModuleLevels() map[string]string {
+	logger.moduleLock.RLock()
+	defer logger.moduleLock.RUnlock()
+	levels := make(map[string]string, len(logger.moduleLevels))
+	for module, level := range logger.moduleLevels {
+		levels[module] = levelName(level)
+	}
+	return levels
+}
+
+// 创建属于模块name的全局日志，Export之后使用新的全局日志，可以在包初始化时创建
+func Module(name string) *Entry {
+	return &Entry{module: name}
+}
+
+// 设置全局日志的等级
+func SetLevel(strLevel string) error {
+	return gLogger.SetLevel(strLevel)
+}
+
+// 全局日志的等级
+func Level() string {
+	return gLogger.Level()
+}
+
+// 设置全局日志中模块的等级，strLevel为空时取消设置
+func SetModuleLevel(module string, strLevel string) error {
+	return gLogger.SetModuleLevel(module, strLevel)
+}
+
+// 替换全局日志中全部模块的等级
+func SetModuleLevels(levels map[string]string) error {
+	return gLogger.SetModuleLevels(levels)
+}
+
+// 全局日志中单独设置了等级的模块
+func ModuleLevels() map[string]string {
+	return gLogger.ModuleLevels()
+}
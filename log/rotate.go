@@ -0,0 +1,304 @@
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+日志文件切换配置
+
+当前日志始终写在 pathname/FileName，切换时改名为 name-20060102_150405.000.log，
+然后按需压缩成 .gz，并按 MaxFiles、MaxAge 清理旧文件。
+*/
+type RotateConfig struct {
+	FileName string        //当前日志文件名，固定不变，默认 gobonbon.log
+	MaxSize  int64         //单个文件的最大字节数，超过后切换，0表示不按大小切换
+	Interval time.Duration //按时间切换的间隔，24h的整数倍时按本地零点对齐，0表示不按时间切换
+	MaxFiles int           //最多保留的旧文件个数，0表示不限制
+	MaxAge   time.Duration //旧文件最长保留时间，0表示不限制
+	Compress bool          //切换后用gzip压缩旧文件
+}
+
+// 默认按天切换，不限制大小和保留个数，与之前的行为一致
+var DefaultRotate = RotateConfig{
+	FileName: "gobonbon.log",
+	Interval: 24 * time.Hour,
+}
+
+// 切换后文件名中的时间格式
+const rotateTimeFormat = "20060102_150405.000"
+
+/*
+按大小和时间切换的日志文件，实现io.Writer，可以被多个goroutine同时使用
+切换只是改名并打开新文件，压缩和清理在后台goroutine中进行，不阻塞写日志
+*/
+type rotateWriter struct {
+	lock       sync.Mutex
+	dir        string
+	cfg        RotateConfig
+	file       *os.File
+	size       int64
+	nextRotate time.Time //下一次按时间切换的时间，零值表示不按时间切换
+
+	millCh   chan struct{} //通知后台压缩和清理
+	millDone chan struct{}
+}
+
+func newRotateWriter(dir string, cfg RotateConfig) (*rotateWriter, error) {
+	if cfg.FileName == "" {
+		cfg.FileName = DefaultRotate.FileName
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &rotateWriter{
+		dir:      dir,
+		cfg:      cfg,
+		millCh:   make(chan struct{}, 1),
+		millDone: make(chan struct{}),
+	}
+	if err := w.openExisting(); err != nil {
+		return nil, err
+	}
+	go w.millRun()
+	w.mill()
+	return w, nil
+}
+
+// 当前日志文件的完整路径
+func (w *rotateWriter) filename() string {
+	return filepath.Join(w.dir, w.cfg.FileName)
+}
+
+// 文件名去掉扩展名的部分和扩展名
+func (w *rotateWriter) prefixAndExt() (string, string) {
+	ext := filepath.Ext(w.cfg.FileName)
+	return strings.TrimSuffix(w.cfg.FileName, ext) + "-", ext
+}
+
+// 下一次按时间切换的时间
+func nextBoundary(now time.Time, interval time.Duration) time.Time {
+	if interval <= 0 {
+		return time.Time{}
+	}
+	day := 24 * time.Hour
+	if interval%day == 0 {
+		y, m, d := now.Date()
+		midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+		return midnight.AddDate(0, 0, int(interval/day))
+	}
+	return now.Truncate(interval).Add(interval)
+}
+
+// 打开当前日志文件，继续追加
+func (w *rotateWriter) openExisting() error {
+	file, err := os.OpenFile(w.filename(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	// 上次运行留下的文件按它的修改时间决定下一次切换
+	w.nextRotate = nextBoundary(info.ModTime(), w.cfg.Interval)
+	return nil
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	now := time.Now()
+	timeUp := !w.nextRotate.IsZero() && !now.Before(w.nextRotate)
+	sizeUp := w.cfg.MaxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.cfg.MaxSize
+	if timeUp || sizeUp {
+		if err := w.rotate(now); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotate err %v\n", err)
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// 关闭当前文件，改名，再打开新的文件，调用者需持有锁
+func (w *rotateWriter) rotate(now time.Time) error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	prefix, ext := w.prefixAndExt()
+	rotated := filepath.Join(w.dir, prefix+now.Format(rotateTimeFormat)+ext)
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = filepath.Join(w.dir, fmt.Sprintf("%s%s-%d%s", prefix, now.Format(rotateTimeFormat), i, ext))
+	}
+	renameErr := os.Rename(w.filename(), rotated)
+
+	file, err := os.OpenFile(w.filename(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.size = 0
+	if renameErr == nil {
+		// 改名失败时新文件就是原来的文件，大小不归零
+		w.nextRotate = nextBoundary(now, w.cfg.Interval)
+	} else if info, err := file.Stat(); err == nil {
+		w.size = info.Size()
+	}
+	w.mill()
+	return renameErr
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// 通知后台压缩和清理，不阻塞
+func (w *rotateWriter) mill() {
+	select {
+	case w.millCh <- struct{}{}:
+	default:
+	}
+}
+
+func (w *rotateWriter) millRun() {
+	defer close(w.millDone)
+	for range w.millCh {
+		if err := w.millRunOnce(); err != nil {
+			fmt.Fprintf(os.Stderr, "log mill err %v\n", err)
+		}
+	}
+}
+
+// 切换后的旧文件
+type oldLogFile struct {
+	name string
+	t    time.Time
+}
+
+// 按时间从新到旧列出全部旧文件
+func (w *rotateWriter) oldFiles() ([]oldLogFile, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix, ext := w.prefixAndExt()
+	var files []oldLogFile
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ext), prefix)
+		if len(stamp) < len(rotateTimeFormat) {
+			continue
+		}
+		t, err := time.ParseInLocation(rotateTimeFormat, stamp[:len(rotateTimeFormat)], time.Local)
+		if err != nil {
+			continue
+		}
+		files = append(files, oldLogFile{name: name, t: t})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].t.Equal(files[j].t) {
+			return files[i].name > files[j].name
+		}
+		return files[i].t.After(files[j].t)
+	})
+	return files, nil
+}
+
+// 清理超出个数和时间的旧文件，再压缩剩下未压缩的
+func (w *rotateWriter) millRunOnce() error {
+	files, err := w.oldFiles()
+	if err != nil {
+		return err
+	}
+	var cutoff time.Time
+	if w.cfg.MaxAge > 0 {
+		cutoff = time.Now().Add(-w.cfg.MaxAge)
+	}
+	var errs []string
+	for i, f := range files {
+		path := filepath.Join(w.dir, f.name)
+		if (w.cfg.MaxFiles > 0 && i >= w.cfg.MaxFiles) || (!cutoff.IsZero() && f.t.Before(cutoff)) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err.Error())
+			}
+			continue
+		}
+		if w.cfg.Compress && !strings.HasSuffix(f.name, ".gz") {
+			if err := compressFile(path); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// 压缩成 name.gz 并删除原文件
+func compressFile(name string) (err error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(name + ".gz")
+		}
+	}()
+
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	src.Close()
+	return os.Remove(name)
+}
+
+// 关闭当前文件，等待后台压缩和清理结束
+func (w *rotateWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	close(w.millCh)
+	<-w.millDone
+	return err
+}
@@ -0,0 +1,64 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotateBySize(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newRotateWriter(dir, RotateConfig{FileName: "app.log", MaxSize: 100, MaxFiles: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for i := 0; i < 8; i++ {
+		if _, err := w.Write(line); err != nil {
+			t.Fatal(err)
+		}
+		// 保证切换后的文件名时间不同
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "app.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(line)) {
+		t.Fatalf("current file size = %d, want %d", info.Size(), len(line))
+	}
+
+	// 8行每个文件1行，切换了7次，只保留2个压缩后的旧文件
+	w2 := &rotateWriter{dir: dir, cfg: RotateConfig{FileName: "app.log"}}
+	old, err := w2.oldFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old) != 2 {
+		t.Fatalf("old files = %v, want 2", old)
+	}
+	for _, f := range old {
+		if !strings.HasSuffix(f.name, ".gz") {
+			t.Fatalf("old file %s not compressed", f.name)
+		}
+	}
+}
+
+func TestNextBoundary(t *testing.T) {
+	now := time.Date(2024, 5, 6, 13, 20, 0, 0, time.Local)
+	if got, want := nextBoundary(now, 24*time.Hour), time.Date(2024, 5, 7, 0, 0, 0, 0, time.Local); !got.Equal(want) {
+		t.Fatalf("daily boundary = %v, want %v", got, want)
+	}
+	if got := nextBoundary(now, time.Hour); got.Sub(now) > time.Hour || !got.After(now) {
+		t.Fatalf("hourly boundary = %v", got)
+	}
+	if got := nextBoundary(now, 0); !got.IsZero() {
+		t.Fatalf("no interval boundary = %v", got)
+	}
+}
@@ -0,0 +1,42 @@
+package metrics
+
+import "strconv"
+
+// gobonbon框架自带的指标，注册在默认注册表中
+var (
+	ConnActive   = NewGauge("gobonbon_connections_active", "Number of connections currently open.")
+	ConnAccepted = NewCounter("gobonbon_connections_accepted_total", "Connections admitted by the listeners.")
+	ConnRejected = NewCounterVec("gobonbon_connections_rejected_total", "Connections rejected by admission control.", "reason")
+
+	MsgsIn   = NewCounterVec("gobonbon_messages_received_total", "Messages received from connections.", "msgid")
+	MsgsOut  = NewCounterVec("gobonbon_messages_sent_total", "Messages queued for sending to connections.", "msgid")
+	BytesIn  = NewCounterVec("gobonbon_bytes_received_total", "Bytes received from connections, including headers.", "msgid")
+	BytesOut = NewCounterVec("gobonbon_bytes_sent_total", "Bytes queued for sending to connections, including headers.", "msgid")
+
+	HandlerLatency = NewHistogramVec("gobonbon_handler_duration_seconds", "Time spent running the router for a message.", DefBuckets, "msgid")
+	WorkerQueueLen = NewGaugeVec("gobonbon_worker_queue_depth", "Requests waiting in each worker task queue.", "worker")
+
+	WriteDrops    = NewCounter("gobonbon_write_drops_total", "Messages dropped because the connection was closed.")
+	WriteTimeouts = NewCounter("gobonbon_write_timeouts_total", "Messages dropped because the write channel stayed full.")
+
+	AuthResults = NewCounterVec("gobonbon_auth_total", "Authentication attempts and unauthenticated messages by result: ok, failed, timeout, dropped.", "result")
+)
+
+// msgId转换成标签值
+func MsgLabel(msgId uint32) string {
+	return strconv.FormatUint(uint64(msgId), 10)
+}
+
+// 记录收到一条消息，n为包含包头的字节数
+func ObserveIn(msgId uint32, n int) {
+	label := MsgLabel(msgId)
+	MsgsIn.WithLabelValues(label).Inc()
+	BytesIn.WithLabelValues(label).Add(float64(n))
+}
+
+// 记录发出一条消息，n为包含包头的字节数
+func ObserveOut(msgId uint32, n int) {
+	label := MsgLabel(msgId)
+	MsgsOut.WithLabelValues(label).Inc()
+	BytesOut.WithLabelValues(label).Add(float64(n))
+}
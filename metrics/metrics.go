@@ -0,0 +1,222 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 每个Vec最多保留的标签组合数，超出的都计入 overflowLabel，防止客户端乱发msgId撑爆内存
+const (
+	maxSeries     = 1000
+	overflowLabel = "overflow"
+)
+
+// 默认的延迟分桶（秒）
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// 原子操作的float64
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) Add(v float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		n := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&f.bits, old, n) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) Set(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *atomicFloat) Load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+// 只增不减的计数器
+type Counter struct {
+	v atomicFloat
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// 增加n，n不能为负数
+func (c *Counter) Add(n float64) {
+	if n < 0 {
+		return
+	}
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() float64 {
+	return c.v.Load()
+}
+
+// 可增可减的仪表
+type Gauge struct {
+	v atomicFloat
+}
+
+func (g *Gauge) Set(v float64) {
+	g.v.Set(v)
+}
+
+func (g *Gauge) Inc() {
+	g.v.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.Add(-1)
+}
+
+func (g *Gauge) Add(v float64) {
+	g.v.Add(v)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.v.Load()
+}
+
+// 直方图，upperBounds从小到大排列
+type Histogram struct {
+	upperBounds []float64
+	counts      []uint64 //每个桶的计数，不累加
+	count       uint64
+	sum         atomicFloat
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	bounds := make([]float64, len(buckets))
+	copy(bounds, buckets)
+	sort.Float64s(bounds)
+	return &Histogram{
+		upperBounds: bounds,
+		counts:      make([]uint64, len(bounds)),
+	}
+}
+
+// 记录一个观测值
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	h.sum.Add(v)
+}
+
+// 获取累加后的各个桶计数、总数和总和
+func (h *Histogram) snapshot() ([]uint64, uint64, float64) {
+	cumulative := make([]uint64, len(h.counts))
+	var total uint64
+	for i := range h.counts {
+		total += atomic.LoadUint64(&h.counts[i])
+		cumulative[i] = total
+	}
+	return cumulative, atomic.LoadUint64(&h.count), h.sum.Load()
+}
+
+// 按标签值分组的指标集合
+type vec struct {
+	labelNames []string
+	lock       sync.RWMutex
+	series     map[string]interface{}
+	values     map[string][]string
+	newMetric  func() interface{}
+}
+
+func newVec(labelNames []string, newMetric func() interface{}) *vec {
+	return &vec{
+		labelNames: labelNames,
+		series:     make(map[string]interface{}),
+		values:     make(map[string][]string),
+		newMetric:  newMetric,
+	}
+}
+
+func (v *vec) get(labelValues []string) interface{} {
+	if len(labelValues) != len(v.labelNames) {
+		panic("metrics: wrong number of label values")
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.lock.RLock()
+	m, ok := v.series[key]
+	v.lock.RUnlock()
+	if ok {
+		return m
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if m, ok := v.series[key]; ok {
+		return m
+	}
+	if len(v.series) >= maxSeries {
+		values := make([]string, len(labelValues))
+		for i := range values {
+			values[i] = overflowLabel
+		}
+		key = strings.Join(values, "\xff")
+		labelValues = values
+		if m, ok := v.series[key]; ok {
+			return m
+		}
+	}
+	m = v.newMetric()
+	v.series[key] = m
+	v.values[key] = append([]string(nil), labelValues...)
+	return m
+}
+
+// 按key排序遍历
+func (v *vec) each(fn func(labelValues []string, m interface{})) {
+	v.lock.RLock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	v.lock.RUnlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		v.lock.RLock()
+		m, values := v.series[k], v.values[k]
+		v.lock.RUnlock()
+		fn(values, m)
+	}
+}
+
+// 带标签的计数器
+type CounterVec struct {
+	*vec
+}
+
+func (v *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	return v.get(labelValues).(*Counter)
+}
+
+// 带标签的仪表
+type GaugeVec struct {
+	*vec
+}
+
+func (v *GaugeVec) WithLabelValues(labelValues ...string) *Gauge {
+	return v.get(labelValues).(*Gauge)
+}
+
+// 带标签的直方图
+type HistogramVec struct {
+	*vec
+}
+
+func (v *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	return v.get(labelValues).(*Histogram)
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A counter.")
+	g := r.NewGaugeVec("test_depth", "A gauge.", "worker")
+	h := r.NewHistogramVec("test_seconds", "A histogram.", []float64{0.1, 1}, "msgid")
+	r.NewGaugeFunc("test_func", "A func.", func() float64 { return 7 })
+
+	c.Add(3)
+	g.WithLabelValues("0").Set(2)
+	h.WithLabelValues("5").Observe(0.05)
+	h.WithLabelValues("5").Observe(0.5)
+	h.WithLabelValues("5").Observe(5)
+
+	var buf bytes.Buffer
+	if err := r.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"# TYPE test_total counter\ntest_total 3\n",
+		`test_depth{worker="0"} 2`,
+		`test_seconds_bucket{msgid="5",le="0.1"} 1`,
+		`test_seconds_bucket{msgid="5",le="1"} 2`,
+		`test_seconds_bucket{msgid="5",le="+Inf"} 3`,
+		`test_seconds_sum{msgid="5"} 5.55`,
+		`test_seconds_count{msgid="5"} 3`,
+		"test_func 7\n",
+	}
+	out := buf.String()
+	for _, w := range want {
+		if !strings.Contains(out, w) {
+			t.Errorf("missing %q in:\n%s", w, out)
+		}
+	}
+}
+
+func TestVecOverflow(t *testing.T) {
+	r := NewRegistry()
+	v := r.NewCounterVec("test_msgs_total", "Messages.", "msgid")
+	for i := 0; i < maxSeries+10; i++ {
+		v.WithLabelValues(strconv.Itoa(i)).Inc()
+	}
+	if got := v.WithLabelValues(overflowLabel).Value(); got != 10 {
+		t.Fatalf("overflow series = %v, want 10", got)
+	}
+}
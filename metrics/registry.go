@@ -0,0 +1,215 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 一个注册的指标
+type desc struct {
+	name       string
+	help       string
+	typ        string // counter gauge histogram
+	labelNames []string
+	metric     interface{}
+}
+
+/*
+指标注册表，按Prometheus文本格式输出
+*/
+type Registry struct {
+	lock  sync.RWMutex
+	descs map[string]*desc
+}
+
+func NewRegistry() *Registry {
+	return &Registry{descs: make(map[string]*desc)}
+}
+
+// 默认注册表，框架自带的指标都注册在这里
+var Default = NewRegistry()
+
+func (r *Registry) register(d *desc) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.descs[d.name]; ok {
+		panic("metrics: duplicate metric " + d.name)
+	}
+	r.descs[d.name] = d
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(&desc{name: name, help: help, typ: "counter", metric: c})
+	return c
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.register(&desc{name: name, help: help, typ: "gauge", metric: g})
+	return g
+}
+
+// 输出时才调用fn取值的仪表
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&desc{name: name, help: help, typ: "gauge", metric: fn})
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.register(&desc{name: name, help: help, typ: "histogram", metric: h})
+	return h
+}
+
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	v := &CounterVec{newVec(labelNames, func() interface{} { return &Counter{} })}
+	r.register(&desc{name: name, help: help, typ: "counter", labelNames: labelNames, metric: v})
+	return v
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	v := &GaugeVec{newVec(labelNames, func() interface{} { return &Gauge{} })}
+	r.register(&desc{name: name, help: help, typ: "gauge", labelNames: labelNames, metric: v})
+	return v
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	v := &HistogramVec{newVec(labelNames, func() interface{} { return newHistogram(buckets) })}
+	r.register(&desc{name: name, help: help, typ: "histogram", labelNames: labelNames, metric: v})
+	return v
+}
+
+// 在默认注册表中创建指标
+func NewCounter(name, help string) *Counter {
+	return Default.NewCounter(name, help)
+}
+
+func NewGauge(name, help string) *Gauge {
+	return Default.NewGauge(name, help)
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) {
+	Default.NewGaugeFunc(name, help, fn)
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return Default.NewHistogram(name, help, buckets)
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labelNames...)
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labelNames...)
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labelNames...)
+}
+
+// 标签值转义
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// 帮助信息转义
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// 拼接标签 {a="1",b="2"}，extra是额外追加的标签对
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, extra[i], labelEscaper.Replace(extra[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func writeHistogram(w io.Writer, name string, names, values []string, h *Histogram) {
+	cumulative, count, sum := h.snapshot()
+	for i, bound := range h.upperBounds {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(names, values, "le", formatFloat(bound)), cumulative[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(names, values, "le", "+Inf"), count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(names, values), formatFloat(sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(names, values), count)
+}
+
+func (d *desc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, helpEscaper.Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+	switch m := d.metric.(type) {
+	case *Counter:
+		fmt.Fprintf(w, "%s %s\n", d.name, formatFloat(m.Value()))
+	case *Gauge:
+		fmt.Fprintf(w, "%s %s\n", d.name, formatFloat(m.Value()))
+	case func() float64:
+		fmt.Fprintf(w, "%s %s\n", d.name, formatFloat(m()))
+	case *Histogram:
+		writeHistogram(w, d.name, nil, nil, m)
+	case *CounterVec:
+		m.each(func(values []string, c interface{}) {
+			fmt.Fprintf(w, "%s%s %s\n", d.name, formatLabels(d.labelNames, values), formatFloat(c.(*Counter).Value()))
+		})
+	case *GaugeVec:
+		m.each(func(values []string, g interface{}) {
+			fmt.Fprintf(w, "%s%s %s\n", d.name, formatLabels(d.labelNames, values), formatFloat(g.(*Gauge).Value()))
+		})
+	case *HistogramVec:
+		m.each(func(values []string, h interface{}) {
+			writeHistogram(w, d.name, d.labelNames, values, h.(*Histogram))
+		})
+	}
+}
+
+// 按Prometheus文本格式输出全部指标
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.lock.RLock()
+	descs := make([]*desc, 0, len(r.descs))
+	for _, d := range r.descs {
+		descs = append(descs, d)
+	}
+	r.lock.RUnlock()
+	sort.Slice(descs, func(i, j int) bool { return descs[i].name < descs[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, d := range descs {
+		d.write(bw)
+	}
+	return bw.Flush()
+}
+
+// 输出指标的http处理函数
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WritePrometheus(w)
+	})
+}
+
+// 默认注册表的http处理函数
+func Handler() http.Handler {
+	return Default.Handler()
+}
@@ -0,0 +1,114 @@
+package module
+
+import (
+	"fmt"
+	"gobonbon/log"
+	"runtime/debug"
+	"sync"
+)
+
+// 模块的日志，等级可以用 log.SetModuleLevel("module", ...) 单独调整
+var modLog = log.Module("module")
+
+/*
+游戏逻辑的模块，每个模块在自己的goroutine中运行，模块之间用chanrpc通信
+
+	type Game struct {
+		*module.Skeleton
+	}
+
+	func (g *Game) OnInit() {
+		g.RegisterChanRPC("Login", g.login)
+	}
+
+	func (g *Game) OnDestroy() {}
+
+OnInit 在Run之前按注册顺序调用，Run 在单独的goroutine中执行，closeSig关闭时返回，
+全部模块的Run返回后按注册的相反顺序调用 OnDestroy。嵌入 Skeleton 就有了带信箱的Run
+*/
+type Module interface {
+	OnInit()
+	OnDestroy()
+	Run(closeSig chan struct{})
+}
+
+type mod struct {
+	mi       Module
+	closeSig chan struct{}
+	wg       sync.WaitGroup
+}
+
+/*
+模块管理，按注册顺序启动，按相反的顺序停止
+Server 带有一个模块管理，用 Server.RegisterModule 注册的模块随Server启动和停止
+*/
+type Manager struct {
+	lock    sync.Mutex
+	mods    []*mod
+	started bool
+}
+
+func NewManager() *Manager {
+	return &Manager{}
+}
+
+// 注册模块，需要在Init之前调用
+func (m *Manager) Register(mi Module) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.started {
+		panic("module registered after Init")
+	}
+	m.mods = append(m.mods, &mod{mi: mi, closeSig: make(chan struct{})})
+}
+
+// 按注册顺序调用全部模块的OnInit，再在各自的goroutine中执行Run；重复调用时只执行一次
+func (m *Manager) Init() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.started {
+		return
+	}
+	m.started = true
+	for _, md := range m.mods {
+		md.mi.OnInit()
+	}
+	for _, md := range m.mods {
+		md.wg.Add(1)
+		go run(md)
+	}
+	modLog.With("modules", len(m.mods)).Debug("modules started")
+}
+
+func run(md *mod) {
+	defer md.wg.Done()
+	md.mi.Run(md.closeSig)
+}
+
+// 按注册的相反顺序停止模块：关闭closeSig，等Run返回，再调用OnDestroy；没有Init时什么也不做
+func (m *Manager) Destroy() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.started {
+		return
+	}
+	m.started = false
+	for i := len(m.mods) - 1; i >= 0; i-- {
+		md := m.mods[i]
+		close(md.closeSig)
+		md.wg.Wait()
+		destroy(md)
+	}
+	m.mods = nil
+	modLog.Debug("modules destroyed")
+}
+
+// OnDestroy中的panic不影响其他模块的停止
+func destroy(md *mod) {
+	defer func() {
+		if r := recover(); r != nil {
+			modLog.With("module", fmt.Sprintf("%T", md.mi)).Error("module destroy panic", "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	md.mi.OnDestroy()
+}
@@ -0,0 +1,100 @@
+package module
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录OnInit和OnDestroy的顺序
+type recorder struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (r *recorder) add(event string) {
+	r.lock.Lock()
+	r.events = append(r.events, event)
+	r.lock.Unlock()
+}
+
+type counter struct {
+	*Skeleton
+	name  string
+	rec   *recorder
+	count int
+}
+
+func (c *counter) OnInit() {
+	c.rec.add("init " + c.name)
+	c.RegisterChanRPC("incr", func(args []interface{}) (interface{}, error) {
+		c.count += args[0].(int)
+		return c.count, nil
+	})
+}
+
+func (c *counter) OnDestroy() {
+	c.rec.add("destroy " + c.name)
+}
+
+// 调用counter模块的模块
+type player struct {
+	*Skeleton
+	rec     *recorder
+	counter *counter
+	results chan string
+}
+
+func (p *player) OnInit() {
+	p.rec.add("init player")
+	p.RegisterChanRPC("play", func(args []interface{}) (interface{}, error) {
+		ret, err := p.Call(p.counter.ChanRPC(), "incr", 1)
+		if err != nil {
+			return nil, err
+		}
+		p.AsynCall(p.counter.ChanRPC(), func(ret interface{}, err error) {
+			p.AfterFunc(time.Millisecond, func() {
+				p.results <- fmt.Sprint("async ", ret)
+			})
+		}, "incr", 10)
+		return ret, nil
+	})
+}
+
+func (p *player) OnDestroy() {
+	p.rec.add("destroy player")
+}
+
+func TestManager(t *testing.T) {
+	rec := &recorder{}
+	c := &counter{Skeleton: NewSkeleton(), name: "counter", rec: rec}
+	p := &player{Skeleton: NewSkeleton(), rec: rec, counter: c, results: make(chan string, 1)}
+	m := NewManager()
+	m.Register(c)
+	m.Register(p)
+	m.Init()
+
+	// 其他goroutine中同步调用模块
+	ret, err := p.ChanRPC().Call("play")
+	if err != nil || ret != 1 {
+		t.Fatalf("play = %v, %v", ret, err)
+	}
+	select {
+	case got := <-p.results:
+		if got != "async 11" {
+			t.Fatalf("async result %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("async callback not called")
+	}
+
+	m.Destroy()
+	want := []string{"init counter", "init player", "destroy player", "destroy counter"}
+	if fmt.Sprint(rec.events) != fmt.Sprint(want) {
+		t.Fatalf("events %v, want %v", rec.events, want)
+	}
+	if _, err := c.ChanRPC().Call("incr", 1); err == nil {
+		t.Fatal("call after destroy succeeded")
+	}
+}
@@ -0,0 +1,111 @@
+package module
+
+import (
+	"gobonbon/chanrpc"
+	"runtime/debug"
+	"time"
+)
+
+// Skeleton 的默认设置
+const (
+	DefaultChanRPCLen  = 10000 //信箱的长度
+	DefaultAsynCallLen = 10000 //同时进行的异步调用的最大数量
+	DefaultTimerLen    = 10000 //等待执行的定时回调的最大数量
+)
+
+/*
+模块的骨架，嵌入到模块中提供Run：在模块的goroutine中依次处理信箱中的调用、异步调用的回调和定时回调，
+这些处理都在同一个goroutine中，模块的数据不需要加锁
+
+	game := &Game{Skeleton: module.NewSkeleton()}
+	s.RegisterModule(game)
+
+	// 其他模块中
+	ret, err := m.Call(game.ChanRPC(), "Login", userID)
+	m.AsynCall(game.ChanRPC(), func(ret interface{}, err error) {...}, "Login", userID)
+
+	// 网络路由等其他goroutine中
+	ret, err := game.ChanRPC().Call("Login", userID)
+*/
+type Skeleton struct {
+	server    *chanrpc.Server
+	client    *chanrpc.Client
+	timerChan chan func()
+	done      chan struct{} //Run返回时关闭
+}
+
+// 使用默认设置创建
+func NewSkeleton() *Skeleton {
+	return NewSkeletonWithSize(DefaultChanRPCLen, DefaultAsynCallLen, DefaultTimerLen)
+}
+
+// 指定信箱的长度、同时进行的异步调用的最大数量和等待执行的定时回调的最大数量
+func NewSkeletonWithSize(chanRPCLen, asynCallLen, timerLen int) *Skeleton {
+	return &Skeleton{
+		server:    chanrpc.NewServer(chanRPCLen),
+		client:    chanrpc.NewClient(asynCallLen),
+		timerChan: make(chan func(), timerLen),
+		done:      make(chan struct{}),
+	}
+}
+
+// 模块的信箱，其他模块和goroutine通过它调用这个模块
+func (s *Skeleton) ChanRPC() *chanrpc.Server {
+	return s.server
+}
+
+// 注册信箱中调用的处理方法，在OnInit中调用
+func (s *Skeleton) RegisterChanRPC(id interface{}, f chanrpc.Handler) {
+	s.server.Register(id, f)
+}
+
+/*
+模块的主循环，closeSig关闭时：信箱中还没有处理的调用返回 chanrpc.ErrClosed，
+等待这个模块发出的异步调用全部返回并执行回调，没有执行的定时回调被丢弃
+*/
+func (s *Skeleton) Run(closeSig chan struct{}) {
+	for {
+		select {
+		case <-closeSig:
+			s.server.Close()
+			s.client.Close()
+			close(s.done)
+			return
+		case ri := <-s.client.ChanAsynRet:
+			s.client.Cb(ri)
+		case ci := <-s.server.ChanCall:
+			s.server.Exec(ci)
+		case f := <-s.timerChan:
+			s.runTimer(f)
+		}
+	}
+}
+
+func (s *Skeleton) runTimer(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			modLog.Error("module timer panic", "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	f()
+}
+
+// 同步调用其他模块，在模块的goroutine中使用；两个模块互相同步调用会死锁，这时使用 AsynCall
+func (s *Skeleton) Call(server *chanrpc.Server, id interface{}, args ...interface{}) (interface{}, error) {
+	return s.client.Call(server, id, args...)
+}
+
+// 异步调用其他模块，cb在这个模块的goroutine中执行，在模块的goroutine中使用
+func (s *Skeleton) AsynCall(server *chanrpc.Server, cb func(ret interface{}, err error), id interface{}, args ...interface{}) {
+	s.client.AsynCall(server, cb, id, args...)
+}
+
+// d之后在这个模块的goroutine中执行f，可以用返回的Timer取消
+func (s *Skeleton) AfterFunc(d time.Duration, f func()) *time.Timer {
+	return time.AfterFunc(d, func() {
+		select {
+		case s.timerChan <- f:
+		case <-s.done:
+		}
+	})
+}
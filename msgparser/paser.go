@@ -6,15 +6,24 @@ import (
 	"errors"
 	"gobonbon/conf"
 	"gobonbon/iface"
+	"sync/atomic"
 )
 
 type MsgParser struct {
-	littleEndian bool // 大小端
+	littleEndian  bool   // 大小端
+	maxPacketSize uint32 // 数据的最大长度，0表示不限制，原子操作，运行时可以修改
 }
 
+// 使用全局配置 conf.Get() 中的 MaxPacketSize，之后可以用 SetMaxPacketSize 修改
 func NewMsgParser() *MsgParser {
+	return NewMsgParserWithMaxPacketSize(conf.Get().MaxPacketSize)
+}
+
+// 创建解析器，maxPacketSize为数据的最大长度，0表示不限制
+func NewMsgParserWithMaxPacketSize(maxPacketSize uint32) *MsgParser {
 	p := new(MsgParser)
 	p.littleEndian = false
+	p.maxPacketSize = maxPacketSize
 	return p
 }
 
@@ -23,6 +32,11 @@ func (p *MsgParser) SetByteOrder(littleEndian bool) {
 	p.littleEndian = littleEndian
 }
 
+// 设置数据的最大长度，0表示不限制，可以在运行时修改
+func (p *MsgParser) SetMaxPacketSize(size uint32) {
+	atomic.StoreUint32(&p.maxPacketSize, size)
+}
+
 // 获取包头长度方法
 func (p *MsgParser) GetHeadLen() uint32 {
 	//Id uint32(4字节) +  DataLen uint32(4字节)
@@ -86,7 +100,7 @@ func (p *MsgParser) Decode(binaryData []byte) (iface.IMessage, error) {
 
 	}
 	// (判断dataLen的长度是否超出我们允许的最大包长度)
-	if conf.GlobalObject.MaxPacketSize > 0 && msg.GetDataLen() > conf.GlobalObject.MaxPacketSize {
+	if max := atomic.LoadUint32(&p.maxPacketSize); max > 0 && msg.GetDataLen() > max {
 		return nil, errors.New("too large msg data received")
 	}
 	// (这里只需要把head的数据拆包出来就可以了，然后再通过head的长度，再从conn读取一次数据)
@@ -0,0 +1,74 @@
+package nettest_test
+
+import (
+	"gobonbon/iface"
+	"gobonbon/nettest"
+	"gobonbon/router"
+	"testing"
+)
+
+type echoRouter struct {
+	router.BaseRouter
+}
+
+func (r *echoRouter) Handle(req iface.IRequest) {
+	req.GetConnection().WriteMsg(req.GetMsgID()+1, req.GetData())
+}
+
+type kickRouter struct {
+	router.BaseRouter
+}
+
+func (r *kickRouter) Handle(req iface.IRequest) {
+	req.GetConnection().Stop()
+}
+
+func TestServerReply(t *testing.T) {
+	s := nettest.NewServer()
+	s.AddRouter(1, &echoRouter{})
+
+	conn := s.Connect()
+	if err := conn.WriteMsg(1, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	msg, ok := conn.Recv()
+	if !ok {
+		t.Fatal("no reply")
+	}
+	if msg.GetMsgId() != 2 || string(msg.GetData()) != "ping" {
+		t.Fatalf("unexpected reply %d %q", msg.GetMsgId(), msg.GetData())
+	}
+	if _, ok := conn.Recv(); ok {
+		t.Fatal("unexpected extra reply")
+	}
+}
+
+func TestServerKick(t *testing.T) {
+	s := nettest.NewServer()
+	s.AddRouter(1, &kickRouter{})
+
+	conn := s.Connect()
+	if s.GetConnMgr().Len() != 1 {
+		t.Fatalf("conn num = %d", s.GetConnMgr().Len())
+	}
+	conn.WriteMsg(1, nil)
+	if !conn.Closed() {
+		t.Fatal("conn not closed")
+	}
+	if s.GetConnMgr().Len() != 0 {
+		t.Fatalf("conn num = %d after kick", s.GetConnMgr().Len())
+	}
+	if err := conn.WriteMsg(1, nil); err != nettest.ErrClosed {
+		t.Fatalf("write after close err = %v", err)
+	}
+}
+
+func TestServerStop(t *testing.T) {
+	s := nettest.NewServer()
+	a := s.Connect()
+	b := s.Connect()
+	s.Stop()
+	if !a.Closed() || !b.Closed() || s.GetConnMgr().Len() != 0 {
+		t.Fatal("connections not cleared")
+	}
+}
@@ -0,0 +1,222 @@
+package nettest
+
+import (
+	"errors"
+	"gobonbon/conf"
+	"gobonbon/iface"
+	"gobonbon/msgparser"
+	"gobonbon/util"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrClosed = errors.New("nettest: connection closed")
+
+// 内存连接ID
+var pipeID uint64
+
+// 内存连接的地址
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "nettest" }
+func (a pipeAddr) String() string  { return string(a) }
+
+/*
+内存中的连接端点，实现iface.IConn
+一端WriteMsg的消息经过msgparser编码解码后同步交给另一端：
+另一端设置了消息回调则直接调用回调，否则放入收件箱等待Recv
+*/
+type Conn struct {
+	util.ConnProperty
+
+	lock   sync.Mutex
+	connID uint64
+	local  pipeAddr
+	peer   *Conn
+	closed bool
+	inbox  []iface.IMessage
+
+	msgParser *msgparser.MsgParser
+	sendLock  sync.Mutex
+	observer  func(msgId uint32, packet []byte)    //发送观察者，见 network.SendObservable
+	onMsg     func(conn *Conn, msg iface.IMessage) //收到消息时的回调
+	onClose   func(conn *Conn)                     //连接关闭时的回调
+}
+
+/*
+创建一对互相连接的内存端点
+*/
+func Pipe() (*Conn, *Conn) {
+	a := newConn()
+	b := newConn()
+	a.peer = b
+	b.peer = a
+	return a, b
+}
+
+func newConn() *Conn {
+	id := atomic.AddUint64(&pipeID, 1)
+	return &Conn{
+		connID:    id,
+		local:     pipeAddr("pipe-" + strconv.FormatUint(id, 10)),
+		msgParser: msgparser.NewMsgParserWithMaxPacketSize(conf.DefaultGlobalObj().MaxPacketSize),
+	}
+}
+
+// 设置收到消息时的回调，设置后消息不再进入收件箱
+func (c *Conn) SetOnMsg(hook func(conn *Conn, msg iface.IMessage)) {
+	c.lock.Lock()
+	c.onMsg = hook
+	c.lock.Unlock()
+}
+
+// 设置连接关闭时的回调
+func (c *Conn) SetOnClose(hook func(conn *Conn)) {
+	c.lock.Lock()
+	c.onClose = hook
+	c.lock.Unlock()
+}
+
+// 对端
+func (c *Conn) Peer() *Conn {
+	return c.peer
+}
+
+// 内存连接不需要启动
+func (c *Conn) Start() {}
+
+// 关闭连接，两端同时进入关闭状态
+func (c *Conn) Stop() {
+	c.close()
+	c.peer.close()
+}
+
+func (c *Conn) close() {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	c.closed = true
+	onClose := c.onClose
+	c.lock.Unlock()
+
+	if onClose != nil {
+		onClose(c)
+	}
+}
+
+// 连接是否已经关闭
+func (c *Conn) Closed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.peer.local
+}
+
+/*
+将消息封包后交给对端，和真实连接一样经过Encode和Decode
+对端有消息回调时，回调在当前goroutine里同步执行
+*/
+func (c *Conn) WriteMsg(msgId uint32, data []byte) error {
+	//有观察者时发送和通知需要串行
+	c.sendLock.Lock()
+	observer := c.observer
+	if observer == nil {
+		c.sendLock.Unlock()
+	} else {
+		defer c.sendLock.Unlock()
+	}
+
+	if c.Closed() {
+		return ErrClosed
+	}
+	buf, err := c.msgParser.Encode(msgparser.NewMsgPackage(msgId, data))
+	if err != nil {
+		return err
+	}
+	if err := c.peer.deliver(buf); err != nil {
+		return err
+	}
+	if observer != nil {
+		observer(msgId, buf)
+	}
+	return nil
+}
+
+// 设置发送观察者，实现 network.SendObservable
+func (c *Conn) SetSendObserver(fn func(msgId uint32, packet []byte)) {
+	c.sendLock.Lock()
+	c.observer = fn
+	c.sendLock.Unlock()
+}
+
+// 对端收到一个完整的数据包
+func (c *Conn) deliver(buf []byte) error {
+	hlen := c.msgParser.GetHeadLen()
+	msg, err := c.msgParser.Decode(buf[:hlen])
+	if err != nil {
+		return err
+	}
+	msg.SetData(buf[hlen : hlen+msg.GetDataLen()])
+
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return ErrClosed
+	}
+	onMsg := c.onMsg
+	if onMsg == nil {
+		c.inbox = append(c.inbox, msg)
+	}
+	c.lock.Unlock()
+
+	if onMsg != nil {
+		onMsg(c, msg)
+	}
+	return nil
+}
+
+// 取出收件箱中最早的一条消息，没有消息时返回false
+func (c *Conn) Recv() (iface.IMessage, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.inbox) == 0 {
+		return nil, false
+	}
+	msg := c.inbox[0]
+	c.inbox = c.inbox[1:]
+	return msg, true
+}
+
+// 取出收件箱中的全部消息
+func (c *Conn) RecvAll() []iface.IMessage {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	msgs := c.inbox
+	c.inbox = nil
+	return msgs
+}
+
+func (c *Conn) GetConnID() uint64 {
+	return c.connID
+}
+
+func (c *Conn) GetTCPConnection() net.Conn {
+	return nil
+}
+
+func (c *Conn) GetWsConn() *websocket.Conn {
+	return nil
+}
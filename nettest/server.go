@@ -0,0 +1,69 @@
+package nettest
+
+import (
+	"gobonbon/iface"
+	"gobonbon/network"
+	"gobonbon/router"
+)
+
+/*
+用于测试路由的服务器，实现iface.IServer
+不监听端口，不启动worker：客户端发送的消息在调用方goroutine里同步执行完路由，
+返回时回复已经在客户端的收件箱里
+*/
+type Server struct {
+	Name       string
+	msgHandler *router.MsgHandle
+	ConnMgr    *network.ConnManager
+}
+
+func NewServer() *Server {
+	return &Server{
+		Name:       "nettest",
+		msgHandler: router.NewMsgHandleWithPool(0, 0), //在连接的goroutine中直接处理，不使用Worker池
+		ConnMgr:    network.NewConnManager(),
+	}
+}
+
+/*
+建立一条新的内存连接，返回客户端一端
+服务端一端加入ConnManager，连接关闭时自动移除
+*/
+func (s *Server) Connect() *Conn {
+	clientConn, serverConn := Pipe()
+	serverConn.SetOnMsg(func(conn *Conn, msg iface.IMessage) {
+		s.msgHandler.DoMsgHandler(network.NewRequest(conn, msg))
+	})
+	serverConn.SetOnClose(func(conn *Conn) {
+		s.ConnMgr.Remove(conn)
+	})
+	s.ConnMgr.Add(serverConn)
+	return clientConn
+}
+
+// 内存服务器不需要启动
+func (s *Server) Start() {}
+
+// 关闭全部连接
+func (s *Server) Stop() {
+	s.ConnMgr.ClearConn()
+}
+
+// 内存服务器没有监听，直接返回
+func (s *Server) Serve() {}
+
+func (s *Server) AddRouter(msgId uint32, router iface.IRouter) {
+	s.msgHandler.AddRouter(msgId, router)
+}
+
+func (s *Server) GetConnMgr() iface.IConnManager {
+	return s.ConnMgr
+}
+
+func (s *Server) ServerName() string {
+	return s.Name
+}
+
+func (s *Server) GetMsgHandler() iface.IMsgHandle {
+	return s.msgHandler
+}
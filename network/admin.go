@@ -0,0 +1,264 @@
+package network
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"gobonbon/conf"
+	"gobonbon/log"
+	"gobonbon/metrics"
+	"gobonbon/router"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+管理http服务，使用独立的ServeMux，不和websocket监听共用
+
+	GET  /metrics          Prometheus文本格式的指标
+	GET  /conns            当前全部连接
+	POST /conns/kick?id=N  踢掉一个连接
+	GET  /routes           已注册的路由
+	GET  /workers          每个worker的任务队列长度
+	GET  /config           当前运行的配置
+	GET  /config/sources   每个配置字段的来源 default file env flag
+	POST /config/reload    重新加载配置，应用可以热更新的字段，返回生效和被忽略的修改
+	                       这两个接口操作全局配置，不是 NewServerWithConfig 创建的Server返回501
+	GET  /log/levels       日志等级和按模块设置的等级
+	POST /log/levels?module=network&level=info  修改模块的日志等级，module为空时修改全局等级，level为空时取消模块的设置
+	POST /shutdown         优雅关闭服务器
+*/
+func (s *Server) ListenAdmin() {
+	cfg := s.Config()
+	addr := fmt.Sprintf("%s:%d", cfg.AdminHost, cfg.AdminPort)
+	httpServer := &http.Server{Addr: addr, Handler: s.adminHandler()}
+	go func() {
+		<-s.exitChan
+		httpServer.Close()
+	}()
+	netLog.With("addr", addr).Info("admin server listening")
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		netLog.With("addr", addr).Error("admin server listen error", "err", err)
+	}
+}
+
+// 管理接口的路由，带令牌校验
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/conns", s.adminConns)
+	mux.HandleFunc("/conns/kick", s.adminKick)
+	mux.HandleFunc("/routes", s.adminRoutes)
+	mux.HandleFunc("/workers", s.adminWorkers)
+	mux.HandleFunc("/config", s.adminConfig)
+	mux.HandleFunc("/config/sources", s.adminConfigSources)
+	mux.HandleFunc("/config/reload", s.adminConfigReload)
+	mux.HandleFunc("/log/levels", s.adminLogLevels)
+	mux.HandleFunc("/shutdown", s.adminShutdown)
+	return adminAuth(s.Config().AdminToken, mux)
+}
+
+// 令牌校验，token为空时不校验
+func adminAuth(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// 连接的统计信息，TCPConn和WsConnection都实现了
+type connStats interface {
+	StartTime() time.Time
+	BytesIn() uint64
+	BytesOut() uint64
+}
+
+type adminConn struct {
+	ID         uint64            `json:"id"`
+	RemoteAddr string            `json:"remote_addr"`
+	Age        string            `json:"age"`
+	BytesIn    uint64            `json:"bytes_in"`
+	BytesOut   uint64            `json:"bytes_out"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+func (s *Server) adminConns(w http.ResponseWriter, r *http.Request) {
+	conns := s.ConnMgr.All()
+	list := make([]adminConn, 0, len(conns))
+	for _, conn := range conns {
+		item := adminConn{ID: conn.GetConnID()}
+		if addr := conn.RemoteAddr(); addr != nil {
+			item.RemoteAddr = addr.String()
+		}
+		if stats, ok := conn.(connStats); ok {
+			item.Age = time.Since(stats.StartTime()).Round(time.Second).String()
+			item.BytesIn = stats.BytesIn()
+			item.BytesOut = stats.BytesOut()
+		}
+		if p, ok := conn.(interface{ Properties() map[string]interface{} }); ok {
+			props := p.Properties()
+			if len(props) > 0 {
+				item.Properties = make(map[string]string, len(props))
+				for k, v := range props {
+					if sess, ok := v.(*Session); ok {
+						//只显示会话ID，令牌可以用来接管会话
+						item.Properties[k] = sess.String()
+						continue
+					}
+					item.Properties[k] = fmt.Sprintf("%v", v)
+				}
+			}
+		}
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	writeJSON(w, list)
+}
+
+func (s *Server) adminKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	connID, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	conn, err := s.ConnMgr.Get(connID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	conn.Stop()
+	writeJSON(w, map[string]interface{}{"kicked": connID})
+}
+
+type adminRoute struct {
+	MsgId    uint32 `json:"msg_id"`
+	MaxMsgId uint32 `json:"max_msg_id,omitempty"` //按范围注册时范围的结束
+	Router   string `json:"router"`
+}
+
+func (s *Server) adminRoutes(w http.ResponseWriter, r *http.Request) {
+	list := []adminRoute{}
+	if mh, ok := s.msgHandler.(*router.MsgHandle); ok {
+		apis, ranges := mh.Routes()
+		for msgId, api := range apis {
+			list = append(list, adminRoute{MsgId: msgId, Router: fmt.Sprintf("%T", api)})
+		}
+		for _, r := range ranges {
+			list = append(list, adminRoute{MsgId: r.Min, MaxMsgId: r.Max, Router: fmt.Sprintf("%T", r.Router)})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].MsgId < list[j].MsgId })
+	writeJSON(w, list)
+}
+
+type adminWorker struct {
+	Worker     int `json:"worker"`
+	QueueDepth int `json:"queue_depth"`
+	Capacity   int `json:"capacity"`
+}
+
+func (s *Server) adminWorkers(w http.ResponseWriter, r *http.Request) {
+	list := []adminWorker{}
+	if mh, ok := s.msgHandler.(*router.MsgHandle); ok {
+		for i, depth := range mh.QueueLens() {
+			list = append(list, adminWorker{Worker: i, QueueDepth: depth, Capacity: cap(mh.TaskQueue[i])})
+		}
+	}
+	writeJSON(w, list)
+}
+
+func (s *Server) adminConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.Config().Masked())
+}
+
+// 全局配置的接口，Server不跟随全局配置时回复501，返回false
+func (s *Server) adminGlobalConfig(w http.ResponseWriter) bool {
+	if !s.global {
+		http.Error(w, "server not using global config", http.StatusNotImplemented)
+		return false
+	}
+	return true
+}
+
+func (s *Server) adminConfigSources(w http.ResponseWriter, r *http.Request) {
+	if !s.adminGlobalConfig(w) {
+		return
+	}
+	writeJSON(w, conf.DefaultLoader.Sources())
+}
+
+func (s *Server) adminConfigReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.adminGlobalConfig(w) {
+		return
+	}
+	result, err := conf.ReloadHot()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, result)
+}
+
+type adminLogLevels struct {
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules"`
+}
+
+func (s *Server) adminLogLevels(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		module, level := r.FormValue("module"), r.FormValue("level")
+		var err error
+		if module == "" {
+			err = log.SetLevel(level)
+		} else {
+			err = log.SetModuleLevel(module, level)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		netLog.With("module", module, "level", level).Info("log level changed by admin")
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, adminLogLevels{Level: log.Level(), Modules: log.ModuleLevels()})
+}
+
+func (s *Server) adminShutdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "shutting down"})
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	// 在新的goroutine里停止，先让这次请求返回
+	go s.Stop()
+}
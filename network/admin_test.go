@@ -0,0 +1,209 @@
+package network
+
+import (
+	"encoding/json"
+	"gobonbon/iface"
+	"gobonbon/router"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type adminTestRouter struct {
+	router.BaseRouter
+}
+
+// 发送管理请求，返回状态码和内容
+func adminDo(h http.Handler, method, path, token string) (int, string) {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Code, w.Body.String()
+}
+
+func TestAdminAuth(t *testing.T) {
+	s, err := NewServer(WithAdmin("127.0.0.1", 0, "tok"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.adminHandler()
+	for _, token := range []string{"", "bad"} {
+		if code, _ := adminDo(h, http.MethodGet, "/config", token); code != http.StatusUnauthorized {
+			t.Fatalf("token %q: status %d", token, code)
+		}
+	}
+	code, body := adminDo(h, http.MethodGet, "/config", "tok")
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	// 令牌不会出现在配置中
+	if strings.Contains(body, `"tok"`) || !strings.Contains(body, "******") {
+		t.Fatalf("token not masked: %s", body)
+	}
+
+	// 没有令牌时不校验
+	s, _ = NewServer()
+	if code, _ := adminDo(s.adminHandler(), http.MethodGet, "/config", ""); code != http.StatusOK {
+		t.Fatalf("status %d without token", code)
+	}
+}
+
+// 在添加路由的同时读取 /routes，用 -race 运行
+func TestAdminRoutes(t *testing.T) {
+	s, _ := NewServer()
+	h := s.adminHandler()
+	s.AddRouterRange(1000, 1999, &adminTestRouter{})
+	done := make(chan struct{})
+	go func() {
+		for i := 1; i <= 50; i++ {
+			s.AddRouter(uint32(i), &adminTestRouter{})
+		}
+		close(done)
+	}()
+	for i := 0; i < 20; i++ {
+		adminDo(h, http.MethodGet, "/routes", "")
+	}
+	<-done
+
+	code, body := adminDo(h, http.MethodGet, "/routes", "")
+	var routes []adminRoute
+	if err := json.Unmarshal([]byte(body), &routes); code != http.StatusOK || err != nil {
+		t.Fatalf("status %d, %v: %s", code, err, body)
+	}
+	if len(routes) != 51 || routes[0].MsgId != 1 || routes[50].MsgId != 1000 || routes[50].MaxMsgId != 1999 {
+		t.Fatalf("routes %+v", routes)
+	}
+	if routes[0].Router != "*network.adminTestRouter" {
+		t.Fatalf("router %q", routes[0].Router)
+	}
+}
+
+// 启动监听本机的Server并建立一个TCP连接，返回客户端一端和服务端一端
+func adminTestConn(t *testing.T, opts ...Option) (*Server, net.Conn, iface.IConn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	s, err := NewServer(append([]Option{WithHost("127.0.0.1"), WithTcpPort(port)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port)); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		s.Stop()
+		t.Fatal(err)
+	}
+	for i := 0; i < 50 && s.ConnMgr.Len() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	all := s.ConnMgr.All()
+	if len(all) != 1 {
+		conn.Close()
+		s.Stop()
+		t.Fatalf("%d conns", len(all))
+	}
+	return s, conn, all[0]
+}
+
+func TestAdminKick(t *testing.T) {
+	s, conn, serverConn := adminTestConn(t)
+	defer s.Stop()
+	defer conn.Close()
+	h := s.adminHandler()
+	id := strconv.FormatUint(serverConn.GetConnID(), 10)
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/conns/kick?id=" + id, http.StatusMethodNotAllowed},
+		{http.MethodPost, "/conns/kick?id=x", http.StatusBadRequest},
+		{http.MethodPost, "/conns/kick?id=99999", http.StatusNotFound},
+		{http.MethodPost, "/conns/kick?id=" + id, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code, body := adminDo(h, tt.method, tt.path, ""); code != tt.want {
+			t.Fatalf("%s %s: status %d, want %d: %s", tt.method, tt.path, code, tt.want, body)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("conn not closed after kick")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("conn not closed after kick")
+	}
+}
+
+// /conns 显示连接的属性，会话只显示ID，不能泄露重连的令牌
+func TestAdminConnsHideSessionToken(t *testing.T) {
+	s, conn, serverConn := adminTestConn(t, WithSessions(SessionConfig{}))
+	defer s.Stop()
+	defer conn.Close()
+	sess, err := s.GetSessionMgr().Create(serverConn, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn.SetProperty("room", 7)
+
+	code, body := adminDo(s.adminHandler(), http.MethodGet, "/conns", "")
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if strings.Contains(body, sess.Token()) {
+		t.Fatalf("/conns contains session token: %s", body)
+	}
+	var conns []adminConn
+	if err := json.Unmarshal([]byte(body), &conns); err != nil || len(conns) != 1 {
+		t.Fatalf("%v: %s", err, body)
+	}
+	props := conns[0].Properties
+	if props["room"] != "7" || props[SessionKey] != sess.String() {
+		t.Fatalf("properties %v", props)
+	}
+}
+
+// 全局配置的接口只对跟随全局配置的Server可用
+func TestAdminConfigReload(t *testing.T) {
+	s, _ := NewServer()
+	h := s.adminHandler()
+	if code, _ := adminDo(h, http.MethodGet, "/config/sources", ""); code != http.StatusNotImplemented {
+		t.Fatalf("sources status %d", code)
+	}
+	if code, _ := adminDo(h, http.MethodPost, "/config/reload", ""); code != http.StatusNotImplemented {
+		t.Fatalf("reload status %d", code)
+	}
+
+	g := NewServerWithConfig()
+	defer g.Stop()
+	h = g.adminHandler()
+	if code, _ := adminDo(h, http.MethodGet, "/config/reload", ""); code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET reload status %d", code)
+	}
+	code, body := adminDo(h, http.MethodPost, "/config/reload", "")
+	var result map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &result); code != http.StatusOK || err != nil {
+		t.Fatalf("reload status %d, %v: %s", code, err, body)
+	}
+	code, body = adminDo(h, http.MethodGet, "/config/sources", "")
+	if code != http.StatusOK || !strings.Contains(body, "MaxConn") {
+		t.Fatalf("sources status %d: %s", code, body)
+	}
+}
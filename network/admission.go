@@ -0,0 +1,232 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrConnDenied    = errors.New("connection denied by cidr rule")
+	ErrServerFull    = errors.New("server is full")
+	ErrTooManyFromIP = errors.New("too many connections from ip")
+	ErrAcceptRate    = errors.New("accept rate exceeded")
+)
+
+/*
+连接准入控制模块
+负责 黑白名单、总连接数、单IP连接数、接入速率 的判断
+*/
+type Admission struct {
+	lock      sync.Mutex
+	maxConn   int            //最大连接数，0表示不限制
+	maxPerIP  int            //单IP最大连接数，0表示不限制
+	active    int            //当前已准入的连接数
+	ipConns   map[string]int //每个IP当前已准入的连接数
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+
+	//令牌桶限制接入速率
+	rate       float64 //每秒产生的令牌数，0表示不限制
+	burst      float64 //令牌桶容量
+	tokens     float64
+	lastRefill time.Time
+}
+
+/*
+创建一个准入控制
+rate为每秒允许的新连接数，burst为允许的突发数量
+*/
+func NewAdmission(maxConn, maxPerIP, rate, burst int, allow, deny []string) (*Admission, error) {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &Admission{
+		maxConn:    maxConn,
+		maxPerIP:   maxPerIP,
+		ipConns:    make(map[string]int),
+		allowNets:  allowNets,
+		denyNets:   denyNets,
+		rate:       float64(rate),
+		burst:      float64(burst),
+		tokens:     float64(burst),
+		lastRefill: time.Now(),
+	}, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %v", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// 拒绝原因，用作指标的标签
+func rejectReason(err error) string {
+	switch err {
+	case ErrConnDenied:
+		return "denied"
+	case ErrServerFull:
+		return "full"
+	case ErrTooManyFromIP:
+		return "per_ip"
+	case ErrAcceptRate:
+		return "rate"
+	}
+	return "other"
+}
+
+// 从地址中取出IP
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// 判断IP是否允许接入，调用者需持有锁
+func (a *Admission) allowed(ip net.IP) bool {
+	for _, n := range a.denyNets {
+		if ip != nil && n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allowNets) == 0 {
+		return true
+	}
+	for _, n := range a.allowNets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 取一个令牌，调用者需持有锁
+func (a *Admission) takeToken() bool {
+	if a.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	a.tokens += now.Sub(a.lastRefill).Seconds() * a.rate
+	if a.tokens > a.burst {
+		a.tokens = a.burst
+	}
+	a.lastRefill = now
+	if a.tokens < 1 {
+		return false
+	}
+	a.tokens--
+	return true
+}
+
+/*
+判断一个新连接是否可以接入
+返回nil表示准入成功，连接关闭时必须调用Release归还
+*/
+func (a *Admission) Admit(addr net.Addr) error {
+	ip := addrIP(addr)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.allowed(ip) {
+		return ErrConnDenied
+	}
+	if !a.takeToken() {
+		return ErrAcceptRate
+	}
+	if a.maxConn > 0 && a.active >= a.maxConn {
+		return ErrServerFull
+	}
+	key := ip.String()
+	if a.maxPerIP > 0 && a.ipConns[key] >= a.maxPerIP {
+		return ErrTooManyFromIP
+	}
+	a.active++
+	a.ipConns[key]++
+	return nil
+}
+
+/*
+修改准入限制，用于配置热更新
+已经接入的连接不受影响，新的限制只作用于之后的新连接
+*/
+func (a *Admission) SetLimits(maxConn, maxPerIP, rate, burst int, allow, deny []string) error {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return err
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return err
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.maxConn = maxConn
+	a.maxPerIP = maxPerIP
+	a.allowNets = allowNets
+	a.denyNets = denyNets
+	if a.rate != float64(rate) || a.burst != float64(burst) {
+		a.rate = float64(rate)
+		a.burst = float64(burst)
+		a.tokens = float64(burst)
+		a.lastRefill = time.Now()
+	}
+	return nil
+}
+
+// 归还一个已准入的连接
+func (a *Admission) Release(addr net.Addr) {
+	key := addrIP(addr).String()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if n, ok := a.ipConns[key]; ok {
+		a.active--
+		if n <= 1 {
+			delete(a.ipConns, key)
+		} else {
+			a.ipConns[key] = n - 1
+		}
+	}
+}
+
+// 获取当前已准入的连接数
+func (a *Admission) Len() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.active
+}
+
+// 获取某个IP当前已准入的连接数
+func (a *Admission) IPLen(ip string) int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.ipConns[ip]
+}
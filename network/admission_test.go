@@ -0,0 +1,185 @@
+package network
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func tcpAddr(ip string, port int) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestAdmission(t *testing.T) {
+	tests := []struct {
+		name              string
+		maxConn, maxPerIP int
+		rate, burst       int
+		allow, deny       []string
+		addrs             []string
+		want              []error
+	}{
+		{
+			name:  "no limits",
+			addrs: []string{"1.1.1.1", "1.1.1.1", "2.2.2.2"},
+			want:  []error{nil, nil, nil},
+		},
+		{
+			name:    "max conn",
+			maxConn: 2,
+			addrs:   []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"},
+			want:    []error{nil, nil, ErrServerFull},
+		},
+		{
+			name:     "per ip",
+			maxPerIP: 2,
+			addrs:    []string{"1.1.1.1", "1.1.1.1", "1.1.1.1", "2.2.2.2"},
+			want:     []error{nil, nil, ErrTooManyFromIP, nil},
+		},
+		{
+			name:  "allow",
+			allow: []string{"10.0.0.0/8"},
+			addrs: []string{"10.1.2.3", "192.168.0.1"},
+			want:  []error{nil, ErrConnDenied},
+		},
+		{
+			name:  "deny before allow",
+			allow: []string{"10.0.0.0/8"},
+			deny:  []string{"10.0.0.0/16"},
+			addrs: []string{"10.0.1.1", "10.1.0.1"},
+			want:  []error{ErrConnDenied, nil},
+		},
+		{
+			name:  "ipv6",
+			deny:  []string{"fd00::/8"},
+			addrs: []string{"fd00::1", "::1"},
+			want:  []error{ErrConnDenied, nil},
+		},
+		{
+			name:  "rate without burst",
+			rate:  2,
+			addrs: []string{"1.1.1.1", "1.1.1.1", "1.1.1.1"},
+			want:  []error{nil, nil, ErrAcceptRate},
+		},
+		{
+			name:  "rate with burst",
+			rate:  1,
+			burst: 3,
+			addrs: []string{"1.1.1.1", "1.1.1.1", "1.1.1.1", "1.1.1.1"},
+			want:  []error{nil, nil, nil, ErrAcceptRate},
+		},
+		{
+			// 黑名单在取令牌之前判断，被拒绝的连接不消耗令牌
+			name:  "denied conn takes no token",
+			rate:  1,
+			deny:  []string{"9.9.9.9/32"},
+			addrs: []string{"9.9.9.9", "1.1.1.1", "1.1.1.1"},
+			want:  []error{ErrConnDenied, nil, ErrAcceptRate},
+		},
+	}
+	for _, tt := range tests {
+		a, err := NewAdmission(tt.maxConn, tt.maxPerIP, tt.rate, tt.burst, tt.allow, tt.deny)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for i, ip := range tt.addrs {
+			if err := a.Admit(tcpAddr(ip, 1000+i)); err != tt.want[i] {
+				t.Fatalf("%s: Admit %d (%s) = %v, want %v", tt.name, i, ip, err, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestAdmissionBadCIDR(t *testing.T) {
+	if _, err := NewAdmission(0, 0, 0, 0, []string{"10.0.0.0"}, nil); err == nil {
+		t.Fatal("want error for cidr without mask")
+	}
+	a, _ := NewAdmission(0, 0, 0, 0, nil, nil)
+	if err := a.SetLimits(0, 0, 0, 0, nil, []string{"bad"}); err == nil {
+		t.Fatal("want error from SetLimits")
+	}
+}
+
+func TestAdmissionRelease(t *testing.T) {
+	a, _ := NewAdmission(2, 1, 0, 0, nil, nil)
+	c1, c2 := tcpAddr("1.1.1.1", 1), tcpAddr("2.2.2.2", 2)
+	if a.Admit(c1) != nil || a.Admit(c2) != nil {
+		t.Fatal("admit failed")
+	}
+	if a.Len() != 2 || a.IPLen("1.1.1.1") != 1 {
+		t.Fatalf("Len = %d, IPLen = %d", a.Len(), a.IPLen("1.1.1.1"))
+	}
+	if err := a.Admit(tcpAddr("1.1.1.1", 3)); err != ErrServerFull {
+		t.Fatalf("Admit when full = %v", err)
+	}
+
+	// 归还的名额可以再次使用，不同端口的同一个IP共用名额
+	a.Release(tcpAddr("1.1.1.1", 1))
+	if a.Len() != 1 || a.IPLen("1.1.1.1") != 0 {
+		t.Fatalf("after release Len = %d, IPLen = %d", a.Len(), a.IPLen("1.1.1.1"))
+	}
+	if err := a.Admit(tcpAddr("1.1.1.1", 4)); err != nil {
+		t.Fatalf("Admit after release = %v", err)
+	}
+
+	// 没有准入过的地址不影响计数
+	a.Release(tcpAddr("3.3.3.3", 5))
+	if a.Len() != 2 {
+		t.Fatalf("Len = %d after releasing unknown addr", a.Len())
+	}
+}
+
+func TestAdmissionRefill(t *testing.T) {
+	a, _ := NewAdmission(0, 0, 100, 1, nil, nil)
+	addr := tcpAddr("1.1.1.1", 1)
+	if a.Admit(addr) != nil {
+		t.Fatal("first admit failed")
+	}
+	if err := a.Admit(addr); err != ErrAcceptRate {
+		t.Fatalf("second admit = %v", err)
+	}
+	// 每秒100个令牌，20ms之后至少有一个
+	time.Sleep(20 * time.Millisecond)
+	if err := a.Admit(addr); err != nil {
+		t.Fatalf("admit after refill = %v", err)
+	}
+
+	// 修改限制后令牌桶重新装满，已经准入的连接不受影响
+	if err := a.SetLimits(1, 0, 10, 2, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Admit(addr); err != ErrServerFull {
+		t.Fatalf("admit after SetLimits = %v", err)
+	}
+	if a.Len() != 2 {
+		t.Fatalf("Len = %d", a.Len())
+	}
+}
+
+func TestWsRemoteAddr(t *testing.T) {
+	tests := []struct {
+		remote string
+		want   string //为空表示返回错误
+	}{
+		{"1.2.3.4:5678", "1.2.3.4:5678"},
+		{"[::1]:80", "[::1]:80"},
+		{"[fe80::1%eth0]:80", "[fe80::1%eth0]:80"},
+		{"1.2.3.4", ""},
+		{"example.com:80", ""},
+		{"1.2.3.4:http", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		addr, err := wsRemoteAddr(&http.Request{RemoteAddr: tt.remote})
+		if tt.want == "" {
+			if err == nil {
+				t.Fatalf("wsRemoteAddr(%q) = %v, want error", tt.remote, addr)
+			}
+			continue
+		}
+		if err != nil || addr.String() != tt.want {
+			t.Fatalf("wsRemoteAddr(%q) = %v, %v, want %s", tt.remote, addr, err, tt.want)
+		}
+	}
+}
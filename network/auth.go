@@ -0,0 +1,160 @@
+package network
+
+import (
+	"errors"
+	"gobonbon/iface"
+	"gobonbon/metrics"
+	"sync/atomic"
+	"time"
+)
+
+/*
+连接认证
+
+	s, err := network.NewServer(
+		network.WithAuth(network.AuthFunc(login), MsgLogin, 10*time.Second),
+		network.WithAuthWhitelist(MsgPing, MsgVersion),
+	)
+
+设置认证后新连接处于未认证状态：
+msgId为认证消息的请求交给Authenticator，白名单中的消息正常路由，其他消息直接丢弃；
+Authenticator返回nil错误和不为nil的身份后连接通过认证，之后的消息全部正常路由，返回的身份保存在连接上，用 Identity 取得；
+身份为nil时认为认证失败；
+超时没有通过认证的连接会被关闭。认证失败时连接不关闭，可以在超时之前重试。
+WithAuth 可以使用多次，每个认证消息对应一个Authenticator，比如登录和断线重连（见 SessionManager）
+Authenticate 在连接的读goroutine中执行，执行完之前不会读取这个连接的下一条消息
+*/
+type Authenticator interface {
+	// 认证，需要回复客户端时直接使用 req.GetConnection().WriteMsg
+	Authenticate(req iface.IRequest) (identity interface{}, err error)
+}
+
+// 函数形式的Authenticator
+type AuthFunc func(req iface.IRequest) (identity interface{}, err error)
+
+func (f AuthFunc) Authenticate(req iface.IRequest) (interface{}, error) {
+	return f(req)
+}
+
+var ErrNilIdentity = errors.New("authenticator returned nil identity")
+
+// 连接的认证状态，TCPConn和WsConnection通过嵌入的connAuth实现
+// 身份不保存在连接属性中，路由里调用 SetProperty 不能伪造认证
+type authState interface {
+	authIdentity() (interface{}, bool)
+}
+
+// 连接通过认证后保存的身份，没有通过认证时返回nil
+func Identity(conn iface.IConn) interface{} {
+	if a, ok := conn.(authState); ok {
+		identity, _ := a.authIdentity()
+		return identity
+	}
+	return nil
+}
+
+// 连接是否已经通过认证，没有设置认证的Server上的连接总是返回false
+func IsAuthenticated(conn iface.IConn) bool {
+	if a, ok := conn.(authState); ok {
+		_, authed := a.authIdentity()
+		return authed
+	}
+	return false
+}
+
+// Server的认证设置，创建之后不再修改
+type authGate struct {
+	authenticators map[uint32]Authenticator //认证消息的ID -> Authenticator
+	whitelist      map[uint32]bool          //认证前可以路由的消息
+	timeout        time.Duration            //<=0 时不限制
+}
+
+// 创建认证设置，没有Authenticator时返回nil，表示不需要认证
+func newAuthGate(authenticators map[uint32]Authenticator, timeout time.Duration, whitelist []uint32) *authGate {
+	if len(authenticators) == 0 {
+		return nil
+	}
+	gate := &authGate{
+		authenticators: make(map[uint32]Authenticator, len(authenticators)),
+		whitelist:      make(map[uint32]bool, len(whitelist)),
+		timeout:        timeout,
+	}
+	for id, a := range authenticators {
+		gate.authenticators[id] = a
+	}
+	for _, id := range whitelist {
+		gate.whitelist[id] = true
+	}
+	return gate
+}
+
+// 一个连接的认证状态，嵌入到TCPConn和WsConnection中
+type connAuth struct {
+	gate     *authGate   //nil表示不需要认证
+	authed   int32       //1表示已经通过认证，原子操作
+	identity interface{} //认证返回的身份，authed为1之后不再修改
+	timer    *time.Timer
+}
+
+// 认证返回的身份和是否已经通过认证
+func (a *connAuth) authIdentity() (interface{}, bool) {
+	if atomic.LoadInt32(&a.authed) == 0 {
+		return nil, false
+	}
+	return a.identity, true
+}
+
+// 连接开始工作时调用，超时没有通过认证时关闭连接
+func (a *connAuth) startAuth(conn iface.IConn, gate *authGate) {
+	a.gate = gate
+	if gate == nil || gate.timeout <= 0 {
+		return
+	}
+	a.timer = time.AfterFunc(gate.timeout, func() {
+		if atomic.LoadInt32(&a.authed) == 1 {
+			return
+		}
+		metrics.AuthResults.WithLabelValues("timeout").Inc()
+		netLog.With("connID", conn.GetConnID(), "remote", conn.RemoteAddr().String()).Info("auth timeout, close conn")
+		conn.Stop()
+	})
+}
+
+// 连接结束时调用
+func (a *connAuth) stopAuth() {
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+}
+
+// 认证前的消息过滤，返回消息是否需要继续路由
+func (a *connAuth) filterAuth(req iface.IRequest) bool {
+	if a.gate == nil || atomic.LoadInt32(&a.authed) == 1 {
+		return true
+	}
+	conn := req.GetConnection()
+	msgId := req.GetMsgID()
+	if authenticator, ok := a.gate.authenticators[msgId]; ok {
+		identity, err := authenticator.Authenticate(req)
+		if err == nil && identity == nil {
+			err = ErrNilIdentity
+		}
+		if err != nil {
+			metrics.AuthResults.WithLabelValues("failed").Inc()
+			netLog.With("connID", conn.GetConnID(), "remote", conn.RemoteAddr().String()).Info("auth failed", "err", err)
+			return false
+		}
+		a.identity = identity
+		atomic.StoreInt32(&a.authed, 1)
+		a.stopAuth()
+		metrics.AuthResults.WithLabelValues("ok").Inc()
+		netLog.With("connID", conn.GetConnID(), "identity", identity).Debug("auth ok")
+		return false
+	}
+	if a.gate.whitelist[msgId] {
+		return true
+	}
+	metrics.AuthResults.WithLabelValues("dropped").Inc()
+	netLog.With("connID", conn.GetConnID(), "msgId", msgId).Debug("drop msg before auth")
+	return false
+}
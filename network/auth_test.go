@@ -0,0 +1,159 @@
+package network_test
+
+import (
+	"errors"
+	"gobonbon/client"
+	"gobonbon/conf"
+	"gobonbon/iface"
+	"gobonbon/network"
+	"gobonbon/router"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	msgLogin = 1
+	msgPing  = 2
+	msgGame  = 3
+	msgReply = 100
+)
+
+// 回复请求的消息ID和连接的身份
+type identityRouter struct {
+	router.BaseRouter
+}
+
+func (r *identityRouter) Handle(req iface.IRequest) {
+	identity, _ := network.Identity(req.GetConnection()).(string)
+	req.GetConnection().WriteMsg(msgReply, []byte{byte(req.GetMsgID())})
+	if identity != "" {
+		req.GetConnection().WriteMsg(msgReply, []byte(identity))
+	}
+}
+
+type recvRouter struct {
+	router.BaseRouter
+	ch chan string
+}
+
+func (r *recvRouter) Handle(req iface.IRequest) {
+	r.ch <- string(req.GetData())
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func login(req iface.IRequest) (interface{}, error) {
+	switch string(req.GetData()) {
+	case "secret":
+		req.GetConnection().WriteMsg(msgReply, []byte("welcome"))
+		return "alice", nil
+	case "nil":
+		return nil, nil //没有身份，不能通过认证
+	}
+	return nil, errors.New("bad password")
+}
+
+func testAuth(t *testing.T, mode string) {
+	port := freePort(t)
+	s, err := network.NewServer(
+		network.WithHost("127.0.0.1"),
+		network.WithMode(mode),
+		network.WithTcpPort(port),
+		network.WithWsPort(port),
+		network.WithAuth(network.AuthFunc(login), msgLogin, 300*time.Millisecond),
+		network.WithAuthWhitelist(msgPing),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddRouter(msgPing, &identityRouter{})
+	s.AddRouter(msgGame, &identityRouter{})
+	s.Start()
+	defer s.Stop()
+
+	// 等待开始监听
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	dial := func() (*client.Client, chan string) {
+		c := client.NewClient("tcp", addr)
+		if mode == conf.ServerModeWebsocket {
+			c = client.NewClient(client.NetworkWebsocket, "ws://"+addr)
+		}
+		c.SetReconnect(false, 0, 0)
+		ch := make(chan string, 16)
+		c.AddRouter(msgReply, &recvRouter{ch: ch})
+		go c.Start()
+		for i := 0; i < 50 && !c.IsConnected(); i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if !c.IsConnected() {
+			t.Fatal("connect failed")
+		}
+		return c, ch
+	}
+	expect := func(ch chan string, want string) {
+		t.Helper()
+		select {
+		case got := <-ch:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+
+	c, ch := dial()
+	defer c.Stop()
+	// 认证前只有白名单中的消息会被路由
+	c.WriteMsg(msgGame, nil)
+	c.WriteMsg(msgPing, nil)
+	expect(ch, string([]byte{msgPing}))
+	c.WriteMsg(msgLogin, []byte("wrong"))
+	c.WriteMsg(msgLogin, []byte("nil"))
+	c.WriteMsg(msgGame, nil)
+	c.WriteMsg(msgLogin, []byte("secret"))
+	expect(ch, "welcome")
+	c.WriteMsg(msgGame, nil)
+	expect(ch, string([]byte{msgGame}))
+	expect(ch, "alice")
+	time.Sleep(400 * time.Millisecond)
+	if !c.IsConnected() {
+		t.Fatal("authenticated conn closed by timeout")
+	}
+
+	// 超时没有认证的连接被关闭
+	c2, _ := dial()
+	defer c2.Stop()
+	deadline := time.Now().Add(2 * time.Second)
+	for c2.IsConnected() && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if c2.IsConnected() {
+		t.Fatal("unauthenticated conn not closed")
+	}
+}
+
+func TestAuthTCP(t *testing.T) {
+	testAuth(t, conf.ServerModeTcp)
+}
+
+func TestAuthWebsocket(t *testing.T) {
+	testAuth(t, conf.ServerModeWebsocket)
+}
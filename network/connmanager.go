@@ -2,7 +2,6 @@ package network
 
 import (
 	"errors"
-	"fmt"
 	"gobonbon/iface"
 	"sync"
 )
@@ -13,6 +12,9 @@ import (
 type ConnManager struct {
 	connSet  map[uint64]iface.IConn //管理的连接信息
 	connLock sync.RWMutex           //读写连接的读写锁
+
+	hookLock    sync.RWMutex
+	removeHooks []func(conn iface.IConn) //连接删除时的回调
 }
 
 /*
@@ -31,7 +33,7 @@ func (connMgr *ConnManager) Add(conn iface.IConn) {
 	//将conn连接添加到ConnMananger中
 	connMgr.connSet[conn.GetConnID()] = conn
 	connMgr.connLock.Unlock()
-	fmt.Println("connection add to ConnManager successfully: conn num = ", connMgr.Len())
+	netLog.With("connID", conn.GetConnID(), "connNum", connMgr.Len()).Debug("connection added to ConnManager")
 }
 
 // 删除连接
@@ -39,9 +41,29 @@ func (connMgr *ConnManager) Remove(conn iface.IConn) {
 	//保护共享资源Map 加写锁
 	connMgr.connLock.Lock()
 	//删除连接信息
+	_, ok := connMgr.connSet[conn.GetConnID()]
 	delete(connMgr.connSet, conn.GetConnID())
 	connMgr.connLock.Unlock()
-	fmt.Println("connection Remove ConnID=", conn.GetConnID(), " successfully: conn num = ", connMgr.Len())
+	if !ok {
+		return
+	}
+	netLog.With("connID", conn.GetConnID(), "connNum", connMgr.Len()).Debug("connection removed from ConnManager")
+
+	//不持有锁调用回调，回调中可以继续使用ConnManager
+	connMgr.hookLock.RLock()
+	hooks := connMgr.removeHooks
+	connMgr.hookLock.RUnlock()
+	for _, hook := range hooks {
+		hook(conn)
+	}
+}
+
+// 注册连接删除时的回调，用于清理和连接绑定的数据，比如分组
+// 回调按注册顺序在关闭连接的goroutine中调用，每个连接只调用一次
+func (connMgr *ConnManager) OnRemove(hook func(conn iface.IConn)) {
+	connMgr.hookLock.Lock()
+	connMgr.removeHooks = append(connMgr.removeHooks[:len(connMgr.removeHooks):len(connMgr.removeHooks)], hook)
+	connMgr.hookLock.Unlock()
 }
 
 // 利用ConnID获取链接
@@ -65,32 +87,36 @@ func (connMgr *ConnManager) Len() int {
 	return length
 }
 
+// 获取全部连接
+func (connMgr *ConnManager) All() []iface.IConn {
+	connMgr.connLock.RLock()
+	defer connMgr.connLock.RUnlock()
+	conns := make([]iface.IConn, 0, len(connMgr.connSet))
+	for _, conn := range connMgr.connSet {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
 // 清除并停止所有连接
 func (connMgr *ConnManager) ClearConn() {
-	//保护共享资源Map 加写锁
-	connMgr.connLock.Lock()
-	//停止并删除全部的连接信息
-	for _, conn := range connMgr.connSet {
-		//停止
+	//先复制一份再停止，连接停止时会调用Remove，不能持有锁
+	for _, conn := range connMgr.All() {
 		conn.Stop()
 	}
-	connMgr.connLock.Unlock()
-	fmt.Println("Clear All Connections successfully: conn num = ", connMgr.Len())
+	netLog.With("connNum", connMgr.Len()).Info("all connections cleared")
 }
 
 // ClearOneConn  利用ConnID获取一个链接 并且删除
 func (connMgr *ConnManager) ClearOneConn(connID uint64) {
-	connMgr.connLock.Lock()
-	defer connMgr.connLock.Unlock()
-
-	connections := connMgr.connSet
-	if conn, ok := connections[connID]; ok {
+	conn, err := connMgr.Get(connID)
+	if err == nil {
 		//停止
 		conn.Stop()
 
-		fmt.Println("Clear Connections ID:  ", connID, "succeed")
+		netLog.With("connID", connID).Info("connection cleared")
 		return
 	}
 
-	fmt.Println("Clear Connections ID:  ", connID, "err")
+	netLog.With("connID", connID).Warn("clear connection failed", "err", err)
 }
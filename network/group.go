@@ -0,0 +1,271 @@
+package network
+
+import (
+	"errors"
+	"gobonbon/iface"
+	"gobonbon/msgparser"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrGroupExists    = errors.New("group already exists")
+	ErrGroupDestroyed = errors.New("group destroyed")
+	ErrGroupConnGone  = errors.New("connection not in ConnManager")
+)
+
+/*
+分组管理，游戏房间、聊天频道、公会等一组连接
+
+	room, err := s.GetGroupMgr().Create("room-1")
+	room.Join(conn)
+	room.Broadcast(msgId, data) //只封包一次，发给全部成员
+	s.GetGroupMgr().GroupsOf(conn.GetConnID())
+
+连接关闭时自动退出所在的全部分组，可以在任意goroutine中使用
+*/
+type GroupManager struct {
+	lock       sync.RWMutex
+	groups     map[string]*Group
+	connGroups map[uint64]map[string]*Group //connID -> 所在的分组
+	connMgr    iface.IConnManager
+	msgParser  iface.IMsgParser
+}
+
+// 一个分组，成员的修改都经过GroupManager的锁，保证两个方向的索引一致
+type Group struct {
+	name      string
+	mgr       *GroupManager
+	members   map[uint64]iface.IConn
+	destroyed bool
+}
+
+// 可以直接发送已经封包的数据的连接
+type packetWriter interface {
+	writePacket(msgId uint32, packet []byte) error
+}
+
+/*
+创建分组管理，连接从connMgr中删除时自动退出所在的分组
+msgParser用于广播时封包，需要和连接使用的一致，不是 packetWriter 的连接广播时使用WriteMsg，由连接自己封包
+*/
+func NewGroupManager(connMgr *ConnManager, msgParser iface.IMsgParser) *GroupManager {
+	mgr := &GroupManager{
+		groups:     make(map[string]*Group),
+		connGroups: make(map[uint64]map[string]*Group),
+		connMgr:    connMgr,
+		msgParser:  msgParser,
+	}
+	connMgr.OnRemove(mgr.LeaveAll)
+	return mgr
+}
+
+// 创建分组，名字已经存在时返回 ErrGroupExists
+func (mgr *GroupManager) Create(name string) (*Group, error) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	if _, ok := mgr.groups[name]; ok {
+		return nil, ErrGroupExists
+	}
+	g := &Group{name: name, mgr: mgr, members: make(map[uint64]iface.IConn)}
+	mgr.groups[name] = g
+	return g, nil
+}
+
+// 取得分组，不存在时创建
+func (mgr *GroupManager) GetOrCreate(name string) *Group {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	if g, ok := mgr.groups[name]; ok {
+		return g
+	}
+	g := &Group{name: name, mgr: mgr, members: make(map[uint64]iface.IConn)}
+	mgr.groups[name] = g
+	return g
+}
+
+// 按名字取得分组，不存在时返回nil
+func (mgr *GroupManager) Get(name string) *Group {
+	mgr.lock.RLock()
+	defer mgr.lock.RUnlock()
+	return mgr.groups[name]
+}
+
+// 销毁分组，全部成员退出，之后再Join返回 ErrGroupDestroyed
+func (mgr *GroupManager) Destroy(name string) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	g, ok := mgr.groups[name]
+	if !ok {
+		return
+	}
+	for connID := range g.members {
+		mgr.unlink(connID, g)
+	}
+	g.members = make(map[uint64]iface.IConn)
+	g.destroyed = true
+	delete(mgr.groups, name)
+}
+
+// 全部分组的名字，按名字排序
+func (mgr *GroupManager) Groups() []string {
+	mgr.lock.RLock()
+	defer mgr.lock.RUnlock()
+	names := make([]string, 0, len(mgr.groups))
+	for name := range mgr.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 连接所在的全部分组的名字，按名字排序
+func (mgr *GroupManager) GroupsOf(connID uint64) []string {
+	mgr.lock.RLock()
+	defer mgr.lock.RUnlock()
+	names := make([]string, 0, len(mgr.connGroups[connID]))
+	for name := range mgr.connGroups[connID] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 连接退出所在的全部分组，连接关闭时由ConnManager调用
+func (mgr *GroupManager) LeaveAll(conn iface.IConn) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	connID := conn.GetConnID()
+	for _, g := range mgr.connGroups[connID] {
+		delete(g.members, connID)
+	}
+	delete(mgr.connGroups, connID)
+}
+
+// 从连接的分组索引中删除g，调用时需要持有写锁
+func (mgr *GroupManager) unlink(connID uint64, g *Group) {
+	groups := mgr.connGroups[connID]
+	delete(groups, g.name)
+	if len(groups) == 0 {
+		delete(mgr.connGroups, connID)
+	}
+}
+
+// 分组的名字
+func (g *Group) Name() string {
+	return g.name
+}
+
+/*
+加入分组，重复加入没有影响
+连接已经关闭（不在ConnManager中）时返回 ErrGroupConnGone，
+检查和加入都持有锁，而删除连接的回调也需要这个锁，所以不会留下已经关闭的成员
+*/
+func (g *Group) Join(conn iface.IConn) error {
+	mgr := g.mgr
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	if g.destroyed {
+		return ErrGroupDestroyed
+	}
+	connID := conn.GetConnID()
+	if c, err := mgr.connMgr.Get(connID); err != nil || c != conn {
+		return ErrGroupConnGone
+	}
+	g.members[connID] = conn
+	groups, ok := mgr.connGroups[connID]
+	if !ok {
+		groups = make(map[string]*Group)
+		mgr.connGroups[connID] = groups
+	}
+	groups[g.name] = g
+	return nil
+}
+
+// 退出分组，不在分组中时没有影响
+func (g *Group) Leave(conn iface.IConn) {
+	mgr := g.mgr
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	connID := conn.GetConnID()
+	if _, ok := g.members[connID]; !ok {
+		return
+	}
+	delete(g.members, connID)
+	mgr.unlink(connID, g)
+}
+
+// 连接是否在分组中
+func (g *Group) Has(connID uint64) bool {
+	g.mgr.lock.RLock()
+	defer g.mgr.lock.RUnlock()
+	_, ok := g.members[connID]
+	return ok
+}
+
+// 成员数量
+func (g *Group) Len() int {
+	g.mgr.lock.RLock()
+	defer g.mgr.lock.RUnlock()
+	return len(g.members)
+}
+
+// 全部成员，按connID排序
+func (g *Group) Members() []iface.IConn {
+	g.mgr.lock.RLock()
+	conns := make([]iface.IConn, 0, len(g.members))
+	for _, conn := range g.members {
+		conns = append(conns, conn)
+	}
+	g.mgr.lock.RUnlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].GetConnID() < conns[j].GetConnID() })
+	return conns
+}
+
+// 发给全部成员
+func (g *Group) Broadcast(msgId uint32, data []byte) error {
+	return g.BroadcastExcept(msgId, data, 0)
+}
+
+/*
+发给除exceptConnID之外的全部成员，connID从1开始，exceptConnID为0时发给全部成员
+发送时不持有锁，见 Broadcast
+*/
+func (g *Group) BroadcastExcept(msgId uint32, data []byte, exceptConnID uint64) error {
+	members := g.Members()
+	if exceptConnID != 0 {
+		for i, conn := range members {
+			if conn.GetConnID() == exceptConnID {
+				members = append(members[:i], members[i+1:]...)
+				break
+			}
+		}
+	}
+	return Broadcast(g.mgr.msgParser, members, msgId, data)
+}
+
+/*
+把同一条消息发给多个连接，数据只封包一次
+msgParser需要和连接使用的一致，不是 packetWriter 的连接使用WriteMsg，由连接自己封包
+单个连接发送失败（队列满或已关闭）不影响其他连接，只有封包失败时返回错误
+*/
+func Broadcast(msgParser iface.IMsgParser, conns []iface.IConn, msgId uint32, data []byte) error {
+	if len(conns) == 0 {
+		return nil
+	}
+	packet, err := msgParser.Encode(msgparser.NewMsgPackage(msgId, data))
+	if err != nil {
+		return err
+	}
+	for _, conn := range conns {
+		if w, ok := conn.(packetWriter); ok {
+			err = w.writePacket(msgId, packet)
+		} else {
+			err = conn.WriteMsg(msgId, data)
+		}
+		if err != nil {
+			netLog.With("connID", conn.GetConnID(), "msgId", msgId).Debug("broadcast write error", "err", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package network_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gobonbon/msgparser"
+	"gobonbon/nettest"
+	"gobonbon/network"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroup(t *testing.T) {
+	s := nettest.NewServer()
+	mgr := network.NewGroupManager(s.ConnMgr, msgparser.NewMsgParserWithMaxPacketSize(4096))
+	clients := []*nettest.Conn{s.Connect(), s.Connect(), s.Connect()}
+	conns := s.ConnMgr.All()
+
+	room, err := mgr.Create("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mgr.Create("room"); err != network.ErrGroupExists {
+		t.Fatalf("Create twice = %v", err)
+	}
+	chat := mgr.GetOrCreate("chat")
+	for _, conn := range conns {
+		if err := room.Join(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chat.Join(conns[0])
+	if got := mgr.GroupsOf(conns[0].GetConnID()); !reflect.DeepEqual(got, []string{"chat", "room"}) {
+		t.Fatalf("GroupsOf = %v", got)
+	}
+
+	room.BroadcastExcept(1, []byte("hi"), conns[1].GetConnID())
+	received := 0
+	for _, c := range clients {
+		for _, msg := range c.RecvAll() {
+			if string(msg.GetData()) != "hi" {
+				t.Fatalf("got %q", msg.GetData())
+			}
+			received++
+		}
+	}
+	if received != 2 {
+		t.Fatalf("received %d", received)
+	}
+
+	// 连接关闭后自动退出全部分组，不能再加入
+	conns[0].Stop()
+	if room.Len() != 2 || chat.Len() != 0 || len(mgr.GroupsOf(conns[0].GetConnID())) != 0 {
+		t.Fatalf("room %d chat %d after close", room.Len(), chat.Len())
+	}
+	if err := chat.Join(conns[0]); err != network.ErrGroupConnGone {
+		t.Fatalf("Join closed conn = %v", err)
+	}
+
+	room.Leave(conns[1])
+	if len(room.Members()) != 1 || room.Has(conns[1].GetConnID()) {
+		t.Fatal("Leave failed")
+	}
+	mgr.Destroy("room")
+	if mgr.Get("room") != nil || len(mgr.GroupsOf(conns[2].GetConnID())) != 0 {
+		t.Fatal("Destroy failed")
+	}
+	if err := room.Join(conns[2]); err != network.ErrGroupDestroyed {
+		t.Fatalf("Join destroyed = %v", err)
+	}
+	if got := mgr.Groups(); !reflect.DeepEqual(got, []string{"chat"}) {
+		t.Fatalf("Groups = %v", got)
+	}
+}
+
+/*
+TCP连接直接发送广播时只封包一次的数据，多个goroutine同时加入、退出和广播，用 -race 运行
+每个客户端收到的每个发送者的消息序号递增，最后全部加入后的广播每个客户端都能收到
+*/
+func TestGroupBroadcastTCP(t *testing.T) {
+	const (
+		clients     = 8
+		senders     = 2
+		broadcasts  = 200
+		msgDone     = 99
+		readTimeout = 3 * time.Second
+	)
+	port := freePort(t)
+	s, err := network.NewServer(network.WithHost("127.0.0.1"), network.WithTcpPort(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Stop()
+
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	raws := make([]net.Conn, 0, clients)
+	for len(raws) < clients {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			time.Sleep(20 * time.Millisecond)
+			continue
+		}
+		defer conn.Close()
+		raws = append(raws, conn)
+	}
+	for i := 0; i < 50 && s.GetConnMgr().Len() < clients; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conns := s.GetConnMgr().All()
+	if len(conns) != clients {
+		t.Fatalf("%d conns", len(conns))
+	}
+
+	// 每个客户端读到msgDone为止，检查包的格式和每个发送者的序号
+	errs := make(chan error, clients)
+	for _, raw := range raws {
+		raw := raw
+		go func() {
+			last := make([]int, senders)
+			head := make([]byte, 8)
+			for {
+				raw.SetReadDeadline(time.Now().Add(readTimeout))
+				if _, err := io.ReadFull(raw, head); err != nil {
+					errs <- err
+					return
+				}
+				data := make([]byte, binary.BigEndian.Uint32(head[4:]))
+				if _, err := io.ReadFull(raw, data); err != nil {
+					errs <- err
+					return
+				}
+				msgId := binary.BigEndian.Uint32(head)
+				if msgId == msgDone {
+					errs <- nil
+					return
+				}
+				if msgId != msgGame || len(data) != 5 || int(data[0]) >= senders {
+					errs <- fmt.Errorf("bad packet %d %v", msgId, data)
+					return
+				}
+				seq := int(binary.BigEndian.Uint32(data[1:]))
+				if seq <= last[data[0]] {
+					errs <- errors.New("broadcast out of order")
+					return
+				}
+				last[data[0]] = seq
+			}
+		}()
+	}
+
+	room := s.GetGroupMgr().GetOrCreate("room")
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		i := i
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for seq := 1; seq <= broadcasts; seq++ {
+				data := make([]byte, 5)
+				data[0] = byte(i)
+				binary.BigEndian.PutUint32(data[1:], uint32(seq))
+				if err := room.Broadcast(msgGame, data); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < broadcasts; j++ {
+				conn := conns[(i+j)%clients]
+				if j%2 == 0 {
+					room.Join(conn)
+				} else {
+					room.Leave(conn)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, conn := range conns {
+		if err := room.Join(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := room.Broadcast(msgDone, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < clients; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package network
+
+import (
+	"gobonbon/conf"
+	"gobonbon/iface"
+	"net/http"
+	"time"
+)
+
+// NewServer 的选项
+type Option func(o *serverOptions)
+
+type serverOptions struct {
+	cfg        conf.GlobalObj
+	msgHandler iface.IMsgHandle
+	msgParser  iface.IMsgParser
+
+	authenticators map[uint32]Authenticator
+	authTimeout    time.Duration
+	authWhitelist  []uint32
+	websocketAuth  func(r *http.Request) error
+	sessions       *SessionConfig
+}
+
+// 使用一份完整的配置，会复制cfg，之后修改cfg不影响Server
+// 后面的选项可以继续修改其中的字段
+func WithConfig(cfg *conf.GlobalObj) Option {
+	return func(o *serverOptions) {
+		o.cfg = *cfg
+	}
+}
+
+// 服务器名称
+func WithName(name string) Option {
+	return func(o *serverOptions) {
+		o.cfg.Name = name
+	}
+}
+
+// 监听的IP
+func WithHost(host string) Option {
+	return func(o *serverOptions) {
+		o.cfg.Host = host
+	}
+}
+
+// TCP监听端口
+func WithTcpPort(port int) Option {
+	return func(o *serverOptions) {
+		o.cfg.TcpPort = port
+	}
+}
+
+// websocket监听端口
+func WithWsPort(port int) Option {
+	return func(o *serverOptions) {
+		o.cfg.WsPort = port
+	}
+}
+
+// 服务模式 conf.ServerModeTcp 或 conf.ServerModeWebsocket
+func WithMode(mode string) Option {
+	return func(o *serverOptions) {
+		o.cfg.Mode = mode
+	}
+}
+
+// 最大连接数
+func WithMaxConn(maxConn int) Option {
+	return func(o *serverOptions) {
+		o.cfg.MaxConn = maxConn
+	}
+}
+
+// 数据包的最大长度，0表示不限制
+func WithMaxPacketSize(size uint32) Option {
+	return func(o *serverOptions) {
+		o.cfg.MaxPacketSize = size
+	}
+}
+
+// 每个连接写消息队列的长度
+func WithMaxMsgChanLen(n int) Option {
+	return func(o *serverOptions) {
+		o.cfg.MaxMsgChanLen = n
+	}
+}
+
+// Worker池的数量和每个Worker任务队列的长度
+func WithWorkerPool(size, taskLen uint64) Option {
+	return func(o *serverOptions) {
+		o.cfg.WorkerPoolSize = size
+		o.cfg.MaxWorkerTaskLen = taskLen
+	}
+}
+
+// 开启管理端口，token为空时不校验
+func WithAdmin(host string, port int, token string) Option {
+	return func(o *serverOptions) {
+		o.cfg.AdminHost = host
+		o.cfg.AdminPort = port
+		o.cfg.AdminToken = token
+	}
+}
+
+// 重复登录的处理方式和被挤下线时发给旧连接的消息，见 UserManager
+func WithLoginPolicy(policy string, kickMsgId uint32, kickMsg string) Option {
+	return func(o *serverOptions) {
+		o.cfg.LoginPolicy = policy
+		o.cfg.KickMsgId = kickMsgId
+		o.cfg.KickMsg = kickMsg
+	}
+}
+
+// 使用自己的消息处理模块，不设置时按配置中的Worker池创建 router.MsgHandle
+func WithMsgHandler(msgHandler iface.IMsgHandle) Option {
+	return func(o *serverOptions) {
+		o.msgHandler = msgHandler
+	}
+}
+
+// 使用自己的封包解包，不设置时使用 msgparser.MsgParser 并按配置设置包的最大长度
+func WithMsgParser(msgParser iface.IMsgParser) Option {
+	return func(o *serverOptions) {
+		o.msgParser = msgParser
+	}
+}
+
+/*
+连接认证，msgId为认证消息的ID，timeout内没有通过认证的连接会被关闭，<=0 时不限制
+认证之前只有认证消息和 WithAuthWhitelist 中的消息会被处理，见 Authenticator
+可以使用多次增加多个认证消息，超时使用最后一次的设置
+*/
+func WithAuth(authenticator Authenticator, msgId uint32, timeout time.Duration) Option {
+	return func(o *serverOptions) {
+		if o.authenticators == nil {
+			o.authenticators = make(map[uint32]Authenticator)
+		}
+		o.authenticators[msgId] = authenticator
+		o.authTimeout = timeout
+	}
+}
+
+// 认证之前可以正常路由的消息，比如心跳、版本检查
+func WithAuthWhitelist(msgIds ...uint32) Option {
+	return func(o *serverOptions) {
+		o.authWhitelist = append(o.authWhitelist, msgIds...)
+	}
+}
+
+// websocket升级之前的认证，比如检查url中的token，返回错误时回复401
+func WithWebsocketAuth(auth func(r *http.Request) error) Option {
+	return func(o *serverOptions) {
+		o.websocketAuth = auth
+	}
+}
+
+// 开启会话和断线重连，见 SessionConfig
+func WithSessions(cfg SessionConfig) Option {
+	return func(o *serverOptions) {
+		o.sessions = &cfg
+	}
+}
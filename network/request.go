@@ -1,7 +1,6 @@
 package network
 
 import (
-	"fmt"
 	"gobonbon/iface"
 	"sync"
 )
@@ -66,7 +65,6 @@ func (r *Request) Call() {
 	if r.router == nil {
 		return
 	}
-	fmt.Printf(" server , name %d", 111)
 	for r.steps < HANDLE_OVER {
 		switch r.steps {
 		case PRE_HANDLE:
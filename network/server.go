@@ -4,16 +4,29 @@ import (
 	"fmt"
 	"gobonbon/conf"
 	"gobonbon/iface"
+	"gobonbon/log"
+	"gobonbon/metrics"
+	"gobonbon/module"
 	"gobonbon/msgparser"
 	"gobonbon/router"
 	"gobonbon/util"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// 拒绝连接时发送满员消息的写超时
+const rejectWriteTimeout = 100 * time.Millisecond
+
+// Stop时等待连接结束和请求处理完的最长时间，之后停止模块
+const StopTimeout = 5 * time.Second
+
 type Server struct {
 	Name      string // Name of the server (服务器的名称)
 	IPVersion string //tcp4 or other
@@ -22,11 +35,18 @@ type Server struct {
 	WsPort    int    // 服务绑定的websocket 端口 (Websocket port the server is bound to)
 
 	// (异步捕获链接关闭状态)
-	// exitChan chan struct{}
+	exitChan  chan struct{}
+	stopOnce  sync.Once
+	startTime time.Time    // 服务器创建的时间
+	cfg       atomic.Value // 当前Server的配置 *conf.GlobalObj，热更新时整体替换
 
 	msgHandler iface.IMsgHandle //当前Server的消息管理模块，用来绑定MsgId和对应的处理方法
 	msgParser  iface.IMsgParser
 	ConnMgr    iface.IConnManager //当前Server的链接管理器
+	groupMgr   *GroupManager      //分组管理
+	userMgr    *UserManager       //用户管理，单点登录
+	modules    *module.Manager    //游戏逻辑模块，随Server启动和停止
+	sessionMgr *SessionManager    //会话管理，没有开启时为nil
 
 	// msg parser
 	LenMsgLen    int
@@ -36,34 +56,179 @@ type Server struct {
 
 	cID uint64 // 连接ID
 
+	admission   *Admission          //连接准入控制
+	acceptDelay *util.AcceptDelayer //accept失败时的退避
+	unsubscribe func()              //取消订阅配置热更新
+	global      bool                //跟随全局配置，NewServerWithConfig创建时为true
+	activeConns int64               //StartConn中还没有结束的连接数
+
 	// websocket
 	upgrader *websocket.Upgrader
 	// websocket connection authentication
 	websocketAuth func(r *http.Request) error
+	// 连接建立后的认证，nil时不需要认证
+	auth *authGate
 }
 
+// 网络层的日志，等级可以用 log.SetModuleLevel("network", ...) 单独调整
+var netLog = log.Module("network")
+
+/*
+使用 conf.Get() 创建Server，兼容之前的用法
+配置热更新时跟随全局配置修改可以热更新的字段
+*/
 func NewServerWithConfig() *Server {
-	// conf.GlobalObject.Reload()
-	s := &Server{
-		Name:       conf.GlobalObject.Name,
-		IPVersion:  "tcp",
-		IP:         conf.GlobalObject.Host,
-		Port:       conf.GlobalObject.TcpPort,
-		WsPort:     conf.GlobalObject.WsPort,
-		msgHandler: router.NewMsgHandle(),
-		ConnMgr:    NewConnManager(),
+	if err := conf.LoadError(); err != nil {
+		panic(err)
+	}
+	s, err := NewServer(WithConfig(conf.Get()))
+	if err != nil {
+		panic(err)
 	}
+	s.unsubscribe = conf.Subscribe(s.onConfigChange)
+	s.global = true
 	return s
 }
 
+/*
+创建Server，配置从 conf.DefaultGlobalObj() 开始，按顺序应用opts
+不读取全局配置，同一个进程中可以创建多个不同配置的Server
+
+	s, err := network.NewServer(
+		network.WithName("game"),
+		network.WithTcpPort(8000),
+		network.WithWorkerPool(4, 1024),
+	)
+*/
+func NewServer(opts ...Option) (*Server, error) {
+	o := &serverOptions{cfg: *conf.DefaultGlobalObj()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	cfg := o.cfg
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := applyLogConfig(&cfg); err != nil {
+		return nil, err
+	}
+
+	msgHandler := o.msgHandler
+	if msgHandler == nil {
+		msgHandler = router.NewMsgHandleWithPool(cfg.WorkerPoolSize, cfg.MaxWorkerTaskLen)
+	}
+	msgParser := o.msgParser
+	if msgParser == nil {
+		msgParser = msgparser.NewMsgParserWithMaxPacketSize(cfg.MaxPacketSize)
+	}
+	admission, err := NewAdmission(cfg.MaxConn, cfg.MaxConnPerIP, cfg.MaxAcceptRate, cfg.AcceptBurst, cfg.AllowCIDR, cfg.DenyCIDR)
+	if err != nil {
+		return nil, err
+	}
+
+	connMgr := NewConnManager()
+	s := &Server{
+		Name:        cfg.Name,
+		IPVersion:   "tcp",
+		IP:          cfg.Host,
+		Port:        cfg.TcpPort,
+		WsPort:      cfg.WsPort,
+		msgHandler:  msgHandler,
+		msgParser:   msgParser,
+		ConnMgr:     connMgr,
+		groupMgr:    NewGroupManager(connMgr, msgParser),
+		userMgr:     NewUserManager(connMgr),
+		modules:     module.NewManager(),
+		exitChan:    make(chan struct{}),
+		startTime:   time.Now(),
+		admission:   admission,
+		acceptDelay: util.NewAcceptDelay(),
+		unsubscribe: func() {},
+	}
+	s.auth = newAuthGate(o.authenticators, o.authTimeout, o.authWhitelist)
+	s.websocketAuth = o.websocketAuth
+	s.cfg.Store(&cfg)
+	s.userMgr.SetPolicy(cfg.LoginPolicy)
+	s.userMgr.SetKickMsg(cfg.KickMsgId, []byte(cfg.KickMsg))
+	if o.sessions != nil {
+		s.EnableSessions(*o.sessions)
+	}
+	return s, nil
+}
+
+// 当前Server使用的配置，不要修改返回的对象
+func (s *Server) Config() *conf.GlobalObj {
+	return s.cfg.Load().(*conf.GlobalObj)
+}
+
+// 日志是全局的，配置中不为空的日志设置会修改全局日志
+func applyLogConfig(cfg *conf.GlobalObj) error {
+	if cfg.LogFormat != "" {
+		if err := log.SetFormat(cfg.LogFormat); err != nil {
+			return err
+		}
+	}
+	if cfg.LogLevel != "" {
+		if err := log.SetLevel(cfg.LogLevel); err != nil {
+			return err
+		}
+	}
+	if len(cfg.LogModules) > 0 {
+		if err := log.SetModuleLevels(cfg.LogModules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 配置热更新：换成新的配置，再修改日志设置、准入限制、重复登录的处理和包的最大长度
+func (s *Server) onConfigChange(changes []conf.Change) {
+	cfg := *conf.Get()
+	s.cfg.Store(&cfg)
+	g := &cfg
+	for _, c := range changes {
+		var err error
+		switch c.Field {
+		case "LogFormat":
+			if g.LogFormat != "" {
+				err = log.SetFormat(g.LogFormat)
+			}
+		case "LogLevel":
+			if g.LogLevel != "" {
+				err = log.SetLevel(g.LogLevel)
+			}
+		case "LogModules":
+			err = log.SetModuleLevels(g.LogModules)
+		case "MaxConn", "MaxConnPerIP", "MaxAcceptRate", "AcceptBurst", "AllowCIDR", "DenyCIDR":
+			err = s.admission.SetLimits(g.MaxConn, g.MaxConnPerIP, g.MaxAcceptRate, g.AcceptBurst, g.AllowCIDR, g.DenyCIDR)
+		case "LoginPolicy":
+			s.userMgr.SetPolicy(g.LoginPolicy)
+		case "KickMsgId", "KickMsg":
+			s.userMgr.SetKickMsg(g.KickMsgId, []byte(g.KickMsg))
+		case "MaxPacketSize":
+			if p, ok := s.msgParser.(interface{ SetMaxPacketSize(uint32) }); ok {
+				p.SetMaxPacketSize(g.MaxPacketSize)
+			}
+		}
+		if err != nil {
+			netLog.With("field", c.Field, "err", err).Error("apply config change failed")
+		}
+	}
+}
+
 // (开启网络服务)
 func (s *Server) Start() {
+	// (按注册顺序启动游戏逻辑模块，在接受连接之前完成OnInit)
+	s.modules.Init()
 	// (启动worker工作池机制)
 	s.msgHandler.StartWorkerPool()
+	// (开启管理端口)
+	if s.Config().AdminPort > 0 {
+		go s.ListenAdmin()
+	}
 	// (开启一个go去做服务端Listener业务)
-	switch conf.GlobalObject.Mode {
+	switch s.Config().Mode {
 	case conf.ServerModeTcp:
-		fmt.Printf(" server , name %d", 11)
 		go s.ListenTcpConn()
 	case conf.ServerModeWebsocket:
 		go s.ListenWebsocketConn()
@@ -73,71 +238,137 @@ func (s *Server) Start() {
 }
 
 // Stop stops the server (停止服务)
+// 关闭全部监听，再停止全部连接，可以重复调用
 func (s *Server) Stop() {
-	fmt.Printf("[STOP] Zinx server , name %s", s.Name)
-	// (将其他需要清理的连接信息或者其他信息 也要一并停止或者清理)
-	s.ConnMgr.ClearConn()
+	s.stopOnce.Do(func() {
+		netLog.With("name", s.Name).Info("server stopping")
+		s.unsubscribe()
+		close(s.exitChan)
+		// (将其他需要清理的连接信息或者其他信息 也要一并停止或者清理)
+		s.ConnMgr.ClearConn()
+		// (连接全部停止、已经收到的请求处理完之后按相反顺序停止模块)
+		s.waitDrain(StopTimeout)
+		s.modules.Destroy()
+	})
+}
+
+/*
+等待连接结束和任务队列中的请求处理完，最多等timeout
+连接结束包括finalizer和ConnManager的OnRemove回调，超时后打印日志，不再等待
+*/
+func (s *Server) waitDrain(timeout time.Duration) {
+	mh, _ := s.msgHandler.(*router.MsgHandle)
+	deadline := time.Now().Add(timeout)
+	for {
+		conns := atomic.LoadInt64(&s.activeConns)
+		pending := 0
+		if mh != nil {
+			pending = mh.Pending()
+		}
+		if conns == 0 && pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			netLog.With("name", s.Name, "connNum", conns, "pending", pending).Warn("stop timeout, destroy modules anyway")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Serve 启动服务器并阻塞，直到Stop
+func (s *Server) Serve() {
+	s.Start()
+	<-s.exitChan
+}
+
+// 服务器停止时关闭的channel
+func (s *Server) Done() <-chan struct{} {
+	return s.exitChan
 }
 
 func (s *Server) ListenTcpConn() {
-	fmt.Printf(" server , name %d", 11)
 	// 1. Get a TCP address
 	addr, err := net.ResolveTCPAddr(s.IPVersion, fmt.Sprintf("%s:%d", s.IP, s.Port))
 	if err != nil {
-		fmt.Printf("[START] resolve tcp addr err: %v\n", err)
+		netLog.With("name", s.Name).Error("resolve tcp addr error", "err", err)
 		return
 	}
 	listener, err := net.ListenTCP(s.IPVersion, addr)
 	if err != nil {
-		fmt.Printf("[ListenTCP is err: %v\n", err)
+		netLog.With("name", s.Name).Error("listen tcp error", "err", err)
 		panic(err)
 	}
-
-	msgParser := msgparser.NewMsgParser()
-
-	s.msgParser = msgParser
+	netLog.With("name", s.Name, "addr", addr.String()).Info("tcp server listening")
 
 	go func() {
 		for {
-			//设置服务器最大连接控制,如果超过最大连接，那么则关闭此新的连接
-			if s.ConnMgr.Len() >= conf.GlobalObject.MaxConn {
-				continue
-			}
 			// (阻塞等待客户端建立连接请求)
 			conn, err := listener.AcceptTCP()
 			if err != nil {
+				select {
+				case <-s.exitChan:
+					return
+				default:
+				}
+				netLog.With("name", s.Name).Warn("accept error", "err", err, "retryIn", s.acceptDelay.Duration())
+				s.acceptDelay.Delay()
 				continue
 			}
+			s.acceptDelay.Reset()
+
+			//准入控制，不满足条件的连接先接受再立即关闭，不在这里空转
+			if err := s.admission.Admit(conn.RemoteAddr()); err != nil {
+				metrics.ConnRejected.WithLabelValues(rejectReason(err)).Inc()
+				go s.rejectTcpConn(conn, err)
+				continue
+			}
+			metrics.ConnAccepted.Inc()
 
 			newCid := atomic.AddUint64(&s.cID, 1)
-			fmt.Println("555")
-			dealConn := newTcpConn(s, conn, newCid, s.msgParser, s.msgHandler)
-			fmt.Println("555")
+			dealConn := newTcpConn(s, conn, newCid, s.msgParser, s.msgHandler, s.Config())
+			dealConn.startAuth(dealConn, s.auth)
 			go s.StartConn(dealConn)
 		}
 	}()
 
-	select {}
+	<-s.exitChan
+	listener.Close()
 }
 
 func (s *Server) ListenWebsocketConn() {
-	fmt.Printf(" server , name %d", 11)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// (设置服务器最大连接控制,如果超过最大连接，则等待)
-		fmt.Printf(" server , name %d", 111)
-		if s.ConnMgr.Len() >= conf.GlobalObject.MaxConn {
-			fmt.Printf("Exceeded the maxConnNum:%d, Wait:%d", conf.GlobalObject.MaxConn, util.AcceptDelay)
-			util.AcceptDelay.Delay()
+	if s.upgrader == nil {
+		s.upgrader = &websocket.Upgrader{
+			ReadBufferSize:  int(s.Config().MaxPacketSize),
+			WriteBufferSize: int(s.Config().MaxPacketSize),
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// (准入控制，不满足条件的请求直接返回错误，不升级连接)
+		remoteAddr, err := wsRemoteAddr(r)
+		if err != nil {
+			netLog.With("remote", r.RemoteAddr).Info("reject websocket conn", "reason", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := s.admission.Admit(remoteAddr); err != nil {
+			metrics.ConnRejected.WithLabelValues(rejectReason(err)).Inc()
+			netLog.With("remote", r.RemoteAddr).Info("reject websocket conn", "reason", err)
+			s.rejectWsConn(w, err)
 			return
 		}
-		fmt.Printf(" server , name %d", 1111)
 		// (如果需要 websocket 认证请设置认证信息)
 		if s.websocketAuth != nil {
 			err := s.websocketAuth(r)
 			if err != nil {
-				fmt.Printf(" websocket auth err:%v", err)
+				netLog.With("remote", r.RemoteAddr).Info("websocket auth error", "err", err)
+				s.admission.Release(remoteAddr)
 				w.WriteHeader(401)
-				util.AcceptDelay.Delay()
+				s.acceptDelay.Delay()
 				return
 			}
 		}
@@ -145,34 +376,119 @@ func (s *Server) ListenWebsocketConn() {
 		// (升级成 websocket 连接)
 		conn, err := s.upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			w.WriteHeader(500)
-			util.AcceptDelay.Delay()
+			s.admission.Release(remoteAddr)
+			s.acceptDelay.Delay()
 			return
 		}
-		fmt.Printf(" server , name %d", 22)
-		util.AcceptDelay.Reset()
+		s.acceptDelay.Reset()
+		metrics.ConnAccepted.Inc()
 		// 5. 处理该新连接请求的 业务 方法， 此时应该有 handler 和 conn是绑定的
 		newCid := atomic.AddUint64(&s.cID, 1)
-		wsConn := newWebsocketConn(s, conn, newCid)
-		fmt.Printf(" server , name %d", newCid)
+		wsConn := newWebsocketConn(s, conn, newCid, s.msgParser, s.Config())
+		wsConn.startAuth(wsConn, s.auth)
 		go s.StartConn(wsConn)
 	})
 
-	err := http.ListenAndServe(fmt.Sprintf("%s:%d", s.IP, s.WsPort), nil)
-	if err != nil {
+	httpServer := &http.Server{Addr: fmt.Sprintf("%s:%d", s.IP, s.WsPort), Handler: mux}
+	netLog.With("name", s.Name, "addr", httpServer.Addr).Info("websocket server listening")
+	go func() {
+		<-s.exitChan
+		httpServer.Close()
+	}()
+	err := httpServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		panic(err)
 	}
 }
 
 func (s *Server) StartConn(conn iface.IConn) {
-	// 开始处理当前连接的业务
+	// 开始处理当前连接的业务，Start会阻塞到连接结束
+	atomic.AddInt64(&s.activeConns, 1)
+	defer atomic.AddInt64(&s.activeConns, -1)
+	metrics.ConnActive.Inc()
 	conn.Start()
+	metrics.ConnActive.Dec()
+	// 连接结束，归还准入名额
+	s.admission.Release(conn.RemoteAddr())
+}
+
+// 满员消息只发给因为连接数被拒绝的连接，黑名单和接入速率的拒绝直接关闭
+func isFull(reason error) bool {
+	return reason == ErrServerFull || reason == ErrTooManyFromIP
+}
+
+// 拒绝一个TCP连接：如果是满员并且配置了满员消息则先发送，然后关闭
+func (s *Server) rejectTcpConn(conn *net.TCPConn, reason error) {
+	defer conn.Close()
+	netLog.With("remote", conn.RemoteAddr().String()).Info("reject tcp conn", "reason", reason)
+	cfg := s.Config()
+	if !isFull(reason) || cfg.FullMsg == "" {
+		return
+	}
+	data, err := s.msgParser.Encode(msgparser.NewMsgPackage(cfg.FullMsgId, []byte(cfg.FullMsg)))
+	if err != nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	conn.Write(data)
+}
+
+// 拒绝一个websocket请求
+func (s *Server) rejectWsConn(w http.ResponseWriter, reason error) {
+	switch reason {
+	case ErrConnDenied:
+		w.WriteHeader(http.StatusForbidden)
+		return
+	case ErrAcceptRate:
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	fullMsg := s.Config().FullMsg
+	if fullMsg == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, fullMsg, http.StatusServiceUnavailable)
+}
+
+// 从http请求中取出远端地址，不是 IP:端口 时返回错误，不能和其他请求共用同一个单IP名额
+func wsRemoteAddr(r *http.Request) (net.Addr, error) {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	var zone string
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid remote ip %q", host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: p, Zone: zone}, nil
 }
 
 // 路由功能：给当前服务注册一个路由业务方法，供客户端链接处理使用
 func (s *Server) AddRouter(msgId uint32, router iface.IRouter) {
 	s.msgHandler.AddRouter(msgId, router)
-	fmt.Println("Add Router succ! ")
+	netLog.With("msgId", msgId).Debug("add router succ")
+}
+
+// 给一段MsgId [min, max] 注册同一个路由，比如网关把一段消息转发给后端节点，见 cluster.Cluster.Forward
+// 消息处理模块需要支持 AddRouterRange，比如 router.MsgHandle
+func (s *Server) AddRouterRange(min, max uint32, router iface.IRouter) {
+	mh, ok := s.msgHandler.(interface {
+		AddRouterRange(min, max uint32, router iface.IRouter)
+	})
+	if !ok {
+		panic("msg handler does not support AddRouterRange")
+	}
+	mh.AddRouterRange(min, max, router)
+	netLog.With("min", min, "max", max).Debug("add router range succ")
 }
 
 // GetConnMgr 得到链接管理
@@ -180,6 +496,73 @@ func (s *Server) GetConnMgr() iface.IConnManager {
 	return s.ConnMgr
 }
 
+/*
+增加一个认证消息，需要在Start之前调用，见 Authenticator 和 WithAuth
+msgId为认证消息的ID，timeout内没有通过认证的连接会被关闭，<=0 时不限制，whitelist为认证前可以路由的消息
+*/
+func (s *Server) SetAuth(authenticator Authenticator, msgId uint32, timeout time.Duration, whitelist ...uint32) {
+	authenticators := map[uint32]Authenticator{msgId: authenticator}
+	if s.auth != nil {
+		for id, a := range s.auth.authenticators {
+			authenticators[id] = a
+		}
+		for id := range s.auth.whitelist {
+			whitelist = append(whitelist, id)
+		}
+	}
+	s.auth = newAuthGate(authenticators, timeout, whitelist)
+}
+
+// 设置websocket升级之前的认证，比如检查url中的token，返回错误时回复401，需要在Start之前调用
+func (s *Server) SetWebsocketAuth(auth func(r *http.Request) error) {
+	s.websocketAuth = auth
+}
+
+/*
+开启会话和断线重连，需要在Start之前调用，返回会话管理
+设置了ResumeMsgId时：使用认证则作为一个认证消息，否则注册为路由；设置了AckMsgId时注册确认消息的路由
+*/
+func (s *Server) EnableSessions(cfg SessionConfig) *SessionManager {
+	connMgr, ok := s.ConnMgr.(*ConnManager)
+	if !ok {
+		panic("sessions need network.ConnManager")
+	}
+	mgr := NewSessionManager(connMgr, s.msgParser, cfg)
+	cfg = mgr.Config()
+	if cfg.ResumeMsgId != 0 {
+		if s.auth != nil {
+			s.SetAuth(mgr.ResumeAuthenticator(), cfg.ResumeMsgId, s.auth.timeout)
+		} else {
+			s.AddRouter(cfg.ResumeMsgId, &resumeRouter{mgr: mgr})
+		}
+	}
+	if cfg.AckMsgId != 0 {
+		s.AddRouter(cfg.AckMsgId, &ackRouter{})
+	}
+	s.sessionMgr = mgr
+	return mgr
+}
+
+// 会话管理，没有开启时返回nil
+func (s *Server) GetSessionMgr() *SessionManager {
+	return s.sessionMgr
+}
+
+// 用户管理，登录成功后用 BindUser 绑定连接，重复登录按配置的 LoginPolicy 处理
+func (s *Server) GetUserMgr() *UserManager {
+	return s.userMgr
+}
+
+// 注册游戏逻辑模块，需要在Start之前调用，见 module.Module
+func (s *Server) RegisterModule(mi module.Module) {
+	s.modules.Register(mi)
+}
+
+// 分组管理，房间、频道等
+func (s *Server) GetGroupMgr() *GroupManager {
+	return s.groupMgr
+}
+
 func (s *Server) ServerName() string {
 	return s.Name
 }
@@ -187,3 +570,8 @@ func (s *Server) ServerName() string {
 func (s *Server) GetMsgHandler() iface.IMsgHandle {
 	return s.msgHandler
 }
+
+// 封包解包，广播时用来只封包一次
+func (s *Server) GetMsgParser() iface.IMsgParser {
+	return s.msgParser
+}
@@ -0,0 +1,94 @@
+package network_test
+
+import (
+	"gobonbon/iface"
+	"gobonbon/module"
+	"gobonbon/msgparser"
+	"gobonbon/network"
+	"gobonbon/router"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 记分模块，处理方法在模块的goroutine中执行
+type scoreModule struct {
+	*module.Skeleton
+}
+
+func (m *scoreModule) OnInit() {
+	m.RegisterChanRPC("Score", func(args []interface{}) (interface{}, error) {
+		return args[0], nil
+	})
+}
+
+func (m *scoreModule) OnDestroy() {}
+
+// 处理消息时调用模块，处理的过程中服务器开始停止
+type slowScoreRouter struct {
+	router.BaseRouter
+	game    *scoreModule
+	started chan struct{}
+	errs    chan error
+}
+
+func (r *slowScoreRouter) Handle(req iface.IRequest) {
+	close(r.started)
+	time.Sleep(100 * time.Millisecond)
+	_, err := r.game.ChanRPC().Call("Score", 1)
+	r.errs <- err
+}
+
+// Stop等连接结束、OnRemove回调和正在处理的请求完成之后才停止模块
+func TestStopDrainsBeforeModules(t *testing.T) {
+	port := freePort(t)
+	s, err := network.NewServer(network.WithHost("127.0.0.1"), network.WithTcpPort(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	game := &scoreModule{Skeleton: module.NewSkeleton()}
+	s.RegisterModule(game)
+	r := &slowScoreRouter{game: game, started: make(chan struct{}), errs: make(chan error, 2)}
+	s.AddRouter(msgGame, r)
+	s.GetConnMgr().(*network.ConnManager).OnRemove(func(conn iface.IConn) {
+		_, err := game.ChanRPC().Call("Score", 2)
+		r.errs <- err
+	})
+	s.Start()
+
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packet, _ := msgparser.NewMsgParserWithMaxPacketSize(4096).Encode(msgparser.NewMsgPackage(msgGame, nil))
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-r.started:
+	case <-time.After(time.Second):
+		t.Fatal("handler not called")
+	}
+
+	s.Stop()
+	// Stop返回时处理方法和OnRemove回调都已经调用完模块
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-r.errs:
+			if err != nil {
+				t.Fatalf("module call during stop: %v", err)
+			}
+		default:
+			t.Fatalf("only %d module calls finished before Stop returned", i)
+		}
+	}
+}
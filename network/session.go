@@ -0,0 +1,592 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"gobonbon/iface"
+	"gobonbon/msgparser"
+	"gobonbon/router"
+	"gobonbon/util"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrSessionNotFound    = errors.New("session not found or expired")
+	ErrSessionReplayLost  = errors.New("session messages to replay already dropped")
+	ErrSessionBadSeq      = errors.New("session seq ahead of server")
+	ErrSessionUnsupported = errors.New("connection does not support sessions")
+	ErrBadResumeData      = errors.New("bad resume data")
+)
+
+/*
+会话：断线后保留一段时间，客户端用令牌重连后继续使用，中间漏掉的消息按顺序重发
+
+	s, err := network.NewServer(
+		network.WithAuth(network.AuthFunc(login), MsgLogin, 10*time.Second),
+		network.WithSessions(network.SessionConfig{Grace: time.Minute, BufferSize: 256, ResumeMsgId: MsgResume, AckMsgId: MsgAck}),
+	)
+	func login(req iface.IRequest) (interface{}, error) {
+		...
+		sess, err := s.GetSessionMgr().Create(req.GetConnection(), userID)
+		req.GetConnection().WriteMsg(MsgLoginOk, []byte(sess.Token())) //这是会话的第1条消息
+		return userID, nil
+	}
+
+消息序号：会话创建之后，连接上发出的每一条消息按顺序编号，从1开始，
+客户端收到一条消息序号加1，定时用AckMsgId发送已经收到的序号（8字节大端序），服务器据此删除缓存；
+断线后客户端重新连接，用ResumeMsgId发送 EncodeResume(token, 收到的最后一个序号)，
+服务器先回复ResumeMsgId（8字节大端序的服务器最后一个序号，失败时为空），这条回复不编号，
+再按顺序重发客户端没有收到的消息，之后的消息继续编号。
+断线期间用 Session.WriteMsg 发送的消息直接进入缓存，重连后一起重发；
+缓存超过BufferSize时丢弃最早的消息，需要它们的重连会失败，客户端需要重新登录。
+重发时等待新连接的发送队列有空位，缓存可以比 MaxMsgChanLen 大，全部重发超过 ResumeWriteTimeout 时重连失败。
+*/
+type SessionConfig struct {
+	Grace       time.Duration //断线后保留会话的时间
+	BufferSize  int           //最多缓存的没有确认的消息数量
+	ResumeMsgId uint32        //断线重连的请求和回复，为0时不处理
+	AckMsgId    uint32        //客户端确认收到的消息，为0时只在重连时确认
+}
+
+var DefaultSessionConfig = SessionConfig{Grace: time.Minute, BufferSize: 256}
+
+// 重连时全部重发的消息进入新连接发送队列的最长时间
+const ResumeWriteTimeout = 5 * time.Second
+
+// 可以等待发送队列空位的连接，重发时使用，TCPConn和WsConnection实现
+type replayWriter interface {
+	writePacketTimeout(msgId uint32, packet []byte, timeout time.Duration) error
+}
+
+// 会话在连接属性中的key
+const SessionKey = "gobonbon.session"
+
+// 可以观察发出的每一条消息的连接，会话用来给消息编号和缓存
+type SendObservable interface {
+	// 设置之后每一条成功进入发送队列的消息都会按发送顺序通知fn，fn为nil时取消
+	SetSendObserver(fn func(msgId uint32, packet []byte))
+}
+
+// 发送观察者，嵌入到TCPConn和WsConnection中
+type sendObserver struct {
+	sendLock sync.Mutex
+	observer atomic.Value //observerFunc
+}
+
+type observerFunc struct {
+	fn func(msgId uint32, packet []byte)
+}
+
+func (o *sendObserver) SetSendObserver(fn func(msgId uint32, packet []byte)) {
+	o.sendLock.Lock()
+	o.observer.Store(observerFunc{fn})
+	o.sendLock.Unlock()
+}
+
+// 有观察者时加锁并返回观察者，没有时返回nil，需要和unlockObserver成对调用
+func (o *sendObserver) lockObserver() func(msgId uint32, packet []byte) {
+	if f, _ := o.observer.Load().(observerFunc); f.fn == nil {
+		return nil
+	}
+	o.sendLock.Lock()
+	f, _ := o.observer.Load().(observerFunc)
+	if f.fn == nil {
+		o.sendLock.Unlock()
+	}
+	return f.fn
+}
+
+func (o *sendObserver) unlockObserver(fn func(msgId uint32, packet []byte)) {
+	if fn != nil {
+		o.sendLock.Unlock()
+	}
+}
+
+// 缓存的一条消息
+type sessionMsg struct {
+	seq    uint64
+	msgId  uint32
+	packet []byte
+}
+
+// 一个会话，属性在重连之后保留
+type Session struct {
+	util.ConnProperty
+
+	mgr      *SessionManager
+	id       uint64
+	token    string
+	identity interface{}
+
+	lock   sync.Mutex
+	conn   iface.IConn  //当前的连接，断线期间为nil
+	seq    uint64       //最后一条消息的序号
+	buffer []sessionMsg //没有确认的消息，按序号排列
+	timer  *time.Timer  //断线后的过期计时
+	closed bool
+}
+
+// 会话管理
+type SessionManager struct {
+	cfg       SessionConfig
+	msgParser iface.IMsgParser
+	sessionID uint64
+
+	lock     sync.RWMutex
+	sessions map[string]*Session //token -> 会话
+
+	hookLock sync.RWMutex
+	onResume []func(sess *Session, conn iface.IConn)
+	onExpire []func(sess *Session)
+}
+
+/*
+创建会话管理，连接从connMgr中删除时会话进入断线状态，Grace之后过期
+msgParser用于断线期间缓存消息时封包，需要和连接使用的一致
+*/
+func NewSessionManager(connMgr *ConnManager, msgParser iface.IMsgParser, cfg SessionConfig) *SessionManager {
+	if cfg.Grace <= 0 {
+		cfg.Grace = DefaultSessionConfig.Grace
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = DefaultSessionConfig.BufferSize
+	}
+	mgr := &SessionManager{
+		cfg:       cfg,
+		msgParser: msgParser,
+		sessions:  make(map[string]*Session),
+	}
+	connMgr.OnRemove(mgr.detach)
+	return mgr
+}
+
+// 会话的设置
+func (mgr *SessionManager) Config() SessionConfig {
+	return mgr.cfg
+}
+
+// 注册重连成功的回调，比如重新加入分组；回调在重发完消息之后调用
+func (mgr *SessionManager) OnResume(fn func(sess *Session, conn iface.IConn)) {
+	mgr.hookLock.Lock()
+	mgr.onResume = append(mgr.onResume[:len(mgr.onResume):len(mgr.onResume)], fn)
+	mgr.hookLock.Unlock()
+}
+
+// 注册会话过期或关闭的回调，比如保存玩家数据
+func (mgr *SessionManager) OnExpire(fn func(sess *Session)) {
+	mgr.hookLock.Lock()
+	mgr.onExpire = append(mgr.onExpire[:len(mgr.onExpire):len(mgr.onExpire)], fn)
+	mgr.hookLock.Unlock()
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+/*
+为登录成功的连接创建会话，之后这个连接上发出的消息开始编号
+连接已经有会话时关闭之前的会话；连接需要实现 SendObservable
+*/
+func (mgr *SessionManager) Create(conn iface.IConn, identity interface{}) (*Session, error) {
+	observable, ok := conn.(SendObservable)
+	if !ok {
+		return nil, ErrSessionUnsupported
+	}
+	if old := SessionOf(conn); old != nil {
+		old.Close()
+	}
+	sess := &Session{
+		mgr:      mgr,
+		id:       atomic.AddUint64(&mgr.sessionID, 1),
+		token:    newToken(),
+		identity: identity,
+		conn:     conn,
+	}
+	mgr.lock.Lock()
+	mgr.sessions[sess.token] = sess
+	mgr.lock.Unlock()
+	conn.SetProperty(SessionKey, sess)
+	observable.SetSendObserver(sess.observer(conn))
+	netLog.With("sessionID", sess.id, "connID", conn.GetConnID()).Debug("session created")
+	return sess, nil
+}
+
+// 按令牌查找会话
+func (mgr *SessionManager) Get(token string) *Session {
+	mgr.lock.RLock()
+	defer mgr.lock.RUnlock()
+	return mgr.sessions[token]
+}
+
+// 会话数量，包括断线中的会话
+func (mgr *SessionManager) Len() int {
+	mgr.lock.RLock()
+	defer mgr.lock.RUnlock()
+	return len(mgr.sessions)
+}
+
+// 连接当前的会话，没有时返回nil
+func SessionOf(conn iface.IConn) *Session {
+	v, err := conn.GetProperty(SessionKey)
+	if err != nil {
+		return nil
+	}
+	sess, _ := v.(*Session)
+	return sess
+}
+
+/*
+用令牌把新的连接绑定到会话，lastSeq为客户端收到的最后一个序号
+先回复ResumeMsgId，再按顺序重发lastSeq之后的消息
+旧的连接还没有断开时会被关闭
+*/
+func (mgr *SessionManager) Resume(conn iface.IConn, token string, lastSeq uint64) (*Session, error) {
+	observable, ok := conn.(SendObservable)
+	if !ok {
+		return nil, ErrSessionUnsupported
+	}
+	sess := mgr.Get(token)
+	if sess == nil {
+		return nil, ErrSessionNotFound
+	}
+	if prev := SessionOf(conn); prev == sess {
+		//在同一个连接上重复重连，只需要确认
+		sess.Ack(lastSeq)
+		return sess, nil
+	} else if prev != nil {
+		//连接属于另一个会话，先解除，重发时不能经过别的会话的观察者
+		observable.SetSendObserver(nil)
+		conn.RemoveProperty(SessionKey)
+	}
+
+	sess.lock.Lock()
+	if sess.closed {
+		sess.lock.Unlock()
+		return nil, ErrSessionNotFound
+	}
+	if lastSeq > sess.seq {
+		sess.lock.Unlock()
+		return nil, ErrSessionBadSeq
+	}
+	first := sess.seq + 1
+	if len(sess.buffer) > 0 {
+		first = sess.buffer[0].seq
+	}
+	if lastSeq+1 < first {
+		sess.lock.Unlock()
+		return nil, ErrSessionReplayLost
+	}
+	sess.ack(lastSeq)
+	old := sess.conn
+	sess.conn = conn
+	if sess.timer != nil {
+		sess.timer.Stop()
+		sess.timer = nil
+	}
+
+	//回复和重发的消息不经过观察者，重发之后才开始给新的消息编号
+	//持有会话的锁，其他goroutine发给会话的消息排在重发的消息之后
+	reply := make([]byte, 8)
+	binary.BigEndian.PutUint64(reply, sess.seq)
+	deadline := time.Now().Add(ResumeWriteTimeout)
+	err := conn.WriteMsg(mgr.cfg.ResumeMsgId, reply)
+	for i := 0; err == nil && i < len(sess.buffer); i++ {
+		err = mgr.replayPacket(conn, sess.buffer[i].msgId, sess.buffer[i].packet, time.Until(deadline))
+	}
+	if err != nil {
+		//新的连接不可用，恢复之前的状态
+		sess.conn = old
+		if old == nil {
+			sess.startExpire()
+		}
+		sess.lock.Unlock()
+		return nil, err
+	}
+	conn.SetProperty(SessionKey, sess)
+	observable.SetSendObserver(sess.observer(conn))
+	sess.lock.Unlock()
+
+	if old != nil && old != conn {
+		old.RemoveProperty(SessionKey)
+		old.Stop()
+	}
+	netLog.With("sessionID", sess.id, "connID", conn.GetConnID(), "lastSeq", lastSeq).Info("session resumed")
+
+	mgr.hookLock.RLock()
+	hooks := mgr.onResume
+	mgr.hookLock.RUnlock()
+	for _, fn := range hooks {
+		fn(sess, conn)
+	}
+	return sess, nil
+}
+
+// 发送已经封包的数据，不是 packetWriter 的连接去掉包头后用WriteMsg
+func (mgr *SessionManager) writePacket(conn iface.IConn, msgId uint32, packet []byte) error {
+	if w, ok := conn.(packetWriter); ok {
+		return w.writePacket(msgId, packet)
+	}
+	return conn.WriteMsg(msgId, packet[mgr.msgParser.GetHeadLen():])
+}
+
+// 重发一条缓存的消息，发送队列满时等待，最多等到timeout
+func (mgr *SessionManager) replayPacket(conn iface.IConn, msgId uint32, packet []byte, timeout time.Duration) error {
+	if w, ok := conn.(replayWriter); ok {
+		return w.writePacketTimeout(msgId, packet, timeout)
+	}
+	return mgr.writePacket(conn, msgId, packet)
+}
+
+// 连接关闭，会话进入断线状态
+func (mgr *SessionManager) detach(conn iface.IConn) {
+	sess := SessionOf(conn)
+	if sess == nil {
+		return
+	}
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	if sess.conn != conn || sess.closed {
+		return
+	}
+	sess.conn = nil
+	sess.startExpire()
+	netLog.With("sessionID", sess.id, "connID", conn.GetConnID()).Debug("session detached")
+}
+
+// 删除会话并通知过期的回调
+func (mgr *SessionManager) remove(sess *Session) {
+	mgr.lock.Lock()
+	delete(mgr.sessions, sess.token)
+	mgr.lock.Unlock()
+
+	mgr.hookLock.RLock()
+	hooks := mgr.onExpire
+	mgr.hookLock.RUnlock()
+	for _, fn := range hooks {
+		fn(sess)
+	}
+}
+
+/*
+断线重连的Authenticator，配合 WithAuth 使用，认证的身份为会话创建时的身份
+WithSessions 设置了ResumeMsgId时自动注册
+*/
+func (mgr *SessionManager) ResumeAuthenticator() Authenticator {
+	return AuthFunc(func(req iface.IRequest) (interface{}, error) {
+		token, lastSeq, err := DecodeResume(req.GetData())
+		if err == nil {
+			var sess *Session
+			if sess, err = mgr.Resume(req.GetConnection(), token, lastSeq); err == nil {
+				return sess.identity, nil
+			}
+		}
+		req.GetConnection().WriteMsg(mgr.cfg.ResumeMsgId, nil)
+		return nil, err
+	})
+}
+
+// 处理断线重连请求的路由，不使用认证时使用
+type resumeRouter struct {
+	router.BaseRouter
+	mgr *SessionManager
+}
+
+func (r *resumeRouter) Handle(req iface.IRequest) {
+	if _, err := r.mgr.ResumeAuthenticator().Authenticate(req); err != nil {
+		netLog.With("connID", req.GetConnection().GetConnID()).Info("session resume failed", "err", err)
+	}
+}
+
+// 处理客户端确认消息的路由
+type ackRouter struct {
+	router.BaseRouter
+}
+
+func (r *ackRouter) Handle(req iface.IRequest) {
+	data := req.GetData()
+	sess := SessionOf(req.GetConnection())
+	if sess == nil || len(data) < 8 {
+		return
+	}
+	sess.Ack(binary.BigEndian.Uint64(data))
+}
+
+// 断线重连请求的数据：8字节大端序的lastSeq，之后是令牌
+func EncodeResume(token string, lastSeq uint64) []byte {
+	data := make([]byte, 8+len(token))
+	binary.BigEndian.PutUint64(data, lastSeq)
+	copy(data[8:], token)
+	return data
+}
+
+// 解析断线重连请求的数据
+func DecodeResume(data []byte) (token string, lastSeq uint64, err error) {
+	if len(data) <= 8 {
+		return "", 0, ErrBadResumeData
+	}
+	return string(data[8:]), binary.BigEndian.Uint64(data), nil
+}
+
+// 会话ID，进程内唯一
+func (sess *Session) ID() uint64 {
+	return sess.id
+}
+
+// 打印会话时只有ID，不包含令牌，也不读取需要加锁的字段
+func (sess *Session) String() string {
+	return "session " + strconv.FormatUint(sess.id, 10)
+}
+
+// 断线重连使用的令牌
+func (sess *Session) Token() string {
+	return sess.token
+}
+
+// 创建会话时的身份
+func (sess *Session) Identity() interface{} {
+	return sess.identity
+}
+
+// 当前的连接，断线期间返回nil
+func (sess *Session) Conn() iface.IConn {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	return sess.conn
+}
+
+// 最后一条消息的序号
+func (sess *Session) Seq() uint64 {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	return sess.seq
+}
+
+// 没有确认的消息数量
+func (sess *Session) Pending() int {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	return len(sess.buffer)
+}
+
+/*
+给会话发送消息：在线时发给当前连接，断线期间放入缓存，重连后重发
+会话已经关闭时返回错误
+*/
+func (sess *Session) WriteMsg(msgId uint32, data []byte) error {
+	sess.lock.Lock()
+	if sess.closed {
+		sess.lock.Unlock()
+		return ErrSessionNotFound
+	}
+	conn := sess.conn
+	if conn == nil {
+		defer sess.lock.Unlock()
+		packet, err := sess.mgr.msgParser.Encode(msgparser.NewMsgPackage(msgId, data))
+		if err != nil {
+			return err
+		}
+		sess.record(msgId, packet)
+		return nil
+	}
+	sess.lock.Unlock()
+	//发送时通过观察者编号，不能持有会话的锁
+	return conn.WriteMsg(msgId, data)
+}
+
+// 连接发出消息时的观察者，连接已经不属于会话时忽略
+func (sess *Session) observer(conn iface.IConn) func(msgId uint32, packet []byte) {
+	return func(msgId uint32, packet []byte) {
+		sess.lock.Lock()
+		defer sess.lock.Unlock()
+		if sess.conn != conn || sess.closed {
+			return
+		}
+		sess.record(msgId, packet)
+	}
+}
+
+// 编号并缓存一条消息，超过BufferSize时丢弃最早的消息，调用时需要持有锁
+func (sess *Session) record(msgId uint32, packet []byte) {
+	sess.seq++
+	if len(sess.buffer) >= sess.mgr.cfg.BufferSize {
+		sess.trim(1)
+	}
+	sess.buffer = append(sess.buffer, sessionMsg{seq: sess.seq, msgId: msgId, packet: packet})
+}
+
+// 客户端确认收到seq及之前的消息
+func (sess *Session) Ack(seq uint64) {
+	sess.lock.Lock()
+	sess.ack(seq)
+	sess.lock.Unlock()
+}
+
+func (sess *Session) ack(seq uint64) {
+	n := 0
+	for n < len(sess.buffer) && sess.buffer[n].seq <= seq {
+		n++
+	}
+	sess.trim(n)
+}
+
+// 删除最早的n条消息
+func (sess *Session) trim(n int) {
+	if n == 0 {
+		return
+	}
+	copy(sess.buffer, sess.buffer[n:])
+	for i := len(sess.buffer) - n; i < len(sess.buffer); i++ {
+		sess.buffer[i] = sessionMsg{}
+	}
+	sess.buffer = sess.buffer[:len(sess.buffer)-n]
+}
+
+// 开始断线的过期计时，调用时需要持有锁
+func (sess *Session) startExpire() {
+	sess.timer = time.AfterFunc(sess.mgr.cfg.Grace, func() {
+		sess.lock.Lock()
+		if sess.conn != nil || sess.closed {
+			sess.lock.Unlock()
+			return
+		}
+		sess.closed = true
+		sess.buffer = nil
+		sess.lock.Unlock()
+		netLog.With("sessionID", sess.id).Info("session expired")
+		sess.mgr.remove(sess)
+	})
+}
+
+// 关闭会话，比如玩家退出登录，连接不会关闭；会通知过期的回调
+func (sess *Session) Close() {
+	sess.lock.Lock()
+	if sess.closed {
+		sess.lock.Unlock()
+		return
+	}
+	sess.closed = true
+	sess.buffer = nil
+	if sess.timer != nil {
+		sess.timer.Stop()
+	}
+	conn := sess.conn
+	sess.conn = nil
+	sess.lock.Unlock()
+
+	if conn != nil {
+		conn.RemoveProperty(SessionKey)
+		if observable, ok := conn.(SendObservable); ok {
+			observable.SetSendObserver(nil)
+		}
+	}
+	sess.mgr.remove(sess)
+}
@@ -0,0 +1,228 @@
+package network_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gobonbon/iface"
+	"gobonbon/msgparser"
+	"gobonbon/nettest"
+	"gobonbon/network"
+	"gobonbon/router"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const msgResume = 50
+
+func recvData(t *testing.T, c *nettest.Conn) []string {
+	t.Helper()
+	var got []string
+	for _, msg := range c.RecvAll() {
+		if msg.GetMsgId() == msgResume {
+			got = append(got, "resume:"+strconv.FormatUint(binary.BigEndian.Uint64(msg.GetData()), 10))
+			continue
+		}
+		got = append(got, string(msg.GetData()))
+	}
+	return got
+}
+
+func expectData(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	s := nettest.NewServer()
+	mgr := network.NewSessionManager(s.ConnMgr, msgparser.NewMsgParserWithMaxPacketSize(4096), network.SessionConfig{
+		Grace: 100 * time.Millisecond, BufferSize: 3, ResumeMsgId: msgResume,
+	})
+	expired := make(chan *network.Session, 1)
+	mgr.OnExpire(func(sess *network.Session) { expired <- sess })
+
+	c1 := s.Connect()
+	sess, err := mgr.Create(c1.Peer(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.Peer().WriteMsg(1, []byte("a"))
+	sess.WriteMsg(1, []byte("b"))
+	expectData(t, recvData(t, c1), "a", "b")
+	sess.Ack(1)
+
+	// 断线期间的消息进入缓存
+	c1.Stop()
+	if sess.Conn() != nil {
+		t.Fatal("session still attached")
+	}
+	sess.WriteMsg(1, []byte("c"))
+
+	// 重连后先回复，再重发2和3，之后的消息继续编号
+	c2 := s.Connect()
+	resume := mgr.ResumeAuthenticator()
+	identity, err := resume.Authenticate(network.NewRequest(c2.Peer(), msgparser.NewMsgPackage(msgResume, network.EncodeResume(sess.Token(), 1))))
+	if err != nil || identity != "alice" {
+		t.Fatalf("resume = %v %v", identity, err)
+	}
+	expectData(t, recvData(t, c2), "resume:3", "b", "c")
+	c2.Peer().WriteMsg(1, []byte("d"))
+	if sess.Seq() != 4 || network.SessionOf(c2.Peer()) != sess {
+		t.Fatalf("seq %d", sess.Seq())
+	}
+
+	// 缓存只保留最后3条，需要更早的消息时重连失败
+	for _, d := range []string{"e", "f", "g"} {
+		c2.Peer().WriteMsg(1, []byte(d))
+	}
+	c2.RecvAll()
+	c3 := s.Connect()
+	if _, err := mgr.Resume(c3.Peer(), sess.Token(), 3); err != network.ErrSessionReplayLost {
+		t.Fatalf("resume = %v", err)
+	}
+	if _, err := mgr.Resume(c3.Peer(), sess.Token(), 9); err != network.ErrSessionBadSeq {
+		t.Fatalf("resume = %v", err)
+	}
+	if _, err := mgr.Resume(c3.Peer(), "bad", 0); err != network.ErrSessionNotFound {
+		t.Fatalf("resume = %v", err)
+	}
+	// 旧的连接还在时被新的连接替换
+	if _, err := mgr.Resume(c3.Peer(), sess.Token(), 6); err != nil {
+		t.Fatal(err)
+	}
+	expectData(t, recvData(t, c3), "resume:7", "g")
+	if !c2.Closed() {
+		t.Fatal("old conn not closed")
+	}
+
+	// 断线超过Grace后过期
+	c3.Stop()
+	select {
+	case got := <-expired:
+		if got != sess || mgr.Get(sess.Token()) != nil || mgr.Len() != 0 {
+			t.Fatal("session not removed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session not expired")
+	}
+	if err := sess.WriteMsg(1, nil); err != network.ErrSessionNotFound {
+		t.Fatalf("WriteMsg after expire = %v", err)
+	}
+}
+
+// 登录时创建会话，把令牌发给客户端
+type sessionLogin struct {
+	router.BaseRouter
+	s *network.Server
+}
+
+func (r *sessionLogin) Handle(req iface.IRequest) {
+	sess, err := r.s.GetSessionMgr().Create(req.GetConnection(), "alice")
+	if err != nil {
+		return
+	}
+	req.GetConnection().WriteMsg(msgReply, []byte(sess.Token()))
+}
+
+// 缓存的消息比新连接的发送队列多，重发时等待队列的空位，客户端按顺序收到全部消息
+func TestSessionResumeFullBuffer(t *testing.T) {
+	const count = 1024
+	port := freePort(t)
+	s, err := network.NewServer(
+		network.WithHost("127.0.0.1"),
+		network.WithTcpPort(port),
+		network.WithMaxMsgChanLen(4),
+		network.WithSessions(network.SessionConfig{Grace: time.Minute, BufferSize: count, ResumeMsgId: msgResume}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddRouter(msgLogin, &sessionLogin{s: s})
+	s.Start()
+	defer s.Stop()
+
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser := msgparser.NewMsgParserWithMaxPacketSize(4096)
+	send := func(conn net.Conn, msgId uint32, data []byte) {
+		packet, _ := parser.Encode(msgparser.NewMsgPackage(msgId, data))
+		if _, err := conn.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(conn net.Conn) (uint32, []byte) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		head := make([]byte, parser.GetHeadLen())
+		if _, err := io.ReadFull(conn, head); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(head[4:]))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			t.Fatal(err)
+		}
+		return binary.BigEndian.Uint32(head), data
+	}
+
+	send(conn, msgLogin, nil)
+	_, token := read(conn)
+	sess := s.GetSessionMgr().Get(string(token))
+	if sess == nil {
+		t.Fatal("session not created")
+	}
+	conn.Close()
+	for i := 0; i < 50 && sess.Conn() != nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if sess.Conn() != nil {
+		t.Fatal("session still attached")
+	}
+	// 断线期间写满缓存，一共4MB，超过socket的缓冲区，重发时写goroutine会被阻塞
+	for i := 0; i < count; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 4000)
+		if err := sess.WriteMsg(msgReply, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 客户端先不读取，重发要等它开始读
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	send(conn, msgResume, network.EncodeResume(string(token), 1))
+	time.Sleep(200 * time.Millisecond)
+	if msgId, data := read(conn); msgId != msgResume || binary.BigEndian.Uint64(data) != count+1 {
+		t.Fatalf("resume reply %d %v", msgId, data)
+	}
+	for i := 0; i < count; i++ {
+		msgId, data := read(conn)
+		if msgId != msgReply || len(data) != 4000 || data[0] != byte(i) {
+			t.Fatalf("replay %d: msg %d, %d bytes of %d", i, msgId, len(data), data[0])
+		}
+	}
+	if sess.Conn() == nil || sess.Seq() != count+1 {
+		t.Fatalf("session not resumed, seq %d", sess.Seq())
+	}
+}
+
+var _ network.SendObservable = (*nettest.Conn)(nil)
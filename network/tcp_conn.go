@@ -4,13 +4,15 @@ package network
 import (
 	"context"
 	"errors"
-	"fmt"
 	"gobonbon/conf"
 	"gobonbon/iface"
+	"gobonbon/metrics"
 	"gobonbon/msgparser"
+	"gobonbon/util"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,6 +22,10 @@ type ConnSet map[net.Conn]struct{}
 
 type TCPConn struct {
 	sync.RWMutex
+	util.ConnProperty //链接属性
+	connAuth          //认证状态
+	sendObserver      //发送观察者，会话用来给消息编号
+
 	TCPServer  iface.IServer //当前Conn属于哪个Server
 	conn       net.Conn      //当前连接socket Tcp套接字
 	connID     uint64        //当前连接的ID 也可以称作为SessionID，ID全局唯一
@@ -27,28 +33,35 @@ type TCPConn struct {
 	writeChan  chan []byte   // (有缓冲管道，用于读、写两个goroutine之间的消息通信)
 	MsgHandler iface.IMsgHandle
 	msgParser  iface.IMsgParser
+	startTime  time.Time //链接建立的时间
+	bytesIn    uint64    //收到的字节数
+	bytesOut   uint64    //发出的字节数
 	//告知该链接已经退出/停止的channel
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
 // 初始化链接模块的方法
-func newTcpConn(server iface.IServer, conn *net.TCPConn, connID uint64, msgParser iface.IMsgParser, msgHandler iface.IMsgHandle) *TCPConn {
+func newTcpConn(server iface.IServer, conn *net.TCPConn, connID uint64, msgParser iface.IMsgParser, msgHandler iface.IMsgHandle, cfg *conf.GlobalObj) *TCPConn {
 	tcpConn := new(TCPConn)
 	tcpConn.TCPServer = server
 	tcpConn.conn = conn
 	tcpConn.connID = connID
-	tcpConn.writeChan = make(chan []byte, conf.GlobalObject.MaxMsgChanLen)
+	tcpConn.writeChan = make(chan []byte, cfg.MaxMsgChanLen)
 	tcpConn.closeFlag = false
 	tcpConn.msgParser = msgParser
 	tcpConn.MsgHandler = msgHandler
+	tcpConn.startTime = time.Now()
+	//加入连接管理后随时可能被Stop，ctx需要在这里创建
+	tcpConn.ctx, tcpConn.cancel = context.WithCancel(context.Background())
 	//将新创建的Conn添加到链接管理中
 	tcpConn.TCPServer.GetConnMgr().Add(tcpConn)
 	return tcpConn
 }
 
 func (tcpConn *TCPConn) StartReader() {
-	defer fmt.Printf("%s [conn Writer exit!]\n", tcpConn.RemoteAddr().String())
+	logger := netLog.With("connID", tcpConn.connID, "remote", tcpConn.RemoteAddr().String())
+	defer logger.Debug("conn reader exit")
 	defer tcpConn.Stop()
 	for {
 		select {
@@ -61,15 +74,14 @@ func (tcpConn *TCPConn) StartReader() {
 			//读取客户端的Msg head
 			headData := make([]byte, hlen)
 			if _, err := io.ReadFull(tcpConn.conn, headData); err != nil {
-				fmt.Println("read msg head error ", err)
+				logger.Debug("read msg head error", "err", err)
 				return
 			}
-			//fmt.Printf("read headData %+v\n", headData)
 
 			//拆包，得到msgid 和 datalen 放在msg中
 			msg, err := tcpConn.msgParser.Decode(headData)
 			if err != nil {
-				fmt.Println("unpack error ", err)
+				logger.Warn("unpack error", "err", err)
 				return
 			}
 
@@ -78,22 +90,22 @@ func (tcpConn *TCPConn) StartReader() {
 			if msg.GetDataLen() > 0 {
 				data = make([]byte, msg.GetDataLen())
 				if _, err := io.ReadFull(tcpConn.conn, data); err != nil {
-					fmt.Println("read msg data error ", err)
+					logger.Debug("read msg data error", "err", err)
 					return
 				}
 			}
 			msg.SetData(data)
-			fmt.Println("555")
+			metrics.ObserveIn(msg.GetMsgId(), int(hlen)+len(data))
+			atomic.AddUint64(&tcpConn.bytesIn, uint64(hlen)+uint64(len(data)))
 			//得到当前客户端请求的Request数据
 			req := NewRequest(tcpConn, msg)
-
-			if conf.GlobalObject.WorkerPoolSize > 0 {
-				//已经启动工作池机制，将消息交给Worker处理
-				tcpConn.MsgHandler.SendMsgToTaskQueue(req)
-			} else {
-				//从绑定好的消息和对应的处理方法中执行对应的Handle方法
-				go tcpConn.MsgHandler.DoMsgHandler(req)
+			//认证之前只处理认证消息和白名单中的消息
+			if !tcpConn.filterAuth(req) {
+				continue
 			}
+
+			//将消息交给Worker处理，WorkerPoolSize为0时在读goroutine中直接处理
+			tcpConn.MsgHandler.SendMsgToTaskQueue(req)
 		}
 	}
 }
@@ -102,21 +114,28 @@ func (tcpConn *TCPConn) StartReader() {
 写消息Goroutine， 用户将数据发送给客户端
 */
 func (c *TCPConn) StartWriter() {
-	fmt.Println("[Writer Goroutine is running]")
-	defer fmt.Println(c.RemoteAddr().String(), "[conn Writer exit!]")
+	logger := netLog.With("connID", c.connID, "remote", c.RemoteAddr().String())
+	logger.Debug("conn writer running")
+	defer logger.Debug("conn writer exit")
 	defer c.Stop()
 	for {
 		select {
 		case data, ok := <-c.writeChan:
 			if ok {
+				if data == nil {
+					//stopAfterFlush 之前的消息已经全部写出
+					logger.Debug("write chan flushed")
+					return
+				}
 				//有数据要写给客户端
 				if _, err := c.conn.Write(data); err != nil {
-					fmt.Println("Send Buff Data error:, ", err, " Conn Writer exit")
+					logger.Debug("send buff data error", "err", err)
 					return
 				}
+				atomic.AddUint64(&c.bytesOut, uint64(len(data)))
 			} else {
-				fmt.Println("msgBuffChan is Closed")
-				// break
+				logger.Debug("write chan closed")
+				return
 			}
 		case <-c.ctx.Done():
 			return
@@ -124,7 +143,7 @@ func (c *TCPConn) StartWriter() {
 	}
 	// for b := range c.writeChan {
 	// 	time.Sleep(1 * time.Second)
-	// 	fmt.Println("写数据", b)
+	// 	log.Debug("写数据 %v", b)
 	// 	if b == nil {
 	// 		continue
 	// 	}
@@ -139,14 +158,16 @@ func (c *TCPConn) StartWriter() {
 
 // (启动连接，让当前连接开始工作)
 func (tcpConn *TCPConn) Start() {
-	tcpConn.ctx, tcpConn.cancel = context.WithCancel(context.Background())
-	go tcpConn.StartReader()
+	readerDone := make(chan struct{})
+	go func() {
+		tcpConn.StartReader()
+		close(readerDone)
+	}()
 	go tcpConn.StartWriter()
-	select {
-	case <-tcpConn.ctx.Done():
-		tcpConn.finalizer()
-		return
-	}
+	<-tcpConn.ctx.Done()
+	tcpConn.finalizer()
+	//finalizer关闭了底层连接，等读goroutine退出，之后不会再有这个连接的请求进入任务队列
+	<-readerDone
 }
 
 func (tcpConn *TCPConn) Stop() {
@@ -163,35 +184,69 @@ func (tcpConn *TCPConn) RemoteAddr() net.Addr {
 
 // 路由和写数据绑定
 func (tcpConn *TCPConn) WriteMsg(msgId uint32, data []byte) error {
-	fmt.Println("111")
+	//将data封包，并且发送
+	msg, err := tcpConn.msgParser.Encode(msgparser.NewMsgPackage(msgId, data))
+	if err != nil {
+		netLog.With("connID", tcpConn.connID, "msgId", msgId).Error("pack error", "err", err)
+		return errors.New("Pack error msg ")
+	}
+	return tcpConn.writePacket(msgId, msg)
+}
+
+// 发送已经封包的数据，广播时同一份数据只封包一次，packet发送前不能修改
+func (tcpConn *TCPConn) writePacket(msgId uint32, packet []byte) error {
+	return tcpConn.writePacketTimeout(msgId, packet, 5*time.Millisecond)
+}
+
+// 发送已经封包的数据，timeout内放不进发送队列时返回错误，连接关闭时立即返回
+func (tcpConn *TCPConn) writePacketTimeout(msgId uint32, packet []byte, timeout time.Duration) error {
+	//有观察者时发送和通知需要串行，保证通知的顺序和发送的顺序一致
+	observe := tcpConn.lockObserver()
+	defer tcpConn.unlockObserver(observe)
 	tcpConn.RLock()
 	defer tcpConn.RUnlock()
-	idleTimeout := time.NewTimer(5 * time.Millisecond)
+	idleTimeout := time.NewTimer(timeout)
 	defer idleTimeout.Stop()
 
 	if tcpConn.closeFlag {
+		metrics.WriteDrops.Inc()
 		return errors.New("Connection closed when send buff msg")
 	}
-	pack := msgparser.NewMsgPackage(msgId, data)
-	pack.SetMsgId(msgId)
-	fmt.Println("222")
-	//将data封包，并且发送
-	msg, err := tcpConn.msgParser.Encode(pack)
-	if err != nil {
-		fmt.Println("Pack error msg id = ", msgId)
-		return errors.New("Pack error msg ")
-	}
 
 	// 发送超时
 	select {
 	case <-idleTimeout.C:
+		metrics.WriteTimeouts.Inc()
 		return errors.New("send buff msg timeout")
-	case tcpConn.writeChan <- msg:
-		fmt.Println("333")
+	case <-tcpConn.ctx.Done():
+		metrics.WriteDrops.Inc()
+		return errors.New("Connection closed when send buff msg")
+	case tcpConn.writeChan <- packet:
+		metrics.ObserveOut(msgId, len(packet))
+		if observe != nil {
+			observe(msgId, packet)
+		}
 		return nil
 	}
 }
 
+// 发送完已经在发送队列中的消息后关闭连接，timeout内放不进队列时直接关闭
+func (tcpConn *TCPConn) stopAfterFlush(timeout time.Duration) {
+	tcpConn.RLock()
+	defer tcpConn.RUnlock()
+	if tcpConn.closeFlag {
+		return
+	}
+	flushTimeout := time.NewTimer(timeout)
+	defer flushTimeout.Stop()
+	select {
+	case tcpConn.writeChan <- nil: //写goroutine收到nil后退出并关闭连接
+	case <-flushTimeout.C:
+		tcpConn.Stop()
+	case <-tcpConn.ctx.Done():
+	}
+}
+
 // 获取当前连接ID
 func (c *TCPConn) GetConnID() uint64 {
 	return c.connID
@@ -206,6 +261,21 @@ func (c *TCPConn) GetWsConn() *websocket.Conn {
 	return nil
 }
 
+// 链接建立的时间
+func (c *TCPConn) StartTime() time.Time {
+	return c.startTime
+}
+
+// 收到的字节数
+func (c *TCPConn) BytesIn() uint64 {
+	return atomic.LoadUint64(&c.bytesIn)
+}
+
+// 发出的字节数
+func (c *TCPConn) BytesOut() uint64 {
+	return atomic.LoadUint64(&c.bytesOut)
+}
+
 func (tcpConn *TCPConn) finalizer() {
 	//如果用户注册了该链接的关闭回调业务，那么在此刻应该显示调用
 	// c.TCPServer.CallOnConnStop(c)
@@ -215,6 +285,7 @@ func (tcpConn *TCPConn) finalizer() {
 		return
 	}
 	tcpConn.closeFlag = true
+	tcpConn.stopAuth()
 	tcpConn.conn.Close()
 	tcpConn.cancel() //关闭Writer
 	//将链接从连接管理器中删除
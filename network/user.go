@@ -0,0 +1,224 @@
+package network
+
+import (
+	"errors"
+	"gobonbon/conf"
+	"gobonbon/iface"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUserOnline   = errors.New("user already online")
+	ErrUserOffline  = errors.New("user not online")
+	ErrUserConnGone = errors.New("connection not in ConnManager")
+)
+
+// 踢下线时等待发送队列清空的最长时间
+const kickFlushTimeout = time.Second
+
+/*
+用户管理，维护用户ID和连接的对应关系，实现单点登录
+
+	func (r *LoginRouter) Handle(req iface.IRequest) {
+		userID := checkPassword(req.GetData())
+		if err := s.GetUserMgr().BindUser(req.GetConnection(), userID); err == network.ErrUserOnline {
+			req.GetConnection().WriteMsg(MsgLoginFailed, nil)
+			return
+		}
+	}
+	conn, err := s.GetUserMgr().GetByUser(userID)
+
+同一个用户重复登录时按 SetPolicy 设置的方式处理：
+conf.LoginKickOld 给旧连接发送 SetKickMsg 设置的消息，发送完之后关闭旧连接；
+conf.LoginRejectNew BindUser 返回 ErrUserOnline；conf.LoginAllowMulti 允许同时在线。
+连接关闭时自动解除绑定，可以在任意goroutine中使用
+*/
+type UserManager struct {
+	lock      sync.RWMutex
+	users     map[string][]iface.IConn //userID -> 连接，按绑定的顺序
+	connUsers map[uint64]string        //connID -> userID
+	connMgr   iface.IConnManager
+	policy    string
+	kickMsgId uint32
+	kickMsg   []byte
+}
+
+// 可以在发送完队列中的消息后关闭的连接
+type flushStopper interface {
+	stopAfterFlush(timeout time.Duration)
+}
+
+// 创建用户管理，连接从connMgr中删除时自动解除绑定，默认踢掉旧连接并且不发送通知
+func NewUserManager(connMgr *ConnManager) *UserManager {
+	mgr := &UserManager{
+		users:     make(map[string][]iface.IConn),
+		connUsers: make(map[uint64]string),
+		connMgr:   connMgr,
+		policy:    conf.LoginKickOld,
+	}
+	connMgr.OnRemove(mgr.UnbindUser)
+	return mgr
+}
+
+// 设置重复登录的处理方式 conf.LoginKickOld、conf.LoginRejectNew 或 conf.LoginAllowMulti，为空时等于 conf.LoginKickOld
+func (mgr *UserManager) SetPolicy(policy string) {
+	if policy == "" {
+		policy = conf.LoginKickOld
+	}
+	mgr.lock.Lock()
+	mgr.policy = policy
+	mgr.lock.Unlock()
+}
+
+// 设置被挤下线时发给旧连接的消息，data为空时不发送直接关闭
+func (mgr *UserManager) SetKickMsg(msgId uint32, data []byte) {
+	mgr.lock.Lock()
+	mgr.kickMsgId = msgId
+	mgr.kickMsg = data
+	mgr.lock.Unlock()
+}
+
+/*
+把连接绑定到用户，通常在登录成功后调用
+连接已经绑定了其他用户时先解除原来的绑定；连接已经关闭时返回 ErrUserConnGone；
+用户已经在线时按重复登录的处理方式处理，拒绝时返回 ErrUserOnline
+*/
+func (mgr *UserManager) BindUser(conn iface.IConn, userID string) error {
+	connID := conn.GetConnID()
+	mgr.lock.Lock()
+	//连接关闭时先从connMgr中删除再解除绑定，在锁内检查保证关闭的连接不会留在索引中
+	if _, err := mgr.connMgr.Get(connID); err != nil {
+		mgr.lock.Unlock()
+		return ErrUserConnGone
+	}
+	old, bound := mgr.connUsers[connID]
+	if bound && old == userID {
+		mgr.lock.Unlock()
+		return nil
+	}
+	others := mgr.users[userID]
+	if len(others) > 0 && mgr.policy == conf.LoginRejectNew {
+		mgr.lock.Unlock()
+		return ErrUserOnline
+	}
+	if bound {
+		mgr.unlink(connID, old)
+	}
+	var kicked []iface.IConn
+	if len(others) > 0 && mgr.policy != conf.LoginAllowMulti {
+		kicked = others
+		for _, other := range others {
+			delete(mgr.connUsers, other.GetConnID())
+		}
+		delete(mgr.users, userID)
+	}
+	mgr.users[userID] = append(mgr.users[userID], conn)
+	mgr.connUsers[connID] = userID
+	kickMsgId, kickMsg := mgr.kickMsgId, mgr.kickMsg
+	mgr.lock.Unlock()
+
+	for _, other := range kicked {
+		netLog.With("userID", userID, "connID", other.GetConnID(), "newConnID", connID).Info("duplicate login, kick old conn")
+		kick(other, kickMsgId, kickMsg)
+	}
+	return nil
+}
+
+// 解除连接的绑定，连接关闭时由ConnManager调用
+func (mgr *UserManager) UnbindUser(conn iface.IConn) {
+	connID := conn.GetConnID()
+	mgr.lock.Lock()
+	if userID, ok := mgr.connUsers[connID]; ok {
+		mgr.unlink(connID, userID)
+	}
+	mgr.lock.Unlock()
+}
+
+// 需要持有写锁
+func (mgr *UserManager) unlink(connID uint64, userID string) {
+	delete(mgr.connUsers, connID)
+	conns := mgr.users[userID]
+	for i, conn := range conns {
+		if conn.GetConnID() == connID {
+			conns = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(mgr.users, userID)
+	} else {
+		mgr.users[userID] = conns
+	}
+}
+
+// 取得用户的连接，允许多个连接在线时返回最后登录的一个，不在线时返回 ErrUserOffline
+func (mgr *UserManager) GetByUser(userID string) (iface.IConn, error) {
+	mgr.lock.RLock()
+	defer mgr.lock.RUnlock()
+	conns := mgr.users[userID]
+	if len(conns) == 0 {
+		return nil, ErrUserOffline
+	}
+	return conns[len(conns)-1], nil
+}
+
+// 用户的全部连接，按登录的顺序
+func (mgr *UserManager) ConnsOf(userID string) []iface.IConn {
+	mgr.lock.RLock()
+	defer mgr.lock.RUnlock()
+	return append([]iface.IConn(nil), mgr.users[userID]...)
+}
+
+// 连接绑定的用户
+func (mgr *UserManager) UserOf(connID uint64) (string, bool) {
+	mgr.lock.RLock()
+	defer mgr.lock.RUnlock()
+	userID, ok := mgr.connUsers[connID]
+	return userID, ok
+}
+
+// 在线的用户数
+func (mgr *UserManager) Len() int {
+	mgr.lock.RLock()
+	defer mgr.lock.RUnlock()
+	return len(mgr.users)
+}
+
+// 把用户的全部连接踢下线，比如封号，返回踢掉的连接数
+func (mgr *UserManager) Kick(userID string) int {
+	mgr.lock.Lock()
+	conns := mgr.users[userID]
+	for _, conn := range conns {
+		delete(mgr.connUsers, conn.GetConnID())
+	}
+	delete(mgr.users, userID)
+	kickMsgId, kickMsg := mgr.kickMsgId, mgr.kickMsg
+	mgr.lock.Unlock()
+
+	for _, conn := range conns {
+		netLog.With("userID", userID, "connID", conn.GetConnID()).Info("kick user")
+		kick(conn, kickMsgId, kickMsg)
+	}
+	return len(conns)
+}
+
+// 关闭连接的会话，避免被踢的客户端断线重连回来；通知之后等发送队列清空再关闭连接
+func kick(conn iface.IConn, msgId uint32, data []byte) {
+	if sess := SessionOf(conn); sess != nil {
+		sess.Close()
+	}
+	if len(data) > 0 {
+		conn.WriteMsg(msgId, data)
+	}
+	StopAfterFlush(conn, kickFlushTimeout)
+}
+
+// 发送完已经在发送队列中的消息后关闭连接，timeout内放不进发送队列时直接关闭；不支持的连接直接Stop
+func StopAfterFlush(conn iface.IConn, timeout time.Duration) {
+	if fs, ok := conn.(flushStopper); ok {
+		fs.stopAfterFlush(timeout)
+	} else {
+		conn.Stop()
+	}
+}
@@ -0,0 +1,140 @@
+package network_test
+
+import (
+	"gobonbon/client"
+	"gobonbon/conf"
+	"gobonbon/iface"
+	"gobonbon/nettest"
+	"gobonbon/network"
+	"gobonbon/router"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUserPolicy(t *testing.T) {
+	s := nettest.NewServer()
+	mgr := network.NewUserManager(s.ConnMgr)
+	mgr.SetKickMsg(9, []byte("kicked"))
+	c1, c2, c3 := s.Connect(), s.Connect(), s.Connect()
+	p1, p2, p3 := c1.Peer(), c2.Peer(), c3.Peer()
+
+	if err := mgr.BindUser(p1, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	// 拒绝新连接时旧的绑定不变
+	mgr.SetPolicy(conf.LoginRejectNew)
+	if err := mgr.BindUser(p2, "alice"); err != network.ErrUserOnline {
+		t.Fatalf("BindUser rejected = %v", err)
+	}
+	if conn, _ := mgr.GetByUser("alice"); conn != iface.IConn(p1) {
+		t.Fatal("GetByUser after reject")
+	}
+
+	mgr.SetPolicy(conf.LoginAllowMulti)
+	mgr.BindUser(p2, "alice")
+	if conns := mgr.ConnsOf("alice"); len(conns) != 2 {
+		t.Fatalf("ConnsOf = %d", len(conns))
+	}
+
+	// 踢掉全部旧连接，旧连接先收到通知再关闭
+	mgr.SetPolicy(conf.LoginKickOld)
+	mgr.BindUser(p3, "alice")
+	for _, c := range []*nettest.Conn{c1, c2} {
+		msgs := c.RecvAll()
+		if len(msgs) != 1 || string(msgs[0].GetData()) != "kicked" || !c.Closed() {
+			t.Fatalf("old conn got %v, closed %v", msgs, c.Closed())
+		}
+	}
+	if conn, _ := mgr.GetByUser("alice"); conn != iface.IConn(p3) {
+		t.Fatal("GetByUser after kick")
+	}
+
+	// 换绑其他用户，连接关闭后解除绑定
+	mgr.BindUser(p3, "bob")
+	if _, err := mgr.GetByUser("alice"); err != network.ErrUserOffline {
+		t.Fatalf("GetByUser alice = %v", err)
+	}
+	c3.Stop()
+	if _, ok := mgr.UserOf(p3.GetConnID()); ok || mgr.Len() != 0 {
+		t.Fatal("binding left after close")
+	}
+	if err := mgr.BindUser(p3, "bob"); err != network.ErrUserConnGone {
+		t.Fatalf("BindUser closed conn = %v", err)
+	}
+}
+
+type bindRouter struct {
+	router.BaseRouter
+	users *network.UserManager
+}
+
+func (r *bindRouter) Handle(req iface.IRequest) {
+	r.users.BindUser(req.GetConnection(), string(req.GetData()))
+	req.GetConnection().WriteMsg(msgReply, []byte("welcome"))
+}
+
+func TestUserKickTCP(t *testing.T) {
+	port := freePort(t)
+	s, err := network.NewServer(
+		network.WithHost("127.0.0.1"),
+		network.WithTcpPort(port),
+		network.WithLoginPolicy(conf.LoginKickOld, msgReply, "kicked"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddRouter(msgLogin, &bindRouter{users: s.GetUserMgr()})
+	s.Start()
+	defer s.Stop()
+
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	login := func() (*client.Client, chan string) {
+		c := client.NewClient("tcp", addr)
+		c.SetReconnect(false, 0, 0)
+		ch := make(chan string, 16)
+		c.AddRouter(msgReply, &recvRouter{ch: ch})
+		go c.Start()
+		for i := 0; i < 50 && !c.IsConnected(); i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		c.WriteMsg(msgLogin, []byte("alice"))
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatal("login timeout")
+		}
+		return c, ch
+	}
+
+	old, oldCh := login()
+	defer old.Stop()
+	c, _ := login()
+	defer c.Stop()
+	select {
+	case got := <-oldCh:
+		if got != "kicked" {
+			t.Fatalf("old conn got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("kick msg not received")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for old.IsConnected() && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if old.IsConnected() || !c.IsConnected() {
+		t.Fatalf("old connected %v, new connected %v", old.IsConnected(), c.IsConnected())
+	}
+	if s.GetUserMgr().Len() != 1 {
+		t.Fatalf("online users %d", s.GetUserMgr().Len())
+	}
+}
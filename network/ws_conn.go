@@ -2,10 +2,17 @@ package network
 
 import (
 	"context"
+	"errors"
+	"gobonbon/conf"
 	"gobonbon/iface"
+	"gobonbon/metrics"
+	"gobonbon/msgparser"
+	"gobonbon/util"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -13,20 +20,27 @@ import (
 // (Websocket连接模块, 用于处理 Websocket 连接的读写业务 一个连接对应一个Connection)
 type WsConnection struct {
 	sync.RWMutex
-	wsServer    iface.IServer          //当前Conn属于哪个Server
-	conn        *websocket.Conn        //conn 是当前连接的 WebSocket 套接字
-	connID      uint64                 // (当前连接的ID 也可以称作为SessionID，ID全局唯一 ，服务端Connection使用,这个是理论支持的进程connID的最大数量) uint64 取值范围：0 ~ 18,446,744,073,709,551,615
-	connIdStr   string                 // (字符串的连接id)
-	closeFlag   bool                   //当前连接的是否关闭状态
-	msgBuffChan chan []byte            // (有缓冲管道，用于读、写两个goroutine之间的消息通信)
-	property    map[string]interface{} //(链接属性)
-	name        string                 // (链接名称，默认与创建链接的Server/Client的Name一致)
-	localAddr   string                 //(当前链接的本地地址)
-	remoteAddr  string                 //(当前链接的远程地址)
+	util.ConnProperty //(链接属性)
+	connAuth          //(认证状态)
+	sendObserver      //(发送观察者，会话用来给消息编号)
+
+	wsServer    iface.IServer   //当前Conn属于哪个Server
+	conn        *websocket.Conn //conn 是当前连接的 WebSocket 套接字
+	connID      uint64          // (当前连接的ID 也可以称作为SessionID，ID全局唯一 ，服务端Connection使用,这个是理论支持的进程connID的最大数量) uint64 取值范围：0 ~ 18,446,744,073,709,551,615
+	connIdStr   string          // (字符串的连接id)
+	closeFlag   bool            //当前连接的是否关闭状态
+	msgBuffChan chan []byte     // (有缓冲管道，用于读、写两个goroutine之间的消息通信)
+	name        string          // (链接名称，默认与创建链接的Server/Client的Name一致)
+	localAddr   string          //(当前链接的本地地址)
+	remoteAddr  string          //(当前链接的远程地址)
+	startTime   time.Time       //(链接建立的时间)
+	bytesIn     uint64          //(收到的字节数)
+	bytesOut    uint64          //(发出的字节数)
 
 	onConnStart func(conn iface.IConn) // (当前连接创建时Hook函数)
 	onConnStop  func(conn iface.IConn) // (当前连接断开时的Hook函数)
 	msgHandler  iface.IMsgHandle       // (消息管理MsgID和对应处理方法的消息管理模块)
+	msgParser   iface.IMsgParser       // (消息封包拆包，一个websocket二进制帧对应一个完整的消息包)
 
 	ctx    context.Context    // (告知该链接已经退出/停止的channel)
 	cancel context.CancelFunc // (告知该链接已经退出/停止的channel)
@@ -34,7 +48,7 @@ type WsConnection struct {
 
 // (newServerConn :for Server, 创建一个Server服务端特性的连接的方法
 // Note: 名字由 NewConnection 更变)
-func newWebsocketConn(server iface.IServer, conn *websocket.Conn, connID uint64) iface.IConn {
+func newWebsocketConn(server iface.IServer, conn *websocket.Conn, connID uint64, msgParser iface.IMsgParser, cfg *conf.GlobalObj) *WsConnection {
 	// Initialize Conn properties (初始化Conn属性)
 	wsConn := &WsConnection{
 		wsServer:    server,
@@ -42,12 +56,14 @@ func newWebsocketConn(server iface.IServer, conn *websocket.Conn, connID uint64)
 		connID:      connID,
 		connIdStr:   strconv.FormatUint(connID, 10),
 		closeFlag:   false,
-		msgBuffChan: nil,
-		property:    nil,
+		msgBuffChan: make(chan []byte, cfg.MaxMsgChanLen),
 		name:        server.ServerName(),
 		localAddr:   conn.LocalAddr().String(),
 		remoteAddr:  conn.RemoteAddr().String(),
+		startTime:   time.Now(),
 	}
+	// 加入连接管理后随时可能被Stop，ctx需要在这里创建
+	wsConn.ctx, wsConn.cancel = context.WithCancel(context.Background())
 
 	// lengthField := server.GetLengthField()
 	// if lengthField != nil {
@@ -59,6 +75,7 @@ func newWebsocketConn(server iface.IServer, conn *websocket.Conn, connID uint64)
 	// wsConn.onConnStart = server.GetOnConnStart()
 	// wsConn.onConnStop = server.GetOnConnStop()
 	wsConn.msgHandler = server.GetMsgHandler()
+	wsConn.msgParser = msgParser
 
 	// Bind the current Connection to the Server's ConnManager (将当前的Connection与Server的ConnManager绑定)
 	// wsConn.connManager = server.GetConnMgr()
@@ -70,28 +87,159 @@ func newWebsocketConn(server iface.IServer, conn *websocket.Conn, connID uint64)
 }
 
 func (wsConn *WsConnection) StartReader() {
+	logger := netLog.With("connID", wsConn.connID, "remote", wsConn.remoteAddr)
+	defer logger.Debug("conn reader exit")
+	defer wsConn.Stop()
+	hlen := wsConn.msgParser.GetHeadLen()
+	for {
+		select {
+		case <-wsConn.ctx.Done():
+			return
+		default:
+			// 一个websocket消息就是一个完整的消息包 head + data
+			msgType, buf, err := wsConn.conn.ReadMessage()
+			if err != nil {
+				logger.Debug("read ws msg error", "err", err)
+				return
+			}
+			if msgType != websocket.BinaryMessage {
+				continue
+			}
+			if uint32(len(buf)) < hlen {
+				logger.Warn("ws msg too short", "len", len(buf))
+				return
+			}
+
+			//拆包，得到msgid 和 datalen 放在msg中
+			msg, err := wsConn.msgParser.Decode(buf[:hlen])
+			if err != nil {
+				logger.Warn("unpack error", "err", err)
+				return
+			}
+			if uint32(len(buf))-hlen < msg.GetDataLen() {
+				logger.Warn("ws msg data too short", "msgId", msg.GetMsgId())
+				return
+			}
+			msg.SetData(buf[hlen : hlen+msg.GetDataLen()])
+			metrics.ObserveIn(msg.GetMsgId(), int(hlen+msg.GetDataLen()))
+			atomic.AddUint64(&wsConn.bytesIn, uint64(len(buf)))
 
+			//得到当前客户端请求的Request数据
+			req := NewRequest(wsConn, msg)
+			// (认证之前只处理认证消息和白名单中的消息)
+			if !wsConn.filterAuth(req) {
+				continue
+			}
+
+			//将消息交给Worker处理，WorkerPoolSize为0时在读goroutine中直接处理
+			wsConn.msgHandler.SendMsgToTaskQueue(req)
+		}
+	}
 }
 
 func (wsConn *WsConnection) StartWriter() {
-
+	logger := netLog.With("connID", wsConn.connID, "remote", wsConn.remoteAddr)
+	defer logger.Debug("conn writer exit")
+	defer wsConn.Stop()
+	for {
+		select {
+		case data, ok := <-wsConn.msgBuffChan:
+			if !ok {
+				return
+			}
+			if data == nil {
+				//stopAfterFlush 之前的消息已经全部写出
+				logger.Debug("write chan flushed")
+				return
+			}
+			if err := wsConn.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				logger.Debug("send ws data error", "err", err)
+				return
+			}
+			atomic.AddUint64(&wsConn.bytesOut, uint64(len(data)))
+		case <-wsConn.ctx.Done():
+			return
+		}
+	}
 }
 
 // (启动连接，让当前连接开始工作)
 func (wsConn *WsConnection) Start() {
-	wsConn.ctx, wsConn.cancel = context.WithCancel(context.Background())
-	go wsConn.StartReader()
+	readerDone := make(chan struct{})
+	go func() {
+		wsConn.StartReader()
+		close(readerDone)
+	}()
 	go wsConn.StartWriter()
+	<-wsConn.ctx.Done()
+	wsConn.finalizer()
+	//finalizer关闭了底层连接，等读goroutine退出，之后不会再有这个连接的请求进入任务队列
+	<-readerDone
+}
+
+// (直接将Message数据发送数据给远程的TCP客户端)
+func (wsConn *WsConnection) WriteMsg(msgID uint32, data []byte) error {
+	//将data封包，并且发送
+	msg, err := wsConn.msgParser.Encode(msgparser.NewMsgPackage(msgID, data))
+	if err != nil {
+		netLog.With("connID", wsConn.connID, "msgId", msgID).Error("pack error", "err", err)
+		return errors.New("Pack error msg ")
+	}
+	return wsConn.writePacket(msgID, msg)
+}
+
+// (发送已经封包的数据，广播时同一份数据只封包一次，packet发送前不能修改)
+func (wsConn *WsConnection) writePacket(msgID uint32, packet []byte) error {
+	return wsConn.writePacketTimeout(msgID, packet, 5*time.Millisecond)
+}
+
+// 发送已经封包的数据，timeout内放不进发送队列时返回错误，连接关闭时立即返回
+func (wsConn *WsConnection) writePacketTimeout(msgID uint32, packet []byte, timeout time.Duration) error {
+	//有观察者时发送和通知需要串行，保证通知的顺序和发送的顺序一致
+	observe := wsConn.lockObserver()
+	defer wsConn.unlockObserver(observe)
+	wsConn.RLock()
+	defer wsConn.RUnlock()
+	idleTimeout := time.NewTimer(timeout)
+	defer idleTimeout.Stop()
+
+	if wsConn.closeFlag {
+		metrics.WriteDrops.Inc()
+		return errors.New("Connection closed when send buff msg")
+	}
+
+	// 发送超时
 	select {
+	case <-idleTimeout.C:
+		metrics.WriteTimeouts.Inc()
+		return errors.New("send buff msg timeout")
 	case <-wsConn.ctx.Done():
-		wsConn.finalizer()
-		return
+		metrics.WriteDrops.Inc()
+		return errors.New("Connection closed when send buff msg")
+	case wsConn.msgBuffChan <- packet:
+		metrics.ObserveOut(msgID, len(packet))
+		if observe != nil {
+			observe(msgID, packet)
+		}
+		return nil
 	}
 }
 
-// (直接将Message数据发送数据给远程的TCP客户端)
-func (wsConn *WsConnection) WriteMsg(msgID uint32, data []byte) error {
-	return nil
+// (发送完已经在发送队列中的消息后关闭连接，timeout内放不进队列时直接关闭)
+func (wsConn *WsConnection) stopAfterFlush(timeout time.Duration) {
+	wsConn.RLock()
+	defer wsConn.RUnlock()
+	if wsConn.closeFlag {
+		return
+	}
+	flushTimeout := time.NewTimer(timeout)
+	defer flushTimeout.Stop()
+	select {
+	case wsConn.msgBuffChan <- nil: //写goroutine收到nil后退出并关闭连接
+	case <-flushTimeout.C:
+		wsConn.Stop()
+	case <-wsConn.ctx.Done():
+	}
 }
 
 func (wsConn *WsConnection) Stop() {
@@ -119,6 +267,21 @@ func (wsConn *WsConnection) GetTCPConnection() net.Conn {
 	return nil
 }
 
+// (链接建立的时间)
+func (wsConn *WsConnection) StartTime() time.Time {
+	return wsConn.startTime
+}
+
+// (收到的字节数)
+func (wsConn *WsConnection) BytesIn() uint64 {
+	return atomic.LoadUint64(&wsConn.bytesIn)
+}
+
+// (发出的字节数)
+func (wsConn *WsConnection) BytesOut() uint64 {
+	return atomic.LoadUint64(&wsConn.bytesOut)
+}
+
 func (wsConn *WsConnection) finalizer() {
 	//如果用户注册了该链接的关闭回调业务，那么在此刻应该显示调用
 	wsConn.Lock()
@@ -127,6 +290,7 @@ func (wsConn *WsConnection) finalizer() {
 		return
 	}
 	wsConn.closeFlag = true
+	wsConn.stopAuth()
 	wsConn.conn.Close()
 	wsConn.cancel() //关闭Writer
 	//将链接从连接管理器中删除
@@ -0,0 +1,254 @@
+package recordfile
+
+import (
+	"fmt"
+	"gobonbon/log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+一组可以热更新的配置表
+
+	m := recordfile.NewManager("gamedata")
+	m.Register("item", "item.tsv", Item{})
+	m.Register("shop", "shop.tsv", Shop{})
+	m.AddCheck(recordfile.RefCheck("shop", "ItemId", "item")) //shop.ItemId 必须是 item 的主键
+	if err := m.Load(); err != nil {
+		panic(err)
+	}
+	stop := m.Watch(5 * time.Second) //文件修改后自动重新加载
+
+	//处理消息时先取一次快照，之后只使用这个快照，重新加载不会影响它
+	t := m.Tables()
+	item := t.Get("item").Index(1001).(*Item)
+
+重新加载时先读取全部文件并做完所有检查，全部成功后才整体替换，
+任何一个文件或检查出错时保留之前的数据。
+*/
+type Manager struct {
+	dir     string
+	lock    sync.Mutex //同一时间只有一个加载
+	defs    []tableDef
+	checks  []func(t *Tables) error
+	onLoad  []func(old, new *Tables)
+	current atomic.Value //*Tables
+	stamps  map[string]fileStamp
+}
+
+type tableDef struct {
+	name string
+	file string
+	st   interface{}
+}
+
+// 一次加载得到的全部配置表，加载之后不会再修改，可以在多个goroutine中同时读取
+type Tables struct {
+	version uint64
+	files   map[string]*RecordFile
+}
+
+// 多个错误，一次报告全部问题
+type Errors []error
+
+func (e Errors) Error() string {
+	list := make([]string, 0, len(e))
+	for _, err := range e {
+		list = append(list, err.Error())
+	}
+	return strings.Join(list, "; ")
+}
+
+var rfLog = log.Module("recordfile")
+
+// 创建配置表管理，dir为配置表文件所在的目录
+func NewManager(dir string) *Manager {
+	m := &Manager{dir: dir, stamps: make(map[string]fileStamp)}
+	m.current.Store(&Tables{files: make(map[string]*RecordFile)})
+	return m
+}
+
+// 注册配置表，name为表名，file为相对dir的文件名，st为记录的结构体
+// 需要在Load之前注册，名字重复时panic
+func (m *Manager) Register(name, file string, st interface{}) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, def := range m.defs {
+		if def.name == name {
+			panic("repeated table " + name)
+		}
+	}
+	if _, err := New(st); err != nil {
+		panic(fmt.Sprintf("table %s: %v", name, err))
+	}
+	m.defs = append(m.defs, tableDef{name: name, file: file, st: st})
+}
+
+// 添加加载后的检查，比如表之间的引用，全部表读取成功后才会调用
+func (m *Manager) AddCheck(fn func(t *Tables) error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.checks = append(m.checks, fn)
+}
+
+// 注册加载成功后的回调，old为之前的快照，第一次加载时old中没有任何表
+func (m *Manager) OnLoad(fn func(old, new *Tables)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.onLoad = append(m.onLoad, fn)
+}
+
+// 当前的快照
+func (m *Manager) Tables() *Tables {
+	return m.current.Load().(*Tables)
+}
+
+// 读取全部配置表并检查，全部成功后替换当前的快照
+func (m *Manager) Load() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	old := m.Tables()
+	t := &Tables{version: old.version + 1, files: make(map[string]*RecordFile, len(m.defs))}
+	stamps := make(map[string]fileStamp, len(m.defs))
+	var errs Errors
+	for _, def := range m.defs {
+		path := filepath.Join(m.dir, def.file)
+		stamps[path] = statFile(path)
+		rf, _ := New(def.st)
+		if err := rf.Read(path); err != nil {
+			errs = append(errs, fmt.Errorf("table %s: %v", def.name, err))
+			continue
+		}
+		t.files[def.name] = rf
+	}
+	if len(errs) == 0 {
+		for _, check := range m.checks {
+			if err := check(t); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	m.current.Store(t)
+	m.stamps = stamps
+	rfLog.With("version", t.version, "tables", len(t.files)).Info("tables loaded")
+	for _, fn := range m.onLoad {
+		fn(old, t)
+	}
+	return nil
+}
+
+/*
+定时检查配置表文件，有文件修改时重新加载，加载失败时保留之前的数据并打印错误
+返回停止检查的函数
+*/
+func (m *Manager) Watch(interval time.Duration) (stop func()) {
+	exitChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-exitChan:
+				return
+			case <-ticker.C:
+				if !m.changed() {
+					continue
+				}
+				if err := m.Load(); err != nil {
+					rfLog.With("err", err).Error("tables reload failed, keep current tables")
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(exitChan)
+			<-done
+		})
+	}
+}
+
+// 是否有文件修改过，加载失败后文件没有再修改时不会重复加载
+func (m *Manager) changed() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	changed := false
+	for _, def := range m.defs {
+		path := filepath.Join(m.dir, def.file)
+		stamp := statFile(path)
+		if last, ok := m.stamps[path]; !ok || !stamp.modTime.Equal(last.modTime) || stamp.size != last.size {
+			changed = true
+		}
+		m.stamps[path] = stamp
+	}
+	return changed
+}
+
+// 文件的修改时间和大小
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// 加载的版本号，每次加载成功加1
+func (t *Tables) Version() uint64 {
+	return t.version
+}
+
+// 按表名取配置表，不存在时返回nil
+func (t *Tables) Get(name string) *RecordFile {
+	return t.files[name]
+}
+
+/*
+检查表from中每条记录的字段field都是表to的主键，字段为零值时不检查
+整数字段和主键的类型可以不同，比如int32的字段引用int的主键
+
+	m.AddCheck(recordfile.RefCheck("shop", "ItemId", "item"))
+*/
+func RefCheck(from, field, to string) func(t *Tables) error {
+	return func(t *Tables) error {
+		src, dst := t.Get(from), t.Get(to)
+		if src == nil || dst == nil {
+			return fmt.Errorf("ref %s.%s -> %s: table not found", from, field, to)
+		}
+		var errs Errors
+		for i, record := range src.Records() {
+			v := reflect.ValueOf(record).Elem().FieldByName(field)
+			if !v.IsValid() {
+				return fmt.Errorf("ref %s.%s -> %s: field not found", from, field, to)
+			}
+			if v.IsZero() {
+				continue
+			}
+			if dst.Index(v.Interface()) == nil {
+				errs = append(errs, fmt.Errorf("table %s: record %d: %s %v not found in %s", from, i+1, field, v.Interface(), to))
+			}
+		}
+		if len(errs) > 0 {
+			return errs
+		}
+		return nil
+	}
+}
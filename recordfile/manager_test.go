@@ -0,0 +1,71 @@
+package recordfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type shop struct {
+	Id     int   `rf:"index"`
+	ItemId int32 //引用item的int主键
+}
+
+func writeFile(t *testing.T, name, data string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManagerReload(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "item.tsv"), itemTSV)
+	writeFile(t, filepath.Join(dir, "shop.tsv"), "编号\t物品\n1\t1001\n2\t1003\n")
+
+	m := NewManager(dir)
+	m.Register("item", "item.tsv", item{})
+	m.Register("shop", "shop.tsv", shop{})
+	m.AddCheck(RefCheck("shop", "ItemId", "item"))
+	var loads int
+	m.OnLoad(func(old, new *Tables) { loads++ })
+	if err := m.Load(); err != nil {
+		t.Fatal(err)
+	}
+	first := m.Tables()
+	if first.Version() != 1 || first.Get("shop").NumRecord() != 2 || loads != 1 {
+		t.Fatalf("version %d, loads %d", first.Version(), loads)
+	}
+
+	// 引用了不存在的物品，整体加载失败，保留之前的数据
+	writeFile(t, filepath.Join(dir, "shop.tsv"), "编号\t物品\n1\t1001\n2\t9999\n3\t1002\n")
+	err := m.Load()
+	if err == nil || !strings.Contains(err.Error(), "ItemId 9999 not found in item") {
+		t.Fatalf("Load = %v", err)
+	}
+	if m.Tables() != first || loads != 1 {
+		t.Fatal("failed reload replaced tables")
+	}
+
+	// 两个文件同时出错时都报告出来
+	writeFile(t, filepath.Join(dir, "item.tsv"), "id\n1\n")
+	writeFile(t, filepath.Join(dir, "shop.tsv"), "编号\t物品\nx\t1\n")
+	if errs, ok := m.Load().(Errors); !ok || len(errs) != 2 {
+		t.Fatalf("Load = %v", errs)
+	}
+
+	writeFile(t, filepath.Join(dir, "item.tsv"), itemTSV)
+	writeFile(t, filepath.Join(dir, "shop.tsv"), "编号\t物品\n1\t1002\n")
+	if err := m.Load(); err != nil {
+		t.Fatal(err)
+	}
+	second := m.Tables()
+	if second.Version() != 2 || second.Get("shop").Index(1).(*shop).ItemId != 1002 || loads != 2 {
+		t.Fatalf("version %d", second.Version())
+	}
+	// 之前取得的快照不受影响
+	if first.Get("shop").NumRecord() != 2 {
+		t.Fatal("old snapshot changed")
+	}
+}
@@ -0,0 +1,384 @@
+package recordfile
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+策划配置表，把TSV/CSV文件读到结构体的切片中
+
+	type Item struct {
+		Id    int      `rf:"index"` //唯一索引，第一个唯一索引是主键
+		Name  string   `rf:"index"`
+		Type  int      `rf:"group"` //非唯一索引，一个值对应多条记录
+		Price float64
+		Tags  []string //列表：a;b;c 或 json ["a","b","c"]
+		Attr  map[string]int //json {"atk":10}
+	}
+
+	rf, err := recordfile.New(Item{})
+	err = rf.Read("item.tsv")
+	item := rf.Index(1001).(*Item)
+
+文件第一行是表头，列名只用于出错时的提示，之后每一行按结构体字段的顺序对应每一列。
+以 Comment 开头的行会被忽略，空的单元格是字段的零值。
+*/
+type RecordFile struct {
+	Comma    rune   //列分隔符，为0时按扩展名选择，.csv为逗号，其他为制表符
+	Comment  rune   //注释行的开头
+	ArraySep string //列表单元格的分隔符，默认分号
+
+	typeRecord reflect.Type
+	header     []string
+	records    []interface{}
+	indexes    map[string]Index //字段名 -> 唯一索引
+	groups     map[string]Group //字段名 -> 非唯一索引
+	primary    string           //主键字段名
+	fields     []reflect.StructField
+}
+
+// 唯一索引，值 -> 记录，整数的值统一保存为int64，见 IndexBy
+type Index map[interface{}]interface{}
+
+// 非唯一索引，值 -> 记录列表，整数的值统一保存为int64
+type Group map[interface{}][]interface{}
+
+/*
+索引的key，整数统一转换成int64（超出int64范围的uint64保持不变），
+int32的字段可以用 Index(1001) 查找，int32字段引用int主键时 RefCheck 也能找到
+*/
+func indexKey(key interface{}) interface{} {
+	switch k := key.(type) {
+	case int64, string, bool:
+		return key
+	case int:
+		return int64(k)
+	case int32:
+		return int64(k)
+	case uint32:
+		return int64(k)
+	}
+	v := reflect.ValueOf(key)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := v.Uint(); u <= math.MaxInt64 {
+			return int64(u)
+		}
+	}
+	return key
+}
+
+// 记录实现Validator时，读取每一行后调用Validate检查，出错时报告所在的行
+type Validator interface {
+	Validate() error
+}
+
+// 出错的位置，Column为0表示整行的错误
+type ParseError struct {
+	File       string
+	Row        int //行号，从1开始
+	Column     int //列号，从1开始
+	ColumnName string
+	Err        error
+}
+
+func (e *ParseError) Error() string {
+	if e.Column == 0 {
+		return fmt.Sprintf("%s: row %d: %v", e.File, e.Row, e.Err)
+	}
+	return fmt.Sprintf("%s: row %d column %d (%s): %v", e.File, e.Row, e.Column, e.ColumnName, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// 创建配置表，st为记录的结构体（或指向它的指针）
+func New(st interface{}) (*RecordFile, error) {
+	typeRecord := reflect.TypeOf(st)
+	if typeRecord != nil && typeRecord.Kind() == reflect.Ptr {
+		typeRecord = typeRecord.Elem()
+	}
+	if typeRecord == nil || typeRecord.Kind() != reflect.Struct {
+		return nil, errors.New("st must be a struct")
+	}
+
+	rf := &RecordFile{
+		Comment:    '#',
+		ArraySep:   ";",
+		typeRecord: typeRecord,
+	}
+	for i := 0; i < typeRecord.NumField(); i++ {
+		f := typeRecord.Field(i)
+		if f.PkgPath != "" {
+			return nil, fmt.Errorf("field %s must be exported", f.Name)
+		}
+		if err := checkKind(f.Type); err != nil {
+			return nil, fmt.Errorf("field %s: %v", f.Name, err)
+		}
+		switch tag := f.Tag.Get("rf"); tag {
+		case "":
+		case "index", "group":
+			if !isKeyKind(f.Type.Kind()) {
+				return nil, fmt.Errorf("field %s: %s must be bool, number or string", f.Name, tag)
+			}
+			if tag == "index" && rf.primary == "" {
+				rf.primary = f.Name
+			}
+		default:
+			return nil, fmt.Errorf("field %s: unknown tag rf:%q", f.Name, tag)
+		}
+		rf.fields = append(rf.fields, f)
+	}
+	return rf, nil
+}
+
+func isKeyKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func checkKind(t reflect.Type) error {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct, reflect.Ptr, reflect.Interface:
+		return nil
+	}
+	if isKeyKind(t.Kind()) {
+		return nil
+	}
+	return fmt.Errorf("unsupported type %s", t)
+}
+
+// 读取配置表文件，成功后替换之前的全部记录和索引
+func (rf *RecordFile) Read(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	comma := rf.Comma
+	if comma == 0 {
+		comma = '\t'
+		if strings.EqualFold(filepath.Ext(name), ".csv") {
+			comma = ','
+		}
+	}
+	return rf.parse(file, name, comma)
+}
+
+// 从r读取配置表，name只用于出错时的提示，Comma为0时使用制表符
+func (rf *RecordFile) Parse(r io.Reader, name string) error {
+	comma := rf.Comma
+	if comma == 0 {
+		comma = '\t'
+	}
+	return rf.parse(r, name, comma)
+}
+
+func (rf *RecordFile) parse(r io.Reader, name string, comma rune) error {
+	reader := csv.NewReader(r)
+	reader.Comma = comma
+	reader.Comment = rf.Comment
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true //单元格中的json不需要额外转义
+
+	var header []string
+	var records []interface{}
+	indexes := make(map[string]Index)
+	groups := make(map[string]Group)
+	for _, f := range rf.fields {
+		switch f.Tag.Get("rf") {
+		case "index":
+			indexes[f.Name] = make(Index)
+		case "group":
+			groups[f.Name] = make(Group)
+		}
+	}
+
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var pe *csv.ParseError
+			if errors.As(err, &pe) {
+				return &ParseError{File: name, Row: pe.Line, Err: pe.Err}
+			}
+			return &ParseError{File: name, Err: err}
+		}
+		row, _ := reader.FieldPos(0)
+		if header == nil {
+			header = line
+			continue
+		}
+		if len(line) != len(rf.fields) {
+			return &ParseError{File: name, Row: row,
+				Err: fmt.Errorf("got %d columns, want %d", len(line), len(rf.fields))}
+		}
+
+		record := reflect.New(rf.typeRecord)
+		v := record.Elem()
+		for i, f := range rf.fields {
+			if err := rf.setCell(v.Field(i), strings.TrimSpace(line[i])); err != nil {
+				return rf.cellError(name, row, i, header, err)
+			}
+			key := indexKey(v.Field(i).Interface())
+			switch f.Tag.Get("rf") {
+			case "index":
+				if _, ok := indexes[f.Name][key]; ok {
+					return rf.cellError(name, row, i, header, fmt.Errorf("duplicate %s %v", f.Name, v.Field(i).Interface()))
+				}
+				indexes[f.Name][key] = record.Interface()
+			case "group":
+				groups[f.Name][key] = append(groups[f.Name][key], record.Interface())
+			}
+		}
+		if validator, ok := record.Interface().(Validator); ok {
+			if err := validator.Validate(); err != nil {
+				return &ParseError{File: name, Row: row, Err: err}
+			}
+		}
+		records = append(records, record.Interface())
+	}
+
+	rf.header = header
+	rf.records = records
+	rf.indexes = indexes
+	rf.groups = groups
+	return nil
+}
+
+func (rf *RecordFile) cellError(name string, row, i int, header []string, err error) error {
+	columnName := rf.fields[i].Name
+	if i < len(header) && header[i] != "" {
+		columnName = header[i]
+	}
+	return &ParseError{File: name, Row: row, Column: i + 1, ColumnName: columnName, Err: err}
+}
+
+// 把单元格解析成字段的类型，空的单元格是零值
+func (rf *RecordFile) setCell(v reflect.Value, s string) error {
+	if s == "" {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid bool %q", s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", v.Type(), s)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", v.Type(), s)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", v.Type(), s)
+		}
+		v.SetFloat(n)
+	case reflect.Slice, reflect.Array:
+		// json格式，或者用ArraySep分隔的列表
+		if strings.HasPrefix(s, "[") {
+			return unmarshalCell(v, s)
+		}
+		items := strings.Split(s, rf.ArraySep)
+		if v.Kind() == reflect.Array && len(items) > v.Len() {
+			return fmt.Errorf("got %d items, want at most %d", len(items), v.Len())
+		}
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(v.Type(), len(items), len(items)))
+		}
+		for i, item := range items {
+			if err := rf.setCell(v.Index(i), strings.TrimSpace(item)); err != nil {
+				return fmt.Errorf("item %d: %v", i+1, err)
+			}
+		}
+	default:
+		// map struct 等使用json格式
+		return unmarshalCell(v, s)
+	}
+	return nil
+}
+
+func unmarshalCell(v reflect.Value, s string) error {
+	if err := json.Unmarshal([]byte(s), v.Addr().Interface()); err != nil {
+		return fmt.Errorf("invalid json %q: %v", s, err)
+	}
+	return nil
+}
+
+// 记录的数量
+func (rf *RecordFile) NumRecord() int {
+	return len(rf.records)
+}
+
+// 第i条记录，类型是指向记录结构体的指针
+func (rf *RecordFile) Record(i int) interface{} {
+	return rf.records[i]
+}
+
+// 全部记录，按文件中的顺序
+func (rf *RecordFile) Records() []interface{} {
+	return rf.records
+}
+
+// 表头
+func (rf *RecordFile) Header() []string {
+	return rf.header
+}
+
+// 按主键（第一个唯一索引）查找记录，找不到时返回nil
+func (rf *RecordFile) Index(key interface{}) interface{} {
+	if rf.primary == "" {
+		return nil
+	}
+	return rf.IndexBy(rf.primary, key)
+}
+
+// 按字段field的唯一索引查找记录，找不到时返回nil
+// 整数的key不需要和字段的类型一致，其他类型需要完全一致
+func (rf *RecordFile) IndexBy(field string, key interface{}) interface{} {
+	return rf.indexes[field][indexKey(key)]
+}
+
+// 字段field的唯一索引，整数字段的key是int64
+func (rf *RecordFile) Indexes(field string) Index {
+	return rf.indexes[field]
+}
+
+// 按字段field的非唯一索引查找记录
+func (rf *RecordFile) Group(field string, key interface{}) []interface{} {
+	return rf.groups[field][indexKey(key)]
+}
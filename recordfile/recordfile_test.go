@@ -0,0 +1,125 @@
+package recordfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type item struct {
+	Id    int    `rf:"index"`
+	Name  string `rf:"index"`
+	Type  int    `rf:"group"`
+	Price float64
+	Sale  bool
+	Tags  []string
+	Pos   [2]int
+	Attr  map[string]int
+}
+
+func (it *item) Validate() error {
+	if it.Price < 0 {
+		return errors.New("negative price")
+	}
+	return nil
+}
+
+const itemTSV = `编号	名字	类型	价格	打折	标签	坐标	属性
+# 注释行
+1001	sword	1	9.5	true	a;b	1;2	{"atk":10}
+1002	shield	1	12	false	["c"]	[3,4]	
+1003	potion	2	1	0			
+`
+
+func TestRead(t *testing.T) {
+	rf, err := New(item{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "item.tsv")
+	if err := os.WriteFile(name, []byte(itemTSV), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.Read(name); err != nil {
+		t.Fatal(err)
+	}
+	if rf.NumRecord() != 3 {
+		t.Fatalf("NumRecord = %d", rf.NumRecord())
+	}
+
+	want := &item{Id: 1001, Name: "sword", Type: 1, Price: 9.5, Sale: true, Tags: []string{"a", "b"}, Pos: [2]int{1, 2}, Attr: map[string]int{"atk": 10}}
+	if got := rf.Index(1001); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Index(1001) = %+v", got)
+	}
+	if got := rf.IndexBy("Name", "shield").(*item); got.Id != 1002 || got.Tags[0] != "c" || got.Pos != [2]int{3, 4} {
+		t.Fatalf("IndexBy(Name, shield) = %+v", got)
+	}
+	if got := rf.Group("Type", 1); len(got) != 2 {
+		t.Fatalf("Group(Type, 1) = %d records", len(got))
+	}
+	if rf.Index(9999) != nil {
+		t.Fatal("Index(9999) != nil")
+	}
+
+	// 整数的key不需要和字段的类型一致
+	type itemID uint16
+	for _, key := range []interface{}{int32(1001), int64(1001), uint16(1001), itemID(1001)} {
+		if got := rf.Index(key); got != rf.Index(1001) {
+			t.Fatalf("Index(%T 1001) = %v", key, got)
+		}
+	}
+	if got := rf.Group("Type", int8(2)); len(got) != 1 {
+		t.Fatalf("Group(Type, int8 2) = %d records", len(got))
+	}
+	if rf.Index("1001") != nil || rf.Index(1001.0) != nil {
+		t.Fatal("non-integer key matched integer index")
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"h\n1001\tsword\tx\t1\t0\t\t\t\n", "row 2 column 3 (Type): invalid int \"x\""},
+		{"h1\th2\th3\th4\th5\th6\th7\th8\n1\ta\t1\t1\t0\t\t\t\n1\tb\t1\t1\t0\t\t\t\n", "row 3 column 1 (h1): duplicate Id 1"},
+		{"h\n1\ta\t1\t-1\t0\t\t\t\n", "row 2: negative price"},
+		{"h\n1\ta\t1\n", "row 2: got 3 columns, want 8"},
+		{"h\n1\ta\t1\t1\t0\t\t\t{bad\n", "column 8"},
+	}
+	for _, tt := range tests {
+		rf, err := New(&item{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rf.Parse(strings.NewReader(tt.data), "item.tsv")
+		var pe *ParseError
+		if !errors.As(err, &pe) || !strings.Contains(err.Error(), tt.want) {
+			t.Fatalf("err = %v, want %q", err, tt.want)
+		}
+	}
+}
+
+func TestCSV(t *testing.T) {
+	type pair struct {
+		Key   string `rf:"index"`
+		Value []int
+	}
+	rf, err := New(pair{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "pair.csv")
+	if err := os.WriteFile(name, []byte("key,value\na,\"[1,2]\"\nb,3;4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.Read(name); err != nil {
+		t.Fatal(err)
+	}
+	if got := rf.Index("b").(*pair); !reflect.DeepEqual(got.Value, []int{3, 4}) {
+		t.Fatalf("b = %v", got.Value)
+	}
+}
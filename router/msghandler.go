@@ -1,58 +1,138 @@
 package router
 
 import (
-	"fmt"
 	"gobonbon/conf"
 	"gobonbon/iface"
+	"gobonbon/log"
+	"gobonbon/metrics"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// 路由和worker的日志，等级可以用 log.SetModuleLevel("router", ...) 单独调整
+var routerLog = log.Module("router")
+
+// 一段MsgId [Min, Max] 对应的处理方法，比如网关转发给后端节点的消息
+type RouterRange struct {
+	Min    uint32
+	Max    uint32
+	Router iface.IRouter
+}
+
 type MsgHandle struct {
-	Apis           map[uint32]iface.IRouter //存放每个MsgId 所对应的处理方法的map属性
-	WorkerPoolSize uint64                   //业务工作Worker池的数量
-	TaskQueue      []chan iface.IRequest    //Worker负责取任务的消息队列
+	pending          int64                    //交给TaskQueue还没有处理完的请求数，放在第一个保证64位对齐
+	lock             sync.RWMutex             //保护Apis和Ranges，其他goroutine读取时用 Routes
+	Apis             map[uint32]iface.IRouter //存放每个MsgId 所对应的处理方法的map属性
+	Ranges           []RouterRange            //按MsgId范围注册的处理方法，Apis中找不到时使用
+	WorkerPoolSize   uint64                   //业务工作Worker池的数量
+	MaxWorkerTaskLen uint64                   //每个Worker任务队列的长度
+	TaskQueue        []chan iface.IRequest    //Worker负责取任务的消息队列
 }
 
+// 使用全局配置 conf.Get() 中的 WorkerPoolSize 和 MaxWorkerTaskLen，创建之后配置的修改不会生效
 func NewMsgHandle() *MsgHandle {
+	cfg := conf.Get()
+	return NewMsgHandleWithPool(cfg.WorkerPoolSize, cfg.MaxWorkerTaskLen)
+}
+
+// 指定Worker池的数量和每个Worker任务队列的长度，
+// 都为0时不使用Worker池，SendMsgToTaskQueue 直接在调用者的goroutine中处理
+func NewMsgHandleWithPool(workerPoolSize, maxWorkerTaskLen uint64) *MsgHandle {
 	return &MsgHandle{
-		Apis:           make(map[uint32]iface.IRouter),
-		WorkerPoolSize: conf.GlobalObject.WorkerPoolSize,
-		TaskQueue:      make([]chan iface.IRequest, conf.GlobalObject.WorkerPoolSize), //一个worker对应一个queue
+		Apis:             make(map[uint32]iface.IRouter),
+		WorkerPoolSize:   workerPoolSize,
+		MaxWorkerTaskLen: maxWorkerTaskLen,
+		TaskQueue:        make([]chan iface.IRequest, workerPoolSize), //一个worker对应一个queue
 	}
 }
 
 // 以非阻塞方式处理消息
 func (mh *MsgHandle) DoMsgHandler(request iface.IRequest) {
-	fmt.Println("DoMsgHandler", request.GetMsgID())
+	mh.lock.RLock()
 	handler, ok := mh.Apis[request.GetMsgID()]
 	if !ok {
-		fmt.Println("api msgId = ", request.GetMsgID(), " is not FOUND!")
+		handler, ok = mh.rangeRouter(request.GetMsgID())
+	}
+	mh.lock.RUnlock()
+	if !ok {
+		routerLog.With("connID", request.GetConnection().GetConnID(), "msgId", request.GetMsgID()).Warn("api is not found")
 		return
 	}
 	// 绑定路由
 	request.BindRouter(handler)
+	start := time.Now()
 	request.Call()
+	metrics.HandlerLatency.WithLabelValues(metrics.MsgLabel(request.GetMsgID())).Observe(time.Since(start).Seconds())
 }
 
 // 为消息添加具体的处理逻辑
 func (mh *MsgHandle) AddRouter(msgId uint32, router iface.IRouter) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
 	//1 判断当前msg绑定的API处理方法是否已经存在
 	if _, ok := mh.Apis[msgId]; ok {
 		panic("repeated api , msgId = " + strconv.Itoa(int(msgId)))
 	}
+	if _, ok := mh.rangeRouter(msgId); ok {
+		panic("api in registered range , msgId = " + strconv.Itoa(int(msgId)))
+	}
 	//2 添加msg与api的绑定关系
 	mh.Apis[msgId] = router
-	fmt.Println("Add api msgId = ", msgId)
+	routerLog.With("msgId", msgId).Debug("add api")
+}
+
+// 为一段MsgId [min, max] 添加同一个处理逻辑，和已经注册的MsgId或范围重叠时panic
+func (mh *MsgHandle) AddRouterRange(min, max uint32, router iface.IRouter) {
+	if min > max {
+		panic("invalid api range , min = " + strconv.Itoa(int(min)) + " max = " + strconv.Itoa(int(max)))
+	}
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+	for _, r := range mh.Ranges {
+		if min <= r.Max && r.Min <= max {
+			panic("repeated api range , min = " + strconv.Itoa(int(min)) + " max = " + strconv.Itoa(int(max)))
+		}
+	}
+	for msgId := range mh.Apis {
+		if msgId >= min && msgId <= max {
+			panic("repeated api , msgId = " + strconv.Itoa(int(msgId)))
+		}
+	}
+	mh.Ranges = append(mh.Ranges, RouterRange{Min: min, Max: max, Router: router})
+	routerLog.With("min", min, "max", max).Debug("add api range")
+}
+
+// 已注册的路由的副本，可以在其他goroutine中和AddRouter同时调用
+func (mh *MsgHandle) Routes() (map[uint32]iface.IRouter, []RouterRange) {
+	mh.lock.RLock()
+	defer mh.lock.RUnlock()
+	apis := make(map[uint32]iface.IRouter, len(mh.Apis))
+	for msgId, router := range mh.Apis {
+		apis[msgId] = router
+	}
+	return apis, append([]RouterRange(nil), mh.Ranges...)
+}
+
+// 查找包含msgId的范围，范围不多，直接遍历，调用时需要持有lock
+func (mh *MsgHandle) rangeRouter(msgId uint32) (iface.IRouter, bool) {
+	for _, r := range mh.Ranges {
+		if msgId >= r.Min && msgId <= r.Max {
+			return r.Router, true
+		}
+	}
+	return nil, false
 }
 
 // 启动worker工作池
 func (mh *MsgHandle) StartWorkerPool() {
-	fmt.Println("Worker is started.")
+	routerLog.With("workerPoolSize", mh.WorkerPoolSize).Debug("worker pool is starting")
 	//遍历需要启动worker的数量，依此启动
 	for i := 0; i < int(mh.WorkerPoolSize); i++ {
 		//一个worker被启动
 		//给当前worker对应的任务队列开辟空间
-		mh.TaskQueue[i] = make(chan iface.IRequest, conf.GlobalObject.MaxWorkerTaskLen)
+		mh.TaskQueue[i] = make(chan iface.IRequest, mh.MaxWorkerTaskLen)
 		//启动当前Worker，阻塞的等待对应的任务队列是否有消息传递进来
 		go mh.StartOneWorker(i, mh.TaskQueue[i])
 	}
@@ -60,26 +140,46 @@ func (mh *MsgHandle) StartWorkerPool() {
 
 // 启动一个Worker工作流程
 func (mh *MsgHandle) StartOneWorker(workerID int, taskQueue chan iface.IRequest) {
-	fmt.Println("Worker ID = ", workerID, " is started.")
+	routerLog.With("workerID", workerID).Debug("worker is started")
 	//不断的等待队列中的消息
 	for {
 		select {
 		//有消息则取出队列的Request，并执行绑定的业务方法
 		case request := <-taskQueue:
-			fmt.Println("request= ", request.GetMsgID())
+			metrics.WorkerQueueLen.WithLabelValues(strconv.Itoa(workerID)).Set(float64(len(taskQueue)))
 			mh.DoMsgHandler(request)
+			atomic.AddInt64(&mh.pending, -1)
 		}
 	}
 }
 
-// 将消息交给TaskQueue,由worker进行处理
+// 获取每个worker任务队列中等待的请求数
+func (mh *MsgHandle) QueueLens() []int {
+	lens := make([]int, len(mh.TaskQueue))
+	for i, queue := range mh.TaskQueue {
+		lens[i] = len(queue)
+	}
+	return lens
+}
+
+// 交给TaskQueue还没有处理完的请求数，包括正在处理的请求
+func (mh *MsgHandle) Pending() int {
+	return int(atomic.LoadInt64(&mh.pending))
+}
+
+// 将消息交给TaskQueue,由worker进行处理；没有Worker池时直接处理
 func (mh *MsgHandle) SendMsgToTaskQueue(request iface.IRequest) {
+	if mh.WorkerPoolSize == 0 {
+		mh.DoMsgHandler(request)
+		return
+	}
 	//根据ConnID来分配当前的连接应该由哪个worker负责处理
 	//轮询的平均分配法则
 
 	//得到需要处理此条连接的workerID
 	workerID := request.GetConnection().GetConnID() % mh.WorkerPoolSize
-	//fmt.Println("Add ConnID=", request.GetConnection().GetConnID()," request msgID=", request.GetMsgID(), "to workerID=", workerID)
 	//将请求消息发送给任务队列
+	atomic.AddInt64(&mh.pending, 1)
 	mh.TaskQueue[workerID] <- request
+	metrics.WorkerQueueLen.WithLabelValues(strconv.FormatUint(workerID, 10)).Set(float64(len(mh.TaskQueue[workerID])))
 }
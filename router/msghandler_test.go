@@ -0,0 +1,34 @@
+package router_test
+
+import (
+	"gobonbon/iface"
+	"gobonbon/msgparser"
+	"gobonbon/nettest"
+	"gobonbon/network"
+	"gobonbon/router"
+	"testing"
+)
+
+type countRouter struct {
+	router.BaseRouter
+	n int
+}
+
+func (r *countRouter) Handle(req iface.IRequest) {
+	r.n++
+}
+
+// 没有Worker池时 SendMsgToTaskQueue 直接处理，不会除以0
+func TestSendMsgWithoutWorkerPool(t *testing.T) {
+	mh := router.NewMsgHandleWithPool(0, 0)
+	r := &countRouter{}
+	mh.AddRouter(1, r)
+	mh.StartWorkerPool()
+	conn, _ := nettest.Pipe()
+	for i := 0; i < 3; i++ {
+		mh.SendMsgToTaskQueue(network.NewRequest(conn, msgparser.NewMsgPackage(1, nil)))
+	}
+	if r.n != 3 || mh.Pending() != 0 {
+		t.Fatalf("handled %d, pending %d", r.n, mh.Pending())
+	}
+}
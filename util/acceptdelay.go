@@ -1,6 +1,7 @@
 package util
 
 import (
+	"sync"
 	"time"
 )
 
@@ -8,38 +9,58 @@ const (
 	maxDelay = 1 * time.Second
 )
 
-var AcceptDelay *acceptDelay
+// AcceptDelay 全局的accept退避对象，保留给旧代码使用；新代码请每个监听器各自 NewAcceptDelay
+var AcceptDelay *AcceptDelayer
 
 func init() {
-	AcceptDelay = &acceptDelay{duration: 0}
+	AcceptDelay = NewAcceptDelay()
 }
 
-type acceptDelay struct {
+// AcceptDelayer accept失败时的指数退避，5ms起步，最大1s，可以被多个goroutine同时使用
+type AcceptDelayer struct {
+	lock     sync.Mutex
 	duration time.Duration
 }
 
-func (d *acceptDelay) Delay() {
-	d.Up()
-	d.do()
+func NewAcceptDelay() *AcceptDelayer {
+	return &AcceptDelayer{duration: 0}
 }
 
-func (d *acceptDelay) Reset() {
+// Delay 增加退避时长并休眠，休眠时不持有锁
+func (d *AcceptDelayer) Delay() {
+	d.do(d.Up())
+}
+
+func (d *AcceptDelayer) Reset() {
+	d.lock.Lock()
 	d.duration = 0
+	d.lock.Unlock()
 }
 
-func (d *acceptDelay) Up() {
+// Up 增加退避时长，返回增加后的时长
+func (d *AcceptDelayer) Up() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	if d.duration == 0 {
 		d.duration = 5 * time.Millisecond
-		return
+		return d.duration
 	}
 	d.duration = 2 * d.duration
 	if d.duration > maxDelay {
 		d.duration = maxDelay
 	}
+	return d.duration
+}
+
+// Duration 当前的退避时长
+func (d *AcceptDelayer) Duration() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.duration
 }
 
-func (d *acceptDelay) do() {
-	if d.duration > 0 {
-		time.Sleep(d.duration)
+func (d *AcceptDelayer) do(duration time.Duration) {
+	if duration > 0 {
+		time.Sleep(duration)
 	}
 }
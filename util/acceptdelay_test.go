@@ -0,0 +1,64 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcceptDelay(t *testing.T) {
+	d := NewAcceptDelay()
+	if d.Duration() != 0 {
+		t.Fatalf("initial duration %v", d.Duration())
+	}
+	want := []time.Duration{
+		5 * time.Millisecond,
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		80 * time.Millisecond,
+		160 * time.Millisecond,
+		320 * time.Millisecond,
+		640 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, w := range want {
+		if got := d.Up(); got != w || d.Duration() != w {
+			t.Fatalf("Up %d = %v, want %v", i, got, w)
+		}
+	}
+
+	d.Reset()
+	if d.Duration() != 0 {
+		t.Fatalf("duration after reset %v", d.Duration())
+	}
+	start := time.Now()
+	d.Delay()
+	if elapsed := time.Since(start); elapsed < 5*time.Millisecond {
+		t.Fatalf("Delay slept %v, want at least 5ms", elapsed)
+	}
+	if d.Duration() != 5*time.Millisecond {
+		t.Fatalf("duration after delay %v", d.Duration())
+	}
+}
+
+// 多个goroutine同时退避，用 -race 运行
+func TestAcceptDelayConcurrent(t *testing.T) {
+	d := NewAcceptDelay()
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			for j := 0; j < 20; j++ {
+				d.Up()
+				d.Duration()
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	if d.Duration() != maxDelay {
+		t.Fatalf("duration %v, want %v", d.Duration(), maxDelay)
+	}
+}
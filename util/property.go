@@ -0,0 +1,52 @@
+package util
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrPropertyNotFound = errors.New("no property found")
+
+// ConnProperty 连接属性，嵌入到各种连接中实现 iface.IConn 的属性方法，可以被多个goroutine同时使用
+type ConnProperty struct {
+	propertyLock sync.RWMutex
+	property     map[string]interface{}
+}
+
+// 设置链接属性
+func (p *ConnProperty) SetProperty(key string, value interface{}) {
+	p.propertyLock.Lock()
+	defer p.propertyLock.Unlock()
+	if p.property == nil {
+		p.property = make(map[string]interface{})
+	}
+	p.property[key] = value
+}
+
+// 获取链接属性
+func (p *ConnProperty) GetProperty(key string) (interface{}, error) {
+	p.propertyLock.RLock()
+	defer p.propertyLock.RUnlock()
+	if value, ok := p.property[key]; ok {
+		return value, nil
+	}
+	return nil, ErrPropertyNotFound
+}
+
+// 移除链接属性
+func (p *ConnProperty) RemoveProperty(key string) {
+	p.propertyLock.Lock()
+	defer p.propertyLock.Unlock()
+	delete(p.property, key)
+}
+
+// 获取全部链接属性的副本
+func (p *ConnProperty) Properties() map[string]interface{} {
+	p.propertyLock.RLock()
+	defer p.propertyLock.RUnlock()
+	props := make(map[string]interface{}, len(p.property))
+	for k, v := range p.property {
+		props[k] = v
+	}
+	return props
+}